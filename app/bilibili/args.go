@@ -1,12 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/coghost/bilibili_cache_converter/bilibili"
 	"github.com/coghost/pathlib"
 	"github.com/coghost/xpretty"
 	"github.com/joho/godotenv"
@@ -17,25 +20,75 @@ type Args struct {
 	// OutputDir where to save the converted files
 	OutputDir string `arg:"-o,--output-dir,env:BL_OUTPUT_DIR" help:"Directory to save converted files"`
 	Ffmpeg    string `arg:"--ffmpeg-bin,env:BL_FFMPEG" help:"Path to ffmpeg binary"`
+	Muxer     string `arg:"--muxer,env:BL_MUXER" default:"native" help:"Muxer backend: native(no ffmpeg required) / ffmpeg"`
+
+	// Profile of codecs and container
+	Profile       string `arg:"--profile,env:BL_PROFILE" default:"copy" help:"Output profile: copy / mobile-720p / archive-hevc / audio-only / audio-mp3 / audio-opus, or one defined in --profile-config"`
+	ProfileConfig string `arg:"--profile-config,env:BL_PROFILE_CONFIG" help:"Json file of custom profiles, e.g. {\"profiles\": {\"custom\": {\"videoCodec\": \"libx264\", \"crf\": 28}}}"`
+
+	// AudioOnly extracts the audio, e.g. of music and talks
+	AudioOnly   bool   `arg:"--audio-only,env:BL_AUDIO_ONLY" default:"false" help:"Extract the audio only, tagged(artist, album, track) with the cover art, named by the preset audio unless --name-template is set"`
+	AudioFormat string `arg:"--audio-format,env:BL_AUDIO_FORMAT" default:"m4a" help:"Format of --audio-only: m4a(no re-encoding) / mp3 / opus"`
+
+	// ToAVC re-encodes hevc/av1 videos
+	ToAVC bool `arg:"--to-avc,env:BL_TO_AVC" default:"false" help:"Transcode HEVC/AV1 videos to AVC(h.264) by ffmpeg for devices that can't play them"`
+
+	// Validator checks the mp4 after converting
+	Validator         string        `arg:"--validate,env:BL_VALIDATE" default:"native" help:"Check tracks, duration and codecs of the mp4 after converting: native / ffprobe / none"`
+	DurationTolerance time.Duration `arg:"--duration-tolerance,env:BL_DURATION_TOLERANCE" default:"2s" help:"Gap allowed between the mp4 and the cached duration"`
 
 	// Actions
 	By string `arg:"--by" default:"group" help:"Conversion scope: g(group) /v(video)"`
 
+	// Stream reads cache files in place
+	Stream bool `arg:"--stream,env:BL_STREAM" default:"false" help:"Read cache files in place instead of copying them without the cache prefix first(needs no extra disk space)"`
+
+	// Non-interactive selection, conditions are combined
+	All      bool   `arg:"--all" default:"false" help:"Select all cached videos without prompts"`
+	Group    string `arg:"--group" help:"Select videos by group id or group title regex without prompts"`
+	Video    string `arg:"--video" help:"Select the video by item id without prompts"`
+	Bvid     string `arg:"--bvid" help:"Select videos by bvid without prompts"`
+	Uploader string `arg:"--uploader" help:"Select videos by uploader name or uid without prompts"`
+
+	// Jobs converts videos in parallel
+	Jobs int `arg:"-j,--jobs,env:BL_JOBS" default:"1" help:"Number of videos converted in parallel"`
+
+	// SummaryJSON saves the run summary
+	SummaryJSON string `arg:"--summary-json,env:BL_SUMMARY_JSON" help:"Save the summary of converted/skipped/failed videos into this json file"`
+
 	// Scan do scan
 	Scan bool `arg:"--scan" default:"false" help:"Scan and list(instead of converting) available cache files with the type from '--by'"`
+	// Format of --scan output
+	Format string `arg:"--format" default:"tree" help:"Output format of --scan: tree/json/ndjson/csv/table"`
 	// Force merge, in case you want to overwrite existed one.
 	Force bool `arg:"--force" default:"false" help:"Force merge even if output file already exists"`
 
 	// Clean up cleans downloaded cache file.
-	Clean bool `arg:"--clean" default:"false" help:"Clean cache(Warn: cached files will be delete forever)"`
+	Clean bool `arg:"--clean" default:"false" help:"Clean cache of converted videos(Warn: cached files will be delete forever unless --trash-dir is set)"`
+	// TrashDir keeps the cleaned cache folders.
+	TrashDir string `arg:"--trash-dir,env:BL_TRASH_DIR" help:"Move cleaned cache folders into this dir instead of deleting them"`
+
+	// Verify checks the cache folders without converting.
+	Verify bool `arg:"--verify" default:"false" help:"Check whether the selected caches are ready(completely downloaded and intact) instead of converting"`
+	// AllowIncomplete converts caches that are not ready.
+	AllowIncomplete bool `arg:"--allow-incomplete,env:BL_ALLOW_INCOMPLETE" default:"false" help:"Convert caches that are incomplete or corrupt instead of skipping them"`
 
 	// GetSubtitle will try to get subtitle from Internet.
 	GetSubtitle bool `arg:"--subtitle" default:"false" help:"Download subtitle(may not working)"`
+	// NoMetadata skips tags and cover art.
+	NoMetadata bool `arg:"--no-metadata" default:"false" help:"Do not write tags(title, uploader, group...) and cover art into the mp4"`
+	// Danmaku exports bullet comments as subtitles.
+	Danmaku bool `arg:"--danmaku" default:"false" help:"Export danmaku(bullet comments) as xml and ass subtitles next to the mp4"`
+
+	// NFO exports sidecars for media servers.
+	NFO bool `arg:"--nfo,env:BL_NFO" default:"false" help:"Export Kodi/Jellyfin nfo and artwork(folder.jpg, poster.jpg, -thumb.jpg) next to the mp4"`
 	// use uploader name as subdir or not
 	UploaderAsSubDir bool `arg:"--uploader-as-subdir" default:"false" help:"Use uploader name as a subdirectory of the output dir"`
+	// NameTemplate of output files, overrides --uploader-as-subdir
+	NameTemplate string `arg:"--name-template,env:BL_NAME_TEMPLATE" help:"Output filename: preset group/uploader/pgc/audio, or a go template like '{{.Uname}}/{{.GroupTitle}}/{{pad .P 3}} - {{.Title}} [{{.Bvid}}]'"`
 
 	InitEnv bool `arg:"--init" help:"Init the running env(.env) file"`
-	DryRun  bool `arg:"--dry-run" help:"Print arguments and exit without converting"`
+	DryRun  bool `arg:"--dry-run" help:"Print arguments and exit without converting, or list what --clean would remove"`
 	Version bool `arg:"--version" help:"Display version and exit"`
 }
 
@@ -56,10 +109,13 @@ func LoadEnvArgs(versions ...string) *Args {
 		os.Exit(0)
 	}
 
-	xpretty.GreenPrintf("%s\n Input dir: %s\nOutput dir: %s\n%s\n", strings.Repeat("-", 32), args.InputDir, args.OutputDir, strings.Repeat("-", 32))
+	// keep stdout clean for the machine readable scan output
+	if !args.Scan || args.Format == formatTree {
+		xpretty.GreenPrintf("%s\n Input dir: %s\nOutput dir: %s\n%s\n", strings.Repeat("-", 32), args.InputDir, args.OutputDir, strings.Repeat("-", 32))
+	}
 
 	showVersionAndExit(args.Version, versions...)
-	if args.DryRun {
+	if args.DryRun && !args.Clean {
 		dryRunAndExit(args)
 	}
 
@@ -77,9 +133,28 @@ func (args *Args) Validate() error {
 		dryRunAndExit(args)
 	}
 
+	if args.AudioOnly && args.Profile != bilibili.ProfileCopy {
+		return fmt.Errorf("--audio-only conflicts with --profile %s, use --audio-format instead", args.Profile)
+	}
+
+	if !isScanFormat(args.Format) {
+		return fmt.Errorf("unknown --format %q, available: %v", args.Format, _scanFormats)
+	}
+
 	return nil
 }
 
+// VideoFilter returns the non-interactive selection, empty if none is set.
+func (args *Args) VideoFilter() *bilibili.VideoFilter {
+	return &bilibili.VideoFilter{
+		All:      args.All,
+		Group:    args.Group,
+		Video:    args.Video,
+		Bvid:     args.Bvid,
+		Uploader: args.Uploader,
+	}
+}
+
 func dryRunAndExit(args *Args) {
 	_ = xpretty.PrettyStruct(args)
 
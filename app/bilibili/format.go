@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/coghost/bilibili_cache_converter/bilibili"
+	"github.com/coghost/bilibili_cache_converter/utils"
+	"github.com/pterm/pterm"
+)
+
+// output formats of --scan
+const (
+	formatTree   = "tree"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+	formatTable  = "table"
+)
+
+var _scanFormats = []string{formatTree, formatJSON, formatNDJSON, formatCSV, formatTable}
+
+var _scanColumns = []string{
+	"group_title", "group_id", "p", "title", "item_id", "bvid", "uploader",
+	"quality", "codec", "duration", "size", "m4s_variant", "cache_format", "converted", "cache_path", "output",
+}
+
+func isScanFormat(format string) bool {
+	return slices.Contains(_scanFormats, format)
+}
+
+// writeScan writes groups in the machine readable formats, tree is rendered by scanLocal.
+func writeScan(w io.Writer, format string, groups []*bilibili.ScanGroup) error {
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(groups)
+	case formatNDJSON:
+		enc := json.NewEncoder(w)
+
+		for _, group := range groups {
+			for _, entry := range group.Videos {
+				if err := enc.Encode(entry); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(_scanColumns); err != nil {
+			return err
+		}
+
+		for _, group := range groups {
+			for _, entry := range group.Videos {
+				if err := cw.Write(scanRow(group, entry, strconv.FormatInt(entry.Size, 10))); err != nil {
+					return err
+				}
+			}
+		}
+
+		cw.Flush()
+
+		return cw.Error()
+	case formatTable:
+		data := pterm.TableData{_scanColumns}
+
+		for _, group := range groups {
+			for _, entry := range group.Videos {
+				data = append(data, scanRow(group, entry, utils.FormatBytes(entry.Size)))
+			}
+		}
+
+		return pterm.DefaultTable.WithHasHeader().WithWriter(w).WithData(data).Render()
+	}
+
+	return fmt.Errorf("unknown format %q, available: %v", format, _scanFormats)
+}
+
+func scanRow(group *bilibili.ScanGroup, entry *bilibili.ScanEntry, size string) []string {
+	return []string{
+		group.Title,
+		group.GroupID,
+		strconv.Itoa(entry.P),
+		entry.Title,
+		entry.ItemID,
+		entry.Bvid,
+		entry.Uname,
+		entry.Quality,
+		entry.Codec,
+		strconv.Itoa(entry.Duration),
+		size,
+		string(entry.M4SVariant),
+		entry.CacheFormat,
+		strconv.FormatBool(entry.Converted),
+		entry.CachePath,
+		entry.Output,
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"maps"
 	"os"
+	"os/signal"
 	"path"
 	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/coghost/bilibili_cache_converter/bilibili"
@@ -31,21 +35,60 @@ const (
 	byVideo = "video"
 )
 
+// _exitFailed is the exit code when any video failed to convert
+const _exitFailed = 1
+
 func main() {
 	args := LoadEnvArgs(versions.Version)
 	run(args)
 }
 
+// loadProfile returns the profile of --profile, or the one of --audio-format in the audio-only mode.
+func loadProfile(args *Args) (*bilibili.Profile, error) {
+	name := args.Profile
+
+	if args.AudioOnly {
+		var err error
+		if name, err = bilibili.AudioProfileName(args.AudioFormat); err != nil {
+			return nil, err
+		}
+	}
+
+	return bilibili.LoadProfile(name, args.ProfileConfig)
+}
+
 func run(args *Args) {
+	profile, err := loadProfile(args)
+	if err != nil {
+		xpretty.PrintToStderr("Invalid argument: %v\n", err)
+		os.Exit(1)
+	}
+
+	if profile.Name != bilibili.ProfileCopy {
+		log.Printf("profile: %s", profile)
+	}
+
 	options := &bilibili.Options{
 		InputDir:            args.InputDir,
 		OutputDir:           args.OutputDir,
 		ForceMerge:          args.Force,
 		UseUploaderAsSubDir: args.UploaderAsSubDir,
+		NameTemplate:        args.NameTemplate,
+		Muxer:               args.Muxer,
+		Profile:             profile,
+		TranscodeToAVC:      args.ToAVC,
+		Validate:            args.Validator,
+		DurationTolerance:   args.DurationTolerance,
+		Stream:              args.Stream,
+		SkipMetadata:        args.NoMetadata,
+		ExportDanmaku:       args.Danmaku,
+		ExportNFO:           args.NFO,
+		AllowIncomplete:     args.AllowIncomplete,
+		Jobs:                args.Jobs,
 	}
 
 	if args.Scan {
-		scanLocal(args)
+		scanLocal(args, options)
 		return
 	}
 
@@ -55,7 +98,12 @@ func run(args *Args) {
 	}
 
 	if args.Clean {
-		scanAndClean(args)
+		scanAndClean(args, options)
+		return
+	}
+
+	if args.Verify {
+		verifyCaches(args)
 		return
 	}
 
@@ -64,47 +112,260 @@ func run(args *Args) {
 }
 
 func convertVideos(args *Args, options *bilibili.Options) {
+	// Ctrl-C aborts the conversions, partial outputs are removed by the converter
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// leftovers of interrupted runs
+	removed, err := bilibili.SweepTemp(pathlib.Path(args.OutputDir).ExpandUser().AbsPath())
+	if err != nil {
+		log.Printf("cannot sweep temp files: %v", err)
+	}
+
+	for _, file := range removed {
+		log.Printf("removed orphaned temp: %s", file)
+	}
+
+	options.Progress = newProgressPrinter()
+	bcvc := bilibili.NewCacheVideoConverter(options, nil)
+
+	if filter := args.VideoFilter(); !filter.IsEmpty() {
+		videos, err := bilibili.FilterVideos(args.InputDir, filter)
+		if err != nil {
+			log.Printf("select videos failed: %v", err)
+			os.Exit(_exitFailed)
+		}
+
+		if len(videos) == 0 {
+			log.Printf("no video matched, end!")
+			return
+		}
+
+		finishRun(args, bcvc, bcvc.ConvertVideos(ctx, videos))
+
+		return
+	}
+
 	videos := bilibili.SelectVideosByGroup(args.InputDir)
 	if len(videos) == 0 {
 		log.Printf("cannot get videos by group, end!")
 		os.Exit(0)
 	}
 
-	var err error
-
-	bcvc := bilibili.NewCacheVideoConverter(options, nil)
-
 	switch args.By {
 	case byG, byGroup:
-		err = bcvc.ConvertByGroup(videos[0].GroupID)
+		err = bcvc.ConvertByGroup(ctx, videos[0].GroupKey())
 	case byV, byVideo:
 		video := bilibili.SelectVideo(videos)
-		err = bcvc.ConvertByVideo(video.ItemID)
+		err = bcvc.ConvertByVideo(ctx, video.ItemID)
 	default:
 		log.Printf("(%s) not supported, check --help for usage", args.By)
 		os.Exit(0)
 	}
 
+	finishRun(args, bcvc, err)
+}
+
+// newProgressPrinter logs stage changes, and every 10 percent of a stage.
+func newProgressPrinter() bilibili.ProgressFunc {
+	type state struct {
+		stage bilibili.Stage
+		step  int
+	}
+
+	var mu sync.Mutex
+
+	states := map[string]state{}
+
+	return func(p bilibili.Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		step := int(p.Percent) / 10
+		if last, ok := states[p.InputDir]; ok && last.stage == p.Stage && last.step == step {
+			return
+		}
+
+		states[p.InputDir] = state{stage: p.Stage, step: step}
+
+		log.Printf("[%-7s] %3.0f%% %s", p.Stage, p.Percent, path.Base(p.InputDir))
+	}
+}
+
+// finishRun prints the run summary, saves it if --summary-json is set,
+// and exits with _exitFailed if err is not nil.
+func finishRun(args *Args, bcvc *bilibili.CacheVideoConverter, err error) {
+	summary := bcvc.Summary()
+
+	for _, res := range summary.Results {
+		if res.Integrity != nil {
+			xpretty.YellowPrintf("[%s] %s: %s\n", strings.ToUpper(string(res.Integrity.State)), res.InputDir, strings.Join(res.Integrity.Problems, "; "))
+		}
+
+		if res.Err == nil {
+			continue
+		}
+
+		xpretty.PrintToStderr("[FAILED] %s: %v\n", res.InputDir, res.Err)
+
+		if res.StderrTail != "" {
+			xpretty.PrintToStderr("%s\n", res.StderrTail)
+		}
+	}
+
+	log.Printf("converted %d, skipped %d, failed %d of %d videos in %s, %s in / %s out",
+		summary.Converted, summary.Skipped, summary.Failed, summary.Total, summary.Duration.Round(time.Millisecond),
+		utils.FormatBytes(summary.BytesIn), utils.FormatBytes(summary.BytesOut))
+
+	if args.SummaryJSON != "" {
+		if err := summary.WriteJSON(args.SummaryJSON); err != nil {
+			log.Printf("cannot save summary: %v", err)
+		}
+	}
+
 	if err != nil {
 		log.Printf("convert failed: %v", err)
+		os.Exit(_exitFailed)
 	}
 }
 
-func scanAndClean(args *Args) {
+func scanAndClean(args *Args, options *bilibili.Options) {
+	videos := selectVideos(args)
+	if len(videos) == 0 {
+		log.Printf("no video selected, end!")
+		return
+	}
+
+	bcvc := bilibili.NewCacheVideoConverter(options, nil)
+	results := bcvc.Clean(videos, &bilibili.CleanOptions{TrashDir: args.TrashDir, DryRun: args.DryRun})
+
+	action := "[REMOVED]"
+
+	switch {
+	case args.DryRun:
+		action = "[DRY-RUN]"
+	case args.TrashDir != "":
+		action = "[TRASHED]"
+	}
+
+	var reclaimed int64
+
+	cleaned, failed := 0, 0
+
+	for _, res := range results {
+		switch {
+		case res.Skipped():
+			xpretty.YellowPrintf("[SKIPPED] %s: %v\n", res.Video.Dir, res.Err)
+		case res.Err != nil:
+			failed++
+
+			xpretty.PrintToStderr("[FAILED] %s: %v\n", res.Video.Dir, res.Err)
+		default:
+			cleaned++
+			reclaimed += res.Size
+
+			note := ""
+			if res.Unrecorded {
+				note = " (unrecorded, no state file)"
+			}
+
+			xpretty.GreenPrintf("%s %s (%s) => %s%s\n", action, res.Video.Dir, utils.FormatBytes(res.Size), res.Output, note)
+		}
+	}
+
+	verb := "reclaimed"
+	if args.DryRun {
+		verb = "reclaimable"
+	}
+
+	log.Printf("%s %s from %d of %d videos", verb, utils.FormatBytes(reclaimed), cleaned, len(results))
+
+	if failed != 0 {
+		os.Exit(_exitFailed)
+	}
+}
+
+// verifyCaches checks the integrity of the selected videos, and exits with _exitFailed if any is not ready.
+func verifyCaches(args *Args) {
+	videos := selectVideos(args)
+	if len(videos) == 0 {
+		log.Printf("no video selected, end!")
+		return
+	}
+
+	states := map[bilibili.Integrity]int{}
+
+	for _, video := range videos {
+		report, err := bilibili.CheckIntegrity(video.Dir)
+		if err != nil {
+			states[bilibili.IntegrityCorrupt]++
+
+			xpretty.PrintToStderr("[FAILED] %s: %v\n", video.Dir, err)
+
+			continue
+		}
+
+		states[report.State]++
+
+		if report.Ready() {
+			xpretty.GreenPrintf("[READY] %s (%s)\n", video.Dir, utils.FormatBytes(report.Bytes))
+			continue
+		}
+
+		xpretty.YellowPrintf("[%s] %s: %s\n", strings.ToUpper(string(report.State)), video.Dir, strings.Join(report.Problems, "; "))
+	}
+
+	log.Printf("%d of %d videos ready, %d incomplete, %d corrupt, %d missing video, %d missing audio",
+		states[bilibili.IntegrityReady], len(videos), states[bilibili.IntegrityIncomplete], states[bilibili.IntegrityCorrupt],
+		states[bilibili.IntegrityMissingVideo], states[bilibili.IntegrityMissingAudio])
+
+	if states[bilibili.IntegrityReady] != len(videos) {
+		os.Exit(_exitFailed)
+	}
+}
+
+// selectVideos selects by VideoFilter if any, or prompts for a group, and a video with --by video.
+func selectVideos(args *Args) []*bilibili.VideoInfo {
+	if filter := args.VideoFilter(); !filter.IsEmpty() {
+		videos, err := bilibili.FilterVideos(args.InputDir, filter)
+		if err != nil {
+			log.Printf("select videos failed: %v", err)
+			os.Exit(_exitFailed)
+		}
+
+		return videos
+	}
+
 	videos := bilibili.SelectVideosByGroup(args.InputDir)
 	if len(videos) == 0 {
-		log.Printf("cannot get videos by group, end!")
-		os.Exit(0)
+		return nil
 	}
 
 	log.Printf("running on group: %s", videos[0].GroupTitle)
 
-	video := bilibili.SelectVideo(videos)
+	if args.By == byV || args.By == byVideo {
+		return []*bilibili.VideoInfo{bilibili.SelectVideo(videos)}
+	}
 
-	log.Printf("running on video: %s:%s", video.Title, video.ItemID)
+	return videos
 }
 
-func scanLocal(args *Args) {
+func scanLocal(args *Args, options *bilibili.Options) {
+	if args.Format != formatTree {
+		groups, err := bilibili.ScanVideos(options)
+		if err != nil {
+			log.Printf("scan local groups failed: %v", err)
+			os.Exit(-1)
+		}
+
+		if err := writeScan(os.Stdout, args.Format, groups); err != nil {
+			log.Printf("write scan result failed: %v", err)
+			os.Exit(-1)
+		}
+
+		return
+	}
+
 	videoGroups, err := bilibili.ScanForAllVideoGroups(args.InputDir)
 	if err != nil {
 		log.Printf("scan local groups failed: %v", err)
@@ -118,7 +379,7 @@ func scanLocal(args *Args) {
 	for _, title := range titles {
 		videos := videoGroups[title]
 
-		grpMsg := fmt.Sprintf("%s(%s: %d)", title, videos[0].GroupID, len(videos))
+		grpMsg := fmt.Sprintf("%s(%s: %d)", title, videos[0].GroupKey(), len(videos))
 		leveledList = append(leveledList, pterm.LeveledListItem{
 			Level: 0,
 			Text:  xpretty.Cyan(grpMsg),
@@ -138,11 +399,23 @@ func scanLocal(args *Args) {
 			l3msg := fmt.Sprintf("[URL] %s", video.URLWithP())
 			leveledList = append(leveledList, pterm.LeveledListItem{
 				Level: 2,
-				Text:  fmt.Sprintf("[PTH] %s", path.Join(args.InputDir, video.ItemID)),
+				Text:  fmt.Sprintf("[PTH] %s", video.Dir),
 			}, pterm.LeveledListItem{
 				Level: 2,
 				Text:  l3msg,
 			})
+
+			leveledList = append(leveledList, pterm.LeveledListItem{
+				Level: 2,
+				Text:  fmt.Sprintf("[M4S] %s (%s, %s)", bilibili.DetectDirVariant(video.Dir), video.CacheFormat, bilibili.DetectVideoCodec(video)),
+			})
+
+			if video.ViewInfo != nil {
+				leveledList = append(leveledList, pterm.LeveledListItem{
+					Level: 2,
+					Text:  fmt.Sprintf("[DMK] %d danmaku, %d interactive", video.ViewInfo.DanmakuCount, len(video.ViewInfo.CommandDms)),
+				})
+			}
 		}
 	}
 
@@ -160,7 +433,7 @@ func downloadSubtitle(args *Args) {
 	}
 
 	sort.Slice(videos, func(i int, j int) bool {
-		return videos[i].P < videos[j].P
+		return videos[i].EpisodeNumber() < videos[j].EpisodeNumber()
 	})
 
 	for index, video := range videos {
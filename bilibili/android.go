@@ -0,0 +1,339 @@
+package bilibili
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/coghost/bilibili_cache_converter/danmaku"
+	"github.com/spf13/cast"
+)
+
+// files of the android cache
+const (
+	_androidEntryFile   = "entry.json"
+	_androidIndexFile   = "index.json"
+	_androidVideoFile   = "video.m4s"
+	_androidAudioFile   = "audio.m4s"
+	_androidDanmakuFile = "danmaku.xml"
+)
+
+// androidEntry is entry.json of a video folder in the android cache.
+type androidEntry struct {
+	MediaType       int    `json:"media_type"`
+	HasDashAudio    bool   `json:"has_dash_audio"`
+	IsCompleted     bool   `json:"is_completed"`
+	TotalBytes      int    `json:"total_bytes"`
+	DownloadedBytes int    `json:"downloaded_bytes"`
+	Title           string `json:"title"`
+	// TypeTag is the sub folder of streams, e.g. 80 or lua.flv720.bili2api.64
+	TypeTag         string `json:"type_tag"`
+	Cover           string `json:"cover"`
+	VideoQuality    int    `json:"video_quality"`
+	TotalTimeMilli  int64  `json:"total_time_milli"`
+	DanmakuCount    int    `json:"danmaku_count"`
+	TimeUpdateStamp int64  `json:"time_update_stamp"`
+	TimeCreateStamp int64  `json:"time_create_stamp"`
+	Avid            int    `json:"avid"`
+	Bvid            string `json:"bvid"`
+	OwnerID         any    `json:"owner_id"`
+	OwnerName       string `json:"owner_name"`
+	OwnerAvatar     string `json:"owner_avatar"`
+	// SeasonID is set for PGC content, with the episode in Ep and the cid in Source instead of PageData
+	SeasonID any `json:"season_id"`
+	Ep       struct {
+		AvID       int    `json:"av_id"`
+		Page       int    `json:"page"`
+		EpisodeID  any    `json:"episode_id"`
+		Index      any    `json:"index"`
+		IndexTitle string `json:"index_title"`
+		Bvid       string `json:"bvid"`
+		Width      int    `json:"width"`
+		Height     int    `json:"height"`
+	} `json:"ep"`
+	Source struct {
+		AvID int `json:"av_id"`
+		Cid  int `json:"cid"`
+	} `json:"source"`
+	PageData struct {
+		Cid    int    `json:"cid"`
+		Page   int    `json:"page"`
+		Part   string `json:"part"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+	} `json:"page_data"`
+}
+
+// androidIndex is index.json of the dash streams.
+type androidIndex struct {
+	Video []androidStream `json:"video"`
+	Audio []androidStream `json:"audio"`
+}
+
+type androidStream struct {
+	ID      int `json:"id"`
+	Codecid int `json:"codecid"`
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+	Size    int `json:"size"`
+}
+
+// androidFormat is the cache of the android client.
+type androidFormat struct{}
+
+func (androidFormat) Name() string {
+	return FormatAndroid
+}
+
+func (androidFormat) Match(dir string) bool {
+	return isFile(filepath.Join(dir, _androidEntryFile))
+}
+
+func (f androidFormat) ParseVideo(dir string) (*VideoInfo, error) {
+	entry, err := readAndroidEntry(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	groupID := entry.Bvid
+	if groupID == "" {
+		groupID = "av" + cast.ToString(entry.Avid)
+	}
+
+	title := entry.PageData.Part
+	if title == "" {
+		title = entry.Title
+	}
+
+	status := "downloading"
+	if entry.IsCompleted {
+		status = _statusCompleted
+	}
+
+	video := &VideoInfo{
+		Type:          TypeUGC,
+		UID:           entry.OwnerID,
+		GroupIDRaw:    groupID,
+		ItemIDRaw:     entry.PageData.Cid,
+		GroupID:       groupID,
+		ItemID:        cast.ToString(entry.PageData.Cid),
+		Aid:           entry.Avid,
+		Cid:           entry.PageData.Cid,
+		Bvid:          entry.Bvid,
+		P:             entry.PageData.Page,
+		Uname:         entry.OwnerName,
+		Avatar:        entry.OwnerAvatar,
+		CoverURL:      entry.Cover,
+		Title:         title,
+		Duration:      int(entry.TotalTimeMilli / 1000),
+		GroupTitle:    entry.Title,
+		Danmaku:       entry.DanmakuCount,
+		Status:        status,
+		Loaded:        entry.IsCompleted,
+		Qn:            entry.VideoQuality,
+		CreateTime:    entry.TimeCreateStamp,
+		UpdateTime:    entry.TimeUpdateStamp,
+		TotalSize:     entry.TotalBytes,
+		LoadedSize:    entry.DownloadedBytes,
+		AllowHEVC:     false,
+		GroupCoverURL: entry.Cover,
+	}
+
+	if seasonID := cast.ToString(entry.SeasonID); seasonID != "" {
+		setAndroidEpisode(video, entry, seasonID)
+	}
+
+	if index, err := readAndroidIndex(dir, entry); err == nil && len(index.Video) > 0 {
+		video.Codecid = index.Video[0].Codecid
+	}
+
+	return video, nil
+}
+
+// setAndroidEpisode fills the PGC fields, entry.Title is the season title then.
+func setAndroidEpisode(video *VideoInfo, entry *androidEntry, seasonID string) {
+	video.Type = TypePGC
+	video.SeasonIDRaw = entry.SeasonID
+	video.SeasonID = seasonID
+	video.SeasonTitle = entry.Title
+	video.EpisodeIDRaw = entry.Ep.EpisodeID
+	video.EpisodeID = cast.ToString(entry.Ep.EpisodeID)
+	video.EpisodeIndexRaw = entry.Ep.Index
+	video.EpisodeIndex = cast.ToString(entry.Ep.Index)
+	video.EpisodeTitle = entry.Ep.IndexTitle
+	video.GroupIDRaw = "ss" + seasonID
+	video.GroupID = "ss" + seasonID
+	video.Aid = entry.Ep.AvID
+	video.Bvid = entry.Ep.Bvid
+	video.P = entry.Ep.Page
+	video.Cid = entry.Source.Cid
+	video.ItemIDRaw = entry.Source.Cid
+	video.ItemID = cast.ToString(entry.Source.Cid)
+
+	video.Title = entry.Ep.IndexTitle
+	if video.Title == "" {
+		video.Title = entry.Title + " " + video.EpisodeIndex
+	}
+}
+
+func (f androidFormat) Streams(dir string) ([]string, error) {
+	entry, err := readAndroidEntry(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	streamDir := androidStreamDir(dir, entry)
+
+	files := []string{}
+
+	for _, name := range []string{_androidVideoFile, _androidAudioFile} {
+		if file := filepath.Join(streamDir, name); isFile(file) {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) != 0 {
+		return files, nil
+	}
+
+	// legacy caches have flv segments instead
+	segments, err := androidSegments(streamDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) == 0 {
+		return nil, ErrNoM4S
+	}
+
+	return segments, nil
+}
+
+// androidSegments returns the .blv segments of dir ordered by index, i.e. 0.blv, 1.blv... 10.blv.
+func androidSegments(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+_segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	index := func(file string) int {
+		i, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), _segmentSuffix))
+		return i
+	}
+
+	slices.SortStableFunc(files, func(a, b string) int {
+		return index(a) - index(b)
+	})
+
+	return files, nil
+}
+
+func (androidFormat) Danmaku(dir string) ([]*danmaku.Elem, error) {
+	return danmaku.ParseXMLFile(filepath.Join(dir, _androidDanmakuFile))
+}
+
+func (androidFormat) Resolution(dir string) (int, int) {
+	entry, err := readAndroidEntry(dir)
+	if err != nil {
+		return 0, 0
+	}
+
+	if index, err := readAndroidIndex(dir, entry); err == nil {
+		for _, stream := range index.Video {
+			if stream.Width > 0 && stream.Height > 0 {
+				return stream.Width, stream.Height
+			}
+		}
+	}
+
+	if entry.Ep.Width > 0 {
+		return entry.Ep.Width, entry.Ep.Height
+	}
+
+	return entry.PageData.Width, entry.PageData.Height
+}
+
+// Codecs of the android cache are the codec tags of the stream ids in index.json, which has no codec strings,
+// e.g. hev1 and mp4a.
+func (androidFormat) Codecs(dir string) (string, string) {
+	entry, err := readAndroidEntry(dir)
+	if err != nil {
+		return "", ""
+	}
+
+	index, err := readAndroidIndex(dir, entry)
+	if err != nil || len(index.Video) == 0 {
+		return "", ""
+	}
+
+	audio := ""
+	if len(index.Audio) != 0 {
+		audio = audioCodecOfID(index.Audio[0].ID)
+	}
+
+	return codecOfID(index.Video[0].Codecid), audio
+}
+
+func (androidFormat) AudioStream(dir string) string {
+	entry, err := readAndroidEntry(dir)
+	if err != nil {
+		return ""
+	}
+
+	if file := filepath.Join(androidStreamDir(dir, entry), _androidAudioFile); isFile(file) {
+		return file
+	}
+
+	return ""
+}
+
+// Covers of the android cache are not cached, entry.json has the url of the video cover only.
+func (androidFormat) Covers(string) (string, string) {
+	return "", ""
+}
+
+func readAndroidEntry(dir string) (*androidEntry, error) {
+	entry := &androidEntry{}
+	if err := readJSON(filepath.Join(dir, _androidEntryFile), entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+func readAndroidIndex(dir string, entry *androidEntry) (*androidIndex, error) {
+	index := &androidIndex{}
+	if err := readJSON(filepath.Join(androidStreamDir(dir, entry), _androidIndexFile), index); err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// androidStreamDir is the folder named by type_tag, or the first sub folder holding index.json.
+func androidStreamDir(dir string, entry *androidEntry) string {
+	if entry.TypeTag != "" && !strings.ContainsAny(entry.TypeTag, `/\`) {
+		return filepath.Join(dir, entry.TypeTag)
+	}
+
+	subDirs, _ := os.ReadDir(dir)
+	for _, sub := range subDirs {
+		if sub.IsDir() && isFile(filepath.Join(dir, sub.Name(), _androidIndexFile)) {
+			return filepath.Join(dir, sub.Name())
+		}
+	}
+
+	return dir
+}
+
+func readJSON(file string, v any) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -1,12 +1,25 @@
 package bilibili
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/coghost/bilibili_cache_converter/danmaku"
 	"github.com/coghost/bilibili_cache_converter/fixtures/testutil"
+	"github.com/coghost/bilibili_cache_converter/mp4"
 	"github.com/coghost/bilibili_cache_converter/utils"
 	"github.com/coghost/pathlib"
 	"github.com/stretchr/testify/assert"
@@ -62,7 +75,11 @@ func TestWithDetailSteps(t *testing.T) {
 		inFs := pathlib.Path(file)
 		outFs := outputFs.Join(inFs.Name)
 
-		n, err := copyWithout9zeroPrefix(file, outFs.AbsPath())
+		format, err := DetectM4S(file)
+		require.NoError(t, err, "detect format")
+		assert.Equal(M4SZeroPrefix, format.Variant)
+
+		n, err := copyWithoutPrefix(context.Background(), m4sInput{path: file, offset: format.Offset}, outFs.AbsPath(), nil)
 		assert.Greater(n, int64(0), "copy to new file")
 		require.NoError(t, err, "copy")
 
@@ -101,3 +118,1335 @@ func TestWithDetailSteps(t *testing.T) {
 		require.NoError(t, err, tt.name+" merge m4s to mp4")
 	}
 }
+
+func TestConvertVideoWithNativeMuxer(t *testing.T) {
+	const videoID = "26349405204"
+
+	outputFs := pathlib.Path(_testOutDir).Join("native")
+
+	options := &Options{
+		InputDir:   pathlib.Path(_testInputDir).Join(videoID).AbsPath(),
+		OutputDir:  outputFs.AbsPath(),
+		ForceMerge: true,
+		Muxer:      MuxerNative,
+
+		ExportDanmaku: true,
+	}
+
+	stages := []Stage{}
+	options.Progress = func(p Progress) {
+		if len(stages) == 0 || stages[len(stages)-1] != p.Stage {
+			stages = append(stages, p.Stage)
+		}
+
+		assert.LessOrEqual(t, p.Percent, float64(100))
+	}
+
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err, "convert without ffmpeg")
+	assert.Equal(t, StatusConverted, res.Status)
+	assert.Equal(t, options.InputDir, res.InputDir)
+	assert.Equal(t, "BV1JcCUYSEEL", res.Video.Bvid)
+	assert.Equal(t, int64(713614+612562-2*_cachedM4SHeaderLen), res.BytesIn, "m4s without prefix")
+	assert.Equal(t, mustFileStat(pathlib.Path(res.Output)).Size(), res.BytesOut)
+	assert.Positive(t, res.Duration)
+	assert.Equal(t, []Stage{StageCopy, StageMux, StageValidate, StageDanmaku, StageDone}, stages, "stages reported")
+	require.NotNil(t, res.Validation)
+	assert.True(t, res.Validation.Valid(), res.Validation.Problems)
+
+	outputMP4Fs := pathlib.Path(res.Output)
+	assert.True(t, outputMP4Fs.Exists(), "mp4 created")
+	assert.Greater(t, mustFileStat(outputMP4Fs).Size(), int64(1_000_000), "mp4 holds both streams")
+
+	meta, err := mp4.ReadMetadata(outputMP4Fs.AbsPath())
+	require.NoError(t, err, "read tags")
+	require.NotNil(t, meta, "tagged")
+	assert.Equal(t, "乐乐乐雨_", meta.Artist)
+	assert.Equal(t, "https://www.bilibili.com/video/BV1JcCUYSEEL/?p=1", meta.Comment)
+	assert.Equal(t, 1, meta.Track)
+	assert.NotEmpty(t, meta.Cover, "cover attached")
+
+	base := strings.TrimSuffix(outputMP4Fs.AbsPath(), _outputVideoDotMP4)
+	assert.True(t, pathlib.Path(base+_outputDotASS).Exists(), "danmaku ass exported")
+	assert.True(t, pathlib.Path(base+_outputDotXML).Exists(), "danmaku xml exported")
+
+	m4sfiles, err := outputFs.ListFilesWithGlob("*.m4s")
+	require.NoError(t, err)
+	assert.Empty(t, m4sfiles, "temp m4s removed")
+}
+
+func TestParsePlayURL(t *testing.T) {
+	assert := assert.New(t)
+
+	inputFs := pathlib.Path(_testInputDir).Join("26349405204")
+
+	playURL, err := ParsePlayURL(inputFs.Join(_playURLFile).AbsPath())
+	require.NoError(t, err, "parse playurl")
+
+	assert.Equal(16, playURL.Quality)
+	assert.Equal("360P 流畅", playURL.QualityDescription())
+	assert.Equal([]int{112, 80, 64, 32, 16}, playURL.AcceptQuality)
+	require.Len(t, playURL.Dash.Video, 1)
+	require.Len(t, playURL.Dash.Audio, 1)
+	assert.Equal("avc1.64001E", playURL.Dash.Video[0].Codecs)
+	assert.Equal(576, playURL.Dash.Video[0].Width)
+	assert.Equal("mp4a.40.2", playURL.Dash.Audio[0].Codecs)
+
+	files := []string{
+		inputFs.Join("26349405204-1-30280.m4s").AbsPath(),
+		inputFs.Join("26349405204-1-30016.m4s").AbsPath(),
+	}
+
+	media, err := playURL.MatchFiles(files)
+	require.NoError(t, err, "match files")
+	assert.Equal(files[1], media.Video, "video matched by id")
+	assert.Equal(files[0], media.Audio, "audio matched by id")
+	assert.Equal([]string{files[1], files[0]}, media.Files(), "video in front")
+
+	_, err = playURL.MatchFiles([]string{"unknown-1-123.m4s"})
+	assert.ErrorIs(err, ErrStreamNotMatched)
+}
+
+func TestParseViewInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	inputFs := pathlib.Path(_testInputDir).Join("26349405204")
+
+	view, err := ParseViewInfo(inputFs.Join(_viewFile).AbsPath())
+	require.NoError(t, err, "parse view")
+
+	assert.Equal(int64(13), view.DanmakuCount, "same as videoInfo.json")
+	assert.Equal(int64(360000), view.SegmentPageSize)
+	assert.Equal(int64(1), view.SegmentTotal)
+	assert.Contains(view.RecommendText, "优化弹幕")
+	assert.Contains(view.Keywords, "前方高能")
+
+	videoInfo, err := ParseVideoInfo(inputFs.Join(_videoInfoFile).AbsPath())
+	require.NoError(t, err, "parse video info")
+	assert.Equal(view, videoInfo.ViewInfo, "view attached to video info")
+
+	_, err = ParseViewInfo(inputFs.Join(_videoInfoFile).AbsPath())
+	assert.ErrorIs(err, ErrUnknownViewLayout, "not a view file")
+}
+
+func TestFilenameFromTemplate(t *testing.T) {
+	videoInfo, err := ParseVideoInfo(pathlib.Path(_testInputDir).Join("26349405204", _videoInfoFile).AbsPath())
+	require.NoError(t, err, "parse video info")
+
+	videoInfo.Title = "a/b: c"
+
+	tests := []struct {
+		name    string
+		tmpl    string
+		want    string
+		wantErr error
+	}{
+		{name: "preset group", tmpl: PresetGroup, want: "【星露谷物语】复古小卧室/a_b_ c"},
+		{name: "preset uploader", tmpl: PresetUploader, want: "乐乐乐雨_/【星露谷物语】复古小卧室/a_b_ c"},
+		{
+			name: "custom",
+			tmpl: `{{.Uname}}/{{.GroupTitle}}/{{pad .P 3}} - {{.Title}} [{{.Bvid}}] {{.Quality}}`,
+			want: "乐乐乐雨_/【星露谷物语】复古小卧室/001 - a_b_ c [BV1JcCUYSEEL] 360P",
+		},
+		{name: "date", tmpl: `{{date .Pubdate "2006"}}/{{.ItemID}}`, want: "2024/26349405204"},
+		{name: "empty segment dropped", tmpl: `{{.Vt | printf "%.0d"}}/{{.Bvid}}`, want: "BV1JcCUYSEEL"},
+		{name: "bad syntax", tmpl: `{{.Title`, wantErr: ErrInvalidNameTemplate},
+		{name: "unknown field", tmpl: `{{.NoSuchField}}`, wantErr: ErrInvalidNameTemplate},
+		{name: "escape", tmpl: `../{{.Bvid}}`, wantErr: ErrInvalidNameTemplate},
+	}
+	for _, tt := range tests {
+		got, err := videoInfo.FilenameFromTemplate(tt.tmpl)
+		if tt.wantErr != nil {
+			assert.ErrorIs(t, err, tt.wantErr, tt.name)
+			continue
+		}
+
+		require.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, got, tt.name)
+	}
+
+	assert.Equal(t, "【星露谷物语】复古小卧室/a_b_ c", videoInfo.FilenameFromGroupAndVideo(), "same as preset")
+}
+
+func TestConvertAllWithJobs(t *testing.T) {
+	assert := assert.New(t)
+
+	const failedVideo = "26227247942"
+
+	var mu sync.Mutex
+
+	seen := []string{}
+	convert := func(_ context.Context, options *Options) (ConversionResult, error) {
+		mu.Lock()
+		seen = append(seen, options.InputDir)
+		mu.Unlock()
+
+		if path.Base(options.InputDir) == failedVideo {
+			return ConversionResult{}, ErrNoM4S
+		}
+
+		return ConversionResult{Output: path.Base(options.InputDir)}, nil
+	}
+
+	options := &Options{InputDir: _testInputDir, OutputDir: _testOutDir, Jobs: 4}
+	bcvc := NewCacheVideoConverter(options, convert)
+
+	err := bcvc.ConvertAll(context.Background())
+	require.ErrorIs(t, err, ErrConvertFailed, "failure reported")
+	assert.Equal(_testInputDir, options.InputDir, "shared options untouched")
+	assert.Len(seen, 2, "keep going after failure")
+
+	results := bcvc.Results()
+	require.Len(t, results, 2)
+
+	summary := bcvc.Summary()
+	assert.Equal(2, summary.Total)
+	assert.Equal(1, summary.Converted)
+	assert.Equal(1, summary.Failed)
+
+	summaryFile := path.Join(t.TempDir(), "summary.json")
+	require.NoError(t, summary.WriteJSON(summaryFile))
+
+	data, err := os.ReadFile(summaryFile)
+	require.NoError(t, err)
+	assert.Contains(string(data), `"error": "no m4s file found"`)
+	assert.Contains(string(data), `"status": "failed"`)
+
+	for _, res := range results {
+		if path.Base(res.InputDir) == failedVideo {
+			assert.ErrorIs(res.Err, ErrNoM4S)
+		} else {
+			assert.NoError(res.Err)
+			assert.Equal("26349405204", res.Output)
+			assert.Equal(StatusConverted, res.Status)
+			assert.Equal("BV1JcCUYSEEL", res.Video.Bvid)
+		}
+	}
+}
+
+func TestFilterVideos(t *testing.T) {
+	assert := assert.New(t)
+
+	itemIDs := func(filter *VideoFilter) []string {
+		videos, err := FilterVideos(_testInputDir, filter)
+		require.NoError(t, err)
+
+		ids := []string{}
+		for _, v := range videos {
+			ids = append(ids, v.ItemID)
+		}
+
+		return ids
+	}
+
+	assert.True((&VideoFilter{}).IsEmpty())
+	assert.Equal([]string{"26227247942", "26349405204"}, itemIDs(&VideoFilter{All: true}))
+	assert.Equal([]string{"26349405204"}, itemIDs(&VideoFilter{Group: "BV1JcCUYSEEL"}), "by group id")
+	assert.Equal([]string{"26227247942"}, itemIDs(&VideoFilter{Group: "钢琴"}), "by group title regex")
+	assert.Equal([]string{"26227247942"}, itemIDs(&VideoFilter{Video: "26227247942"}))
+	assert.Equal([]string{"26349405204"}, itemIDs(&VideoFilter{Bvid: "bv1jccuyseel"}))
+	assert.Len(itemIDs(&VideoFilter{Uploader: "3546765257083595"}), 2, "by uid")
+	assert.Empty(itemIDs(&VideoFilter{Uploader: "乐乐乐雨_", Group: "^none$"}), "all conditions must match")
+
+	byID := &VideoFilter{Group: "123"}
+	require.NoError(t, byID.compile())
+	assert.False(byID.Match(&VideoInfo{GroupID: "456", GroupTitle: "合集 123"}), "a group id is not a title regex")
+	assert.True(byID.Match(&VideoInfo{GroupID: "123", GroupTitle: "合集"}))
+
+	videos, err := FilterVideos(_testInputDir, &VideoFilter{Video: "26349405204"})
+	require.NoError(t, err)
+	assert.Equal(path.Join(_testInputDir, "26349405204"), videos[0].Dir)
+
+	_, err = FilterVideos(_testInputDir, &VideoFilter{Group: "("})
+	assert.ErrorIs(err, ErrInvalidFilter)
+}
+
+func TestConvertVideos(t *testing.T) {
+	converted := []string{}
+	convert := func(_ context.Context, options *Options) (ConversionResult, error) {
+		converted = append(converted, options.InputDir)
+		return ConversionResult{}, ErrNoM4S
+	}
+
+	videos, err := FilterVideos(_testInputDir, &VideoFilter{Video: "26349405204"})
+	require.NoError(t, err)
+
+	bcvc := NewCacheVideoConverter(&Options{OutputDir: _testOutDir}, convert)
+	err = bcvc.ConvertVideos(context.Background(), videos)
+	require.ErrorIs(t, err, ErrConvertFailed)
+	assert.Equal(t, []string{videos[0].Dir}, converted)
+}
+
+func TestClean(t *testing.T) {
+	assert := assert.New(t)
+
+	inputDir := t.TempDir()
+	for _, id := range []string{"26349405204", "26227247942"} {
+		require.NoError(t, copyDir(path.Join(_testInputDir, id), path.Join(inputDir, id)))
+	}
+
+	options := &Options{InputDir: path.Join(inputDir, "26349405204"), OutputDir: t.TempDir()}
+	_, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+
+	videos, err := FilterVideos(inputDir, &VideoFilter{All: true})
+	require.NoError(t, err)
+	require.Len(t, videos, 2)
+
+	bcvc := NewCacheVideoConverter(options, nil)
+
+	results := bcvc.Clean(videos, &CleanOptions{DryRun: true})
+	require.Len(t, results, 2)
+	assert.True(results[0].Skipped(), "26227247942 is not converted")
+	assert.NoError(results[1].Err)
+	assert.Equal(int64(1326158), results[1].Size, "size from TotalSize")
+	assert.DirExists(videos[1].Dir, "nothing removed in dry run")
+
+	trashDir := t.TempDir()
+	results = bcvc.Clean(videos[1:], &CleanOptions{TrashDir: trashDir})
+	require.NoError(t, results[0].Err)
+	assert.NoDirExists(videos[1].Dir)
+	assert.FileExists(path.Join(trashDir, "26349405204", _videoInfoFile), "moved into trash")
+
+	// a truncated mp4 is not treated as converted
+	output, err := options.OutputPath(videos[0])
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(path.Dir(output), 0o755))
+	require.NoError(t, os.WriteFile(output, []byte("\x00\x00\x00\x20ftypisom"), 0o644))
+
+	results = bcvc.Clean(videos[:1], &CleanOptions{})
+	assert.ErrorIs(results[0].Err, ErrNotConverted)
+	assert.DirExists(videos[0].Dir)
+
+	// the recorded output is found after the template changes, and checked against the cache
+	options = &Options{InputDir: videos[0].Dir, OutputDir: t.TempDir()}
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+
+	options.NameTemplate = "{{.Uname}}"
+	bcvc = NewCacheVideoConverter(options, nil)
+
+	results = bcvc.Clean(videos[:1], &CleanOptions{DryRun: true})
+	require.NoError(t, results[0].Err)
+	assert.Equal(res.Output, results[0].Output)
+	assert.False(results[0].Unrecorded)
+
+	// without the state file, the output of another video at the same path is not taken
+	require.NoError(t, os.Rename(res.Output, path.Join(options.OutputDir, "乐乐乐雨_.mp4")))
+	require.NoError(t, os.Remove(path.Join(options.OutputDir, _stateFile)))
+
+	other := *videos[0]
+	other.Duration = 30
+
+	results = bcvc.Clean([]*VideoInfo{&other, videos[0]}, &CleanOptions{DryRun: true})
+	assert.ErrorIs(results[0].Err, ErrNotConverted)
+	assert.Contains(results[0].Err.Error(), "expected 30s")
+	require.NoError(t, results[1].Err)
+	assert.True(results[1].Unrecorded)
+}
+
+func TestScanVideos(t *testing.T) {
+	assert := assert.New(t)
+
+	options := &Options{InputDir: _testInputDir, OutputDir: t.TempDir()}
+	groups, err := ScanVideos(options)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+
+	assert.Equal("「星露谷物语」钢琴房", groups[0].Title)
+	assert.Equal("【星露谷物语】复古小卧室", groups[1].Title)
+	require.Len(t, groups[1].Videos, 1)
+
+	entry := groups[1].Videos[0]
+	assert.Equal(path.Join(_testInputDir, "26349405204"), entry.CachePath)
+	assert.Equal("360P", entry.Quality)
+	assert.Equal(M4SZeroPrefix, entry.M4SVariant)
+	assert.Equal(CodecAVC, entry.Codec)
+	assert.Equal(54, entry.Duration)
+	assert.Greater(entry.Size, int64(entry.TotalSize), "cache folder has covers and metadata too")
+	assert.False(entry.Converted)
+	assert.Equal(path.Join(options.OutputDir, "【星露谷物语】复古小卧室", "【星露谷物语】复古小卧室.mp4"), entry.Output)
+
+	require.NoError(t, os.MkdirAll(path.Dir(entry.Output), 0o755))
+	require.NoError(t, os.WriteFile(entry.Output, nil, 0o644))
+
+	groups, err = ScanVideos(options)
+	require.NoError(t, err)
+	assert.True(groups[1].Videos[0].Converted, "output exists")
+}
+
+func TestConvertVideoCanceled(t *testing.T) {
+	outputDir := t.TempDir()
+	options := &Options{
+		InputDir:  path.Join(_testInputDir, "26349405204"),
+		OutputDir: outputDir,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	options.Progress = func(p Progress) {
+		// Ctrl-C while muxing
+		if p.Stage == StageMux && p.Bytes > 0 {
+			cancel()
+		}
+	}
+
+	_, err := ConvertVideo(ctx, options)
+	require.ErrorIs(t, err, ErrUserCanceled)
+	require.ErrorIs(t, err, context.Canceled)
+
+	left := []string{}
+	require.NoError(t, filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			left = append(left, path)
+		}
+
+		return err
+	}))
+	assert.Empty(t, left, "partial outputs removed")
+
+	entries, err := os.ReadDir(outputDir)
+	require.NoError(t, err)
+
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), _tempDirPrefix), "job temp dir removed")
+	}
+
+	// jobs not started are canceled as well
+	bcvc := NewCacheVideoConverter(&Options{InputDir: _testInputDir, OutputDir: outputDir}, nil)
+	require.ErrorIs(t, bcvc.ConvertAll(ctx), ErrConvertFailed)
+
+	for _, res := range bcvc.Results() {
+		assert.ErrorIs(t, res.Err, ErrUserCanceled)
+	}
+}
+
+func TestConvertVideoWithState(t *testing.T) {
+	assert := assert.New(t)
+
+	inputDir := path.Join(t.TempDir(), "26349405204")
+	require.NoError(t, copyDir(path.Join(_testInputDir, "26349405204"), inputDir))
+
+	options := &Options{InputDir: inputDir, OutputDir: t.TempDir()}
+	convert := func() ConversionResult {
+		res, err := ConvertVideo(context.Background(), options)
+		require.NoError(t, err)
+
+		return res
+	}
+
+	first := convert()
+	assert.Equal(StatusConverted, first.Status)
+	assert.FileExists(path.Join(options.OutputDir, _stateFile))
+
+	assert.Equal(StatusSkipped, convert().Status, "recorded and intact")
+
+	// renamed template still finds the recorded output
+	options.NameTemplate = "{{.Bvid}}"
+	res := convert()
+	assert.Equal(StatusSkipped, res.Status)
+	assert.Equal(first.Output, res.Output)
+
+	options.NameTemplate = ""
+
+	// half-written output
+	require.NoError(t, os.Truncate(first.Output, 1024))
+	assert.Equal(StatusConverted, convert().Status, "truncated output is converted again")
+
+	// same size but different content
+	data, err := os.ReadFile(first.Output)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(first.Output, data, 0o644))
+	assert.Equal(StatusConverted, convert().Status, "checksum mismatched")
+
+	// re-downloaded at another quality
+	infoFile := path.Join(inputDir, _videoInfoFile)
+	raw, err := os.ReadFile(infoFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(infoFile, []byte(strings.Replace(string(raw), `"qn": 16`, `"qn": 32`, 1)), 0o644))
+	assert.Equal(StatusConverted, convert().Status, "stale output")
+	assert.Equal(StatusSkipped, convert().Status)
+
+	// an mp4 converted before the state file is adopted only if it matches the cache
+	legacy := func(inputDir string) ConversionResult {
+		options := &Options{InputDir: inputDir, OutputDir: t.TempDir(), NameTemplate: "{{.Uname}}"}
+		data, err := os.ReadFile(first.Output)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path.Join(options.OutputDir, "乐乐乐雨_.mp4"), data, 0o644))
+
+		res, err := ConvertVideo(context.Background(), options)
+		require.NoError(t, err)
+
+		return res
+	}
+
+	// records of another writer are kept, and a deleted state file is not seen as converted
+	video, err := ParseVideoDir(inputDir)
+	require.NoError(t, err)
+
+	other := *video
+	other.ItemID = "1"
+
+	stores := []*stateStore{}
+	for range 2 {
+		store, err := openState(options.OutputDir)
+		require.NoError(t, err)
+
+		stores = append(stores, store)
+	}
+
+	require.NoError(t, stores[0].record(video, Fingerprint{}, first.Output))
+	require.NoError(t, stores[1].record(&other, Fingerprint{}, first.Output))
+
+	store, err := openState(options.OutputDir)
+	require.NoError(t, err)
+	assert.Contains(store.data.Videos, stateKey(video))
+	assert.Contains(store.data.Videos, stateKey(&other))
+
+	require.NoError(t, os.Remove(path.Join(options.OutputDir, _stateFile)))
+
+	store, err = openState(options.OutputDir)
+	require.NoError(t, err)
+	assert.Empty(store.data.Videos)
+
+	assert.Equal(StatusSkipped, legacy(inputDir).Status, "adopted")
+	assert.Equal(StatusConverted, legacy(path.Join(_testInputDir, "26227247942")).Status,
+		"same name, another video")
+}
+
+func TestSweepTemp(t *testing.T) {
+	assert := assert.New(t)
+
+	outputDir := t.TempDir()
+
+	running, err := mkJobTempDir(outputDir)
+	require.NoError(t, err)
+
+	// pid above the linux pid_max
+	orphaned := path.Join(outputDir, _tempDirPrefix+"99999999-1")
+	require.NoError(t, os.MkdirAll(orphaned, 0o755))
+
+	stray := path.Join(outputDir, "26349405204-1-30016.m4s")
+	stateTemp := path.Join(outputDir, _stateFile+_tempSuffix)
+	kept := path.Join(outputDir, "kept.mp4")
+	keptM4S := path.Join(outputDir, "music.m4s")
+
+	for _, file := range []string{stray, stateTemp, kept, keptM4S} {
+		require.NoError(t, os.WriteFile(file, nil, 0o644))
+	}
+
+	removed, err := SweepTemp(outputDir)
+	require.NoError(t, err)
+	assert.ElementsMatch([]string{orphaned, stray, stateTemp}, removed)
+	assert.DirExists(running, "owned by a running process")
+	assert.FileExists(kept)
+	assert.FileExists(keptM4S, "not named as the cache")
+
+	removed, err = SweepTemp(path.Join(outputDir, "not-exist"))
+	require.NoError(t, err)
+	assert.Empty(removed)
+}
+
+func TestConvertVideoStreaming(t *testing.T) {
+	assert := assert.New(t)
+
+	inputDir := path.Join(_testInputDir, "26349405204")
+	convert := func(stream bool) ([]byte, []Stage) {
+		stages := []Stage{}
+		options := &Options{
+			InputDir:  inputDir,
+			OutputDir: t.TempDir(),
+			Stream:    stream,
+			Progress: func(p Progress) {
+				if len(stages) == 0 || stages[len(stages)-1] != p.Stage {
+					stages = append(stages, p.Stage)
+				}
+			},
+		}
+
+		res, err := ConvertVideo(context.Background(), options)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(res.Output)
+		require.NoError(t, err)
+
+		return data, stages
+	}
+
+	copied, stages := convert(false)
+	assert.Contains(stages, StageCopy)
+
+	streamed, stages := convert(true)
+	assert.NotContains(stages, StageCopy, "nothing copied")
+	assert.Equal(copied, streamed, "same output")
+}
+
+func TestFfmpegMergeWithPipes(t *testing.T) {
+	if !utils.PipeInputSupported {
+		t.Skip("pipe inputs are not supported")
+	}
+
+	// concatenates pipe:3 and pipe:4 into the output
+	fakeFfmpeg := path.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\nfor a in \"$@\"; do out=\"$a\"; done\ncat <&3 > \"$out\"\ncat <&4 >> \"$out\"\necho out_time_us=1000000\n"
+	require.NoError(t, os.WriteFile(fakeFfmpeg, []byte(script), 0o755))
+	t.Setenv("BL_FFMPEG", fakeFfmpeg)
+
+	inputs := []m4sInput{}
+	want := []byte{}
+
+	for _, name := range []string{"26349405204-1-30016.m4s", "26349405204-1-30280.m4s"} {
+		file := path.Join(_testInputDir, "26349405204", name)
+		inputs = append(inputs, m4sInput{path: file, offset: _cachedM4SHeaderLen})
+
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+
+		want = append(want, data[_cachedM4SHeaderLen:]...)
+	}
+
+	output := path.Join(t.TempDir(), "out.mp4")
+
+	var got time.Duration
+
+	require.NoError(t, ffmpegMerge(context.Background(), inputs, output, nil, func(d time.Duration) { got = d }))
+	assert.Equal(t, time.Second, got, "progress parsed")
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, want, data, "prefix skipped on the fly")
+}
+
+func TestDetectM4S(t *testing.T) {
+	assert := assert.New(t)
+
+	cached, err := os.ReadFile(path.Join(_testInputDir, "26349405204", "26349405204-1-30280.m4s"))
+	require.NoError(t, err)
+
+	plain := cached[_cachedM4SHeaderLen:]
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		data    []byte
+		variant M4SVariant
+		offset  int64
+	}{
+		{"zero prefix", cached, M4SZeroPrefix, _cachedM4SHeaderLen},
+		{"plain", plain, M4SPlain, 0},
+		{"other padding", append([]byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), plain...), M4SPrefixed, 16},
+	}
+
+	for _, tt := range tests {
+		file := path.Join(dir, "30280.m4s")
+		require.NoError(t, os.WriteFile(file, tt.data, 0o644))
+
+		format, err := DetectM4S(file)
+		require.NoError(t, err, tt.name)
+		assert.Equal(tt.variant, format.Variant, tt.name)
+		assert.Equal(tt.offset, format.Offset, tt.name)
+	}
+
+	file := path.Join(dir, "30280.m4s")
+	require.NoError(t, os.WriteFile(file, []byte("not an mp4 at all"), 0o644))
+
+	_, err = DetectM4S(file)
+	require.ErrorIs(t, err, ErrUnknownM4SFormat)
+
+	assert.Equal(M4SZeroPrefix, DetectDirVariant(path.Join(_testInputDir, "26349405204")))
+}
+
+func TestConvertVideoWithPlainM4S(t *testing.T) {
+	inputDir := path.Join(t.TempDir(), "26349405204")
+	require.NoError(t, copyDir(path.Join(_testInputDir, "26349405204"), inputDir))
+
+	// the video stream without prefix, the audio one with the default prefix
+	video := path.Join(inputDir, "26349405204-1-30016.m4s")
+	data, err := os.ReadFile(video)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(video, data[_cachedM4SHeaderLen:], 0o644))
+	assert.Equal(t, M4SMixed, DetectDirVariant(inputDir))
+
+	copied := int64(0)
+	options := &Options{InputDir: inputDir, OutputDir: t.TempDir(), Progress: func(p Progress) {
+		if p.Stage == StageCopy {
+			copied = p.Total
+		}
+	}}
+
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(t, int64(612562-_cachedM4SHeaderLen), copied, "only the prefixed audio is copied")
+	assert.NoError(t, mp4.Verify(res.Output))
+}
+
+// mkAndroidCache lays out fixture 26349405204 as the android client does, returns the download dir.
+func mkAndroidCache(t *testing.T) string {
+	t.Helper()
+
+	root := t.TempDir()
+	src := path.Join(_testInputDir, "26349405204")
+	videoDir := path.Join(root, "113328349388772", "c_26349405204")
+	require.NoError(t, os.MkdirAll(path.Join(videoDir, "16"), 0o755))
+
+	entry := `{
+  "media_type": 2, "has_dash_audio": true, "is_completed": true,
+  "total_bytes": 1326158, "downloaded_bytes": 1326158,
+  "title": "【星露谷物语】复古小卧室", "type_tag": "16", "video_quality": 16,
+  "cover": "http://i0.hdslb.com/bfs/archive/f12c0ba059f91239f87eae2f7190f0e0c719df38.jpg",
+  "total_time_milli": 53546, "danmaku_count": 13,
+  "time_update_stamp": 1752762414418, "time_create_stamp": 1752762413418,
+  "avid": 113328349388772, "bvid": "BV1JcCUYSEEL",
+  "owner_id": 3546765257083595, "owner_name": "乐乐乐雨_",
+  "page_data": {"cid": 26349405204, "page": 1, "part": "复古小卧室", "width": 640, "height": 360}
+}`
+	index := `{"video": [{"id": 16, "codecid": 7, "width": 640, "height": 360}], "audio": [{"id": 30280}]}`
+
+	require.NoError(t, os.WriteFile(path.Join(videoDir, _androidEntryFile), []byte(entry), 0o644))
+	require.NoError(t, os.WriteFile(path.Join(videoDir, "16", _androidIndexFile), []byte(index), 0o644))
+
+	for name, dst := range map[string]string{
+		"26349405204-1-30016.m4s": _androidVideoFile,
+		"26349405204-1-30280.m4s": _androidAudioFile,
+	} {
+		data, err := os.ReadFile(path.Join(src, name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path.Join(videoDir, "16", dst), data[_cachedM4SHeaderLen:], 0o644))
+	}
+
+	elems, err := danmaku.ParseFile(path.Join(src, _danmakuFile))
+	require.NoError(t, err)
+	require.NoError(t, writeFile(path.Join(videoDir, _androidDanmakuFile), func(w io.Writer) error {
+		return danmaku.WriteXML(w, elems, 26349405204)
+	}))
+
+	return root
+}
+
+func TestAndroidCache(t *testing.T) {
+	assert := assert.New(t)
+
+	root := mkAndroidCache(t)
+	videoDir := path.Join(root, "113328349388772", "c_26349405204")
+
+	groups, err := ScanForAllVideoGroups(root)
+	require.NoError(t, err)
+	require.Len(t, groups["【星露谷物语】复古小卧室"], 1)
+
+	video := groups["【星露谷物语】复古小卧室"][0]
+	assert.Equal(FormatAndroid, video.CacheFormat)
+	assert.Equal("BV1JcCUYSEEL", video.GroupID)
+	assert.Equal("26349405204", video.ItemID)
+	assert.Equal("复古小卧室", video.Title)
+	assert.Equal(53, video.Duration)
+	assert.Equal(7, video.Codecid)
+	assert.Equal(M4SPlain, DetectDirVariant(videoDir))
+
+	options := &Options{InputDir: videoDir, OutputDir: t.TempDir(), ExportDanmaku: true, ExportNFO: true}
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(StatusConverted, res.Status)
+	assert.NoError(mp4.Verify(res.Output))
+	assert.FileExists(strings.TrimSuffix(res.Output, _outputVideoDotMP4)+_outputDotASS, "danmaku from danmaku.xml")
+
+	// no cover is cached by the android client
+	assert.FileExists(strings.TrimSuffix(res.Output, _outputVideoDotMP4) + _nfoDotExt)
+	assert.NoFileExists(strings.TrimSuffix(res.Output, _outputVideoDotMP4) + _thumbSuffix)
+
+	meta, err := mp4.ReadMetadata(res.Output)
+	require.NoError(t, err)
+	assert.Equal("乐乐乐雨_", meta.Artist)
+	assert.Empty(meta.Cover)
+
+	videoCover, groupCover := desktopFormat{}.Covers(path.Join(_testInputDir, "26349405204"))
+	assert.Equal(path.Join(_testInputDir, "26349405204", _coverFile), videoCover)
+	assert.Equal(path.Join(_testInputDir, "26349405204", _groupCoverFile), groupCover)
+
+	// the nested android folder is found by cid
+	options = &Options{InputDir: root, OutputDir: t.TempDir()}
+	bcvc := NewCacheVideoConverter(options, nil)
+	require.NoError(t, bcvc.ConvertByVideo(context.Background(), "26349405204"))
+	assert.Equal(videoDir, bcvc.Results()[0].InputDir)
+	assert.NoError(bcvc.ConvertByGroup(context.Background(), "BV1JcCUYSEEL"))
+
+	options.InputDir = videoDir
+	assert.ErrorIs(NewCacheVideoConverter(options, nil).ConvertByGroup(context.Background(), "BV1JcCUYSEEL"), ErrNotGroupFolder)
+
+	// the audio codec is told by the stream id
+	for id, want := range map[int]string{30280: _codecAAC, 30250: _codecEAC3, 30251: _codecFLAC, 30999: ""} {
+		index := fmt.Sprintf(`{"video": [{"id": 16, "codecid": 7}], "audio": [{"id": %d}]}`, id)
+		require.NoError(t, os.WriteFile(path.Join(videoDir, "16", _androidIndexFile), []byte(index), 0o644))
+
+		videoCodec, audioCodec := androidFormat{}.Codecs(videoDir)
+		assert.Equal(_codecAVC, videoCodec)
+		assert.Equal(want, audioCodec, id)
+	}
+
+	// the emptied <avid> folder goes with the cleaned one, the input root is kept
+	options.InputDir = root
+	results := NewCacheVideoConverter(options, nil).Clean([]*VideoInfo{video}, &CleanOptions{})
+	require.NoError(t, results[0].Err)
+	assert.NoDirExists(path.Dir(videoDir))
+	assert.DirExists(root)
+}
+
+func TestAndroidSegments(t *testing.T) {
+	assert := assert.New(t)
+
+	// a legacy cache has flv segments in place of video.m4s and audio.m4s
+	root := mkAndroidCache(t)
+	videoDir := path.Join(root, "113328349388772", "c_26349405204")
+	streamDir := path.Join(videoDir, "16")
+
+	require.NoError(t, os.Remove(path.Join(streamDir, _androidVideoFile)))
+	require.NoError(t, os.Remove(path.Join(streamDir, _androidAudioFile)))
+
+	for _, name := range []string{"10.blv", "2.blv", "0.blv", "1.blv"} {
+		require.NoError(t, os.WriteFile(path.Join(streamDir, name), []byte("FLV\x01\x05"+name), 0o644))
+	}
+
+	files, err := androidFormat{}.Streams(videoDir)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+
+	assert.Equal([]string{"0.blv", "1.blv", "2.blv", "10.blv"}, names, "ordered by index")
+	assert.Equal(M4SFLV, DetectDirVariant(videoDir))
+
+	// writes the args and the concat list into the output
+	fakeFfmpeg := path.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\nfor a in \"$@\"; do [ \"$prev\" = -i ] && list=\"$a\"; prev=\"$a\"; done\n" +
+		"echo \"$@\" > \"$prev\"\ncat \"$list\" >> \"$prev\"\n"
+	require.NoError(t, os.WriteFile(fakeFfmpeg, []byte(script), 0o755))
+	t.Setenv("BL_FFMPEG", fakeFfmpeg)
+
+	// the segments are placeholders, which are not ready to convert
+	report, err := CheckIntegrity(videoDir)
+	require.NoError(t, err)
+	assert.False(report.Ready())
+
+	options := &Options{
+		InputDir: videoDir, OutputDir: t.TempDir(), Muxer: MuxerFfmpeg, SkipMetadata: true, AllowIncomplete: true,
+		Validate: ValidateNone,
+	}
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(StatusConverted, res.Status)
+
+	data, err := os.ReadFile(res.Output)
+	require.NoError(t, err)
+	assert.Contains(string(data), "-f concat -safe 0 -i ")
+
+	want := ""
+	for _, file := range files {
+		want += "file '" + file + "'\n"
+	}
+
+	assert.True(strings.HasSuffix(string(data), want), "segments concatenated in order")
+}
+
+// mkPGCCache copies fixture 26349405204 as episodes of a season, each with fields set over videoInfo.json.
+func mkPGCCache(t *testing.T, episodes map[string]map[string]any) string {
+	t.Helper()
+
+	root := t.TempDir()
+
+	for name, fields := range episodes {
+		dir := path.Join(root, name)
+		require.NoError(t, copyDir(path.Join(_testInputDir, "26349405204"), dir))
+
+		data, err := os.ReadFile(path.Join(dir, _videoInfoFile))
+		require.NoError(t, err)
+
+		info := map[string]any{}
+		require.NoError(t, json.Unmarshal(data, &info))
+		maps.Copy(info, fields)
+
+		data, err = json.Marshal(info)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path.Join(dir, _videoInfoFile), data, 0o644))
+	}
+
+	return root
+}
+
+func TestPGC(t *testing.T) {
+	assert := assert.New(t)
+
+	season := map[string]any{"type": "pgc", "seasonId": 25617, "seasonTitle": "进击的巨人 第二季", "groupId": 1}
+	ep3 := maps.Clone(season)
+	maps.Copy(ep3, map[string]any{"episodeId": 250671, "episodeIndex": "3", "episodeTitle": "在那里", "itemId": 3, "p": 1})
+	sp := maps.Clone(season)
+	maps.Copy(sp, map[string]any{"episodeId": "250680", "episodeIndex": "SP", "groupId": "other", "itemId": 4, "p": 9})
+
+	root := mkPGCCache(t, map[string]map[string]any{"ep3": ep3, "sp": sp})
+
+	groups, err := ScanForAllVideoGroups(root)
+	require.NoError(t, err)
+	require.Len(t, groups, 1, "grouped by season, not groupId")
+
+	videos, err := FilterVideos(root, &VideoFilter{Group: "ss25617"})
+	require.NoError(t, err)
+	require.Len(t, videos, 2)
+	assert.Equal("3", videos[0].EpisodeIndex, "sorted by episode number")
+	assert.Equal(9, videos[1].EpisodeNumber(), "P for non-numeric index")
+	assert.Equal("250671", videos[0].EpisodeID)
+
+	name, err := videos[0].FilenameFromTemplate(PresetPGC)
+	require.NoError(t, err)
+	assert.Equal("进击的巨人/Season 02/S02E03 - 在那里", name)
+
+	output, err := (&Options{OutputDir: "/out", UseUploaderAsSubDir: true}).OutputPath(videos[1])
+	require.NoError(t, err)
+	assert.Equal("/out/进击的巨人/Season 02/S02E09.mp4", output, "PresetPGC by default")
+
+	for title, want := range map[string]struct {
+		show   string
+		season int
+	}{
+		"进击的巨人 第二季":          {"进击的巨人", 2},
+		"鬼灭之刃 第十二季":          {"鬼灭之刃", 12},
+		"Fate/Zero Season 2": {"Fate/Zero", 2},
+		"三体":                 {"三体", 1},
+	} {
+		show, season := parseSeason(title)
+		assert.Equal(want.show, show, title)
+		assert.Equal(want.season, season, title)
+	}
+
+	// the android client has season_id and ep in entry.json
+	videoDir := path.Join(mkAndroidCache(t), "113328349388772", "c_26349405204")
+	entry := `{"title": "进击的巨人 第二季", "type_tag": "16", "season_id": "25617",
+  "ep": {"av_id": 1, "page": 1, "episode_id": 250671, "index": "3", "index_title": "在那里", "bvid": "BV1xx"},
+  "source": {"av_id": 1, "cid": 26349405204}}`
+	require.NoError(t, os.WriteFile(path.Join(videoDir, _androidEntryFile), []byte(entry), 0o644))
+
+	video, err := ParseVideoDir(videoDir)
+	require.NoError(t, err)
+	assert.True(video.IsPGC())
+	assert.Equal("ss25617", video.GroupKey())
+	assert.Equal("26349405204", video.ItemID)
+	assert.Equal(3, video.EpisodeNumber())
+	assert.Equal("进击的巨人 第二季", video.GroupName())
+}
+
+func TestExportNFO(t *testing.T) {
+	assert := assert.New(t)
+
+	outputDir := t.TempDir()
+	options := &Options{InputDir: path.Join(_testInputDir, "26349405204"), OutputDir: outputDir, ExportNFO: true}
+
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+
+	base := strings.TrimSuffix(res.Output, _outputVideoDotMP4)
+	groupDir := filepath.Dir(res.Output)
+
+	for _, file := range []string{
+		base + _nfoDotExt, base + _thumbSuffix,
+		path.Join(groupDir, _tvshowNFOFile), path.Join(groupDir, _folderImageFile), path.Join(groupDir, _posterImageFile),
+	} {
+		assert.FileExists(file)
+	}
+
+	data, err := os.ReadFile(base + _nfoDotExt)
+	require.NoError(t, err)
+
+	episode := &episodeNFO{}
+	require.NoError(t, xml.Unmarshal(data, episode))
+	assert.Equal("【星露谷物语】复古小卧室", episode.Title)
+	assert.Equal("乐乐乐雨_", episode.Director)
+	assert.Equal("2024-10-19", episode.Aired)
+	assert.Equal(1, episode.Runtime)
+	assert.Equal(1, episode.Episode)
+	assert.Contains(episode.Plot, "views: 81659, danmaku: 13")
+	assert.Equal("BV1JcCUYSEEL?p=1", episode.UniqueIDs[0].Value)
+	assert.NotContains(string(data), "<tag>", "the danmaku keywords of view are not video tags")
+
+	cover, err := os.ReadFile(path.Join(options.InputDir, _groupCoverFile))
+	require.NoError(t, err)
+
+	poster, err := os.ReadFile(path.Join(groupDir, _posterImageFile))
+	require.NoError(t, err)
+	assert.Equal(cover, poster, "group.jpg as the poster")
+
+	// a video converted before gets the missing sidecars
+	require.NoError(t, os.Remove(base+_nfoDotExt))
+
+	res, err = ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(StatusSkipped, res.Status)
+	assert.FileExists(base + _nfoDotExt)
+
+	// tvshow.nfo of PGC content goes above the season folder
+	root := mkPGCCache(t, map[string]map[string]any{
+		"ep1": {"type": "pgc", "seasonId": 1, "seasonTitle": "三体 第二季", "episodeIndex": 1},
+	})
+	options = &Options{InputDir: path.Join(root, "ep1"), OutputDir: t.TempDir(), ExportNFO: true}
+
+	res, err = ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.FileExists(path.Join(options.OutputDir, "三体", _tvshowNFOFile))
+	assert.NoFileExists(path.Join(filepath.Dir(res.Output), _tvshowNFOFile))
+
+	// no group folder, no group files
+	options.OutputDir, options.NameTemplate = t.TempDir(), "{{.Title}}"
+
+	_, err = ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.NoFileExists(path.Join(options.OutputDir, _tvshowNFOFile))
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	assert := assert.New(t)
+
+	report, err := CheckIntegrity(path.Join(_testInputDir, "26349405204"))
+	require.NoError(t, err)
+	assert.True(report.Ready(), report.Problems)
+	assert.Equal(int64(1326158), report.Bytes)
+	assert.NoError(report.Err())
+
+	root := mkPGCCache(t, map[string]map[string]any{
+		"corrupt":     {"totalSize": 1326158 - 4096, "loadedSize": 1326158 - 4096},
+		"downloading": {"status": "downloading", "loadedSize": 1000},
+		"audioless":   {},
+	})
+
+	// truncated, though the video info agrees with the size
+	video := path.Join(root, "corrupt", "26349405204-1-30016.m4s")
+	data, err := os.ReadFile(video)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(video, data[:len(data)-4096], 0o644))
+
+	report, err = CheckIntegrity(path.Join(root, "corrupt"))
+	require.NoError(t, err)
+	assert.Equal(IntegrityCorrupt, report.State)
+	require.ErrorIs(t, report.Err(), ErrNotReady)
+
+	report, err = CheckIntegrity(path.Join(root, "downloading"))
+	require.NoError(t, err)
+	assert.Equal(IntegrityIncomplete, report.State)
+
+	require.NoError(t, os.Remove(path.Join(root, "audioless", "26349405204-1-30280.m4s")))
+
+	report, err = CheckIntegrity(path.Join(root, "audioless"))
+	require.NoError(t, err)
+	assert.Equal(IntegrityIncomplete, report.State, "smaller than totalSize")
+
+	require.NoError(t, os.WriteFile(path.Join(root, "audioless", "26349405204-1-30280.m4s"), data, 0o644))
+
+	report, err = CheckIntegrity(path.Join(root, "audioless"))
+	require.NoError(t, err)
+	assert.Equal(IntegrityMissingAudio, report.State, "two video streams")
+
+	// not ready caches are skipped, unless allowed
+	options := &Options{InputDir: path.Join(root, "downloading"), OutputDir: t.TempDir()}
+
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(StatusSkipped, res.Status)
+	require.NotNil(t, res.Integrity)
+	assert.Equal(IntegrityIncomplete, res.Integrity.State)
+	assert.NoFileExists(res.Output)
+
+	options.AllowIncomplete = true
+
+	res, err = ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(StatusConverted, res.Status)
+	assert.FileExists(res.Output)
+}
+
+func TestValidateOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	root := mkPGCCache(t, map[string]map[string]any{
+		"ok":   {},
+		"long": {"duration": 600},
+	})
+
+	options := &Options{InputDir: path.Join(root, "ok"), OutputDir: t.TempDir()}
+
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(ValidateNative, res.Validation.Validator)
+	assert.Equal([]OutputTrack{{TrackVideo, "avc1"}, {TrackAudio, "mp4a"}}, res.Validation.Tracks)
+
+	// the mp4 is dropped and not recorded, so the cache is kept by clean
+	options.InputDir, options.OutputDir = path.Join(root, "long"), t.TempDir()
+
+	res, err = ConvertVideo(context.Background(), options)
+	require.ErrorIs(t, err, ErrInvalidOutput)
+	assert.Equal(StatusFailed, res.Status)
+	assert.Contains(res.Validation.Problems[0], "expected 10m0s")
+	assert.NoFileExists(res.Output)
+
+	video, err := ParseVideoDir(options.InputDir)
+	require.NoError(t, err)
+
+	bcvc := NewCacheVideoConverter(options, nil)
+	results := bcvc.Clean([]*VideoInfo{video}, &CleanOptions{})
+	require.ErrorIs(t, results[0].Err, ErrNotConverted)
+	assert.DirExists(options.InputDir)
+
+	// ffprobe reports an hevc stream, which .playurl doesn't tell
+	fakeFfprobe := path.Join(t.TempDir(), "ffprobe")
+	script := "#!/bin/sh\necho '{\"streams\": [{\"codec_type\": \"video\", \"codec_name\": \"hevc\", \"codec_tag_string\": \"[0][0][0][0]\"}, " +
+		"{\"codec_type\": \"audio\", \"codec_name\": \"aac\", \"codec_tag_string\": \"mp4a\"}], \"format\": {\"duration\": \"54.0\"}}'\n"
+	require.NoError(t, os.WriteFile(fakeFfprobe, []byte(script), 0o755))
+	t.Setenv("BL_FFPROBE", fakeFfprobe)
+
+	options.InputDir, options.Validate, options.ForceMerge = path.Join(root, "ok"), ValidateFfprobe, true
+
+	res, err = ConvertVideo(context.Background(), options)
+	require.ErrorIs(t, err, ErrInvalidOutput)
+	assert.Equal([]string{"video codec hevc, expected avc1.64001E"}, res.Validation.Problems)
+
+	options.Validate = "unknown"
+
+	_, err = ConvertVideo(context.Background(), options)
+	require.ErrorIs(t, err, ErrUnknownValidator)
+}
+
+func TestHEVC(t *testing.T) {
+	assert := assert.New(t)
+
+	// fixture 26349405204 with the video stream tagged as hevc
+	root := mkPGCCache(t, map[string]map[string]any{"hevc": {"codecid": CodecidHEVC}})
+	dir := path.Join(root, "hevc")
+
+	video := path.Join(dir, "26349405204-1-30016.m4s")
+	data, err := os.ReadFile(video)
+	require.NoError(t, err)
+
+	// type of the sample entry is 16 bytes after the stsd type
+	i := bytes.Index(data, []byte("stsd"))
+	require.Equal(t, _codecAVC, string(data[i+16:i+20]))
+	copy(data[i+16:], _codecHEVC)
+	require.NoError(t, os.WriteFile(video, data, 0o644))
+
+	playURL, err := os.ReadFile(path.Join(dir, _playURLFile))
+	require.NoError(t, err)
+	playURL = bytes.ReplaceAll(playURL, []byte("avc1.64001E"), []byte("hev1.1.6.L120.90"))
+	require.NoError(t, os.WriteFile(path.Join(dir, _playURLFile), playURL, 0o644))
+
+	parsed, err := ParseVideoDir(dir)
+	require.NoError(t, err)
+	assert.Equal(CodecHEVC, DetectVideoCodec(parsed))
+
+	// the native muxer tags hvc1
+	options := &Options{InputDir: dir, OutputDir: t.TempDir()}
+
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(CodecHEVC, res.Codec)
+	assert.False(res.Transcoded)
+	assert.Equal(_codecHVC1, res.Validation.Tracks[0].Codec)
+
+	// writes the args into the output
+	fakeFfmpeg := path.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\nfor a in \"$@\"; do out=\"$a\"; done\necho \"$@\" > \"$out\"\n"
+	require.NoError(t, os.WriteFile(fakeFfmpeg, []byte(script), 0o755))
+	t.Setenv("BL_FFMPEG", fakeFfmpeg)
+
+	ffmpegArgs := func(options *Options) (ConversionResult, string) {
+		options.ForceMerge, options.SkipMetadata, options.Validate = true, true, ValidateNone
+
+		res, err := ConvertVideo(context.Background(), options)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(res.Output)
+		require.NoError(t, err)
+
+		return res, string(data)
+	}
+
+	_, args := ffmpegArgs(&Options{InputDir: dir, OutputDir: t.TempDir(), Muxer: MuxerFfmpeg})
+	assert.Contains(args, "-c:v copy -tag:v hvc1 -c:a copy")
+
+	// transcoded by ffmpeg though the native muxer is set
+	res, args = ffmpegArgs(&Options{InputDir: dir, OutputDir: t.TempDir(), TranscodeToAVC: true})
+	assert.True(res.Transcoded)
+	assert.Contains(args, "-c:v libx264")
+
+	// avc is never transcoded
+	res, args = ffmpegArgs(&Options{
+		InputDir: path.Join(_testInputDir, "26349405204"), OutputDir: t.TempDir(), Muxer: MuxerFfmpeg, TranscodeToAVC: true,
+	})
+	assert.False(res.Transcoded)
+	assert.Contains(args, "-c:v copy -c:a copy")
+}
+
+func TestProfiles(t *testing.T) {
+	assert := assert.New(t)
+
+	profile, err := LoadProfile(ProfileMobile720p, "")
+	require.NoError(t, err)
+	assert.Equal("-c:v libx264 -preset veryfast -crf 26 -vf scale=-2:'min(720,ih)' -pix_fmt yuv420p -c:a aac -b:a 128k -movflags +faststart",
+		strings.Join(profile.ffmpegArgs(CodecHEVC, true), " "), "video encoded, nothing to transcode")
+
+	_, err = LoadProfile("custom", "")
+	require.ErrorIs(t, err, ErrUnknownProfile)
+
+	config := path.Join(t.TempDir(), "profiles.json")
+	require.NoError(t, os.WriteFile(config, []byte(`{"profiles": {
+  "custom": {"videoCodec": "libx265", "videoBitrate": "1M", "container": "mkv"},
+  "copy": {"container": "mkv"},
+  "broken": {"container": "avi"}
+}}`), 0o644))
+
+	profile, err = LoadProfile("custom", config)
+	require.NoError(t, err)
+	assert.Equal("custom", profile.Name)
+	assert.Equal("-c:v libx265 -b:v 1M -pix_fmt yuv420p -c:a copy", strings.Join(profile.ffmpegArgs(CodecAVC, false), " "),
+		"no hvc1 tag in mkv")
+
+	_, err = LoadProfile("broken", config)
+	require.ErrorIs(t, err, ErrInvalidProfile)
+
+	// audio only by the native muxer
+	profile, err = LoadProfile(ProfileAudioOnly, "")
+	require.NoError(t, err)
+
+	outputDir := t.TempDir()
+	options := &Options{InputDir: path.Join(_testInputDir, "26349405204"), OutputDir: outputDir, Profile: profile}
+
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(ProfileAudioOnly, res.Profile)
+	assert.Equal(".m4a", filepath.Ext(res.Output))
+	assert.Equal([]OutputTrack{{TrackAudio, "mp4a"}}, res.Validation.Tracks)
+
+	// writes the args into the output
+	fakeFfmpeg := path.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\nfor a in \"$@\"; do out=\"$a\"; done\necho \"$@\" > \"$out\"\n"
+	require.NoError(t, os.WriteFile(fakeFfmpeg, []byte(script), 0o755))
+	t.Setenv("BL_FFMPEG", fakeFfmpeg)
+
+	// another profile converts again, even into the same file
+	options.Profile, err = LoadProfile(ProfileCopy, config)
+	require.NoError(t, err)
+
+	options.Validate = ValidateNone
+
+	res, err = ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(StatusConverted, res.Status)
+	assert.Equal(".mkv", filepath.Ext(res.Output))
+
+	data, err := os.ReadFile(res.Output)
+	require.NoError(t, err)
+	assert.Contains(string(data), "-c:v copy -c:a copy")
+
+	res, err = ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(StatusSkipped, res.Status)
+
+	options.Profile, err = LoadProfile("custom", config)
+	require.NoError(t, err)
+
+	res, err = ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(StatusConverted, res.Status, "same output, another profile")
+
+	// the mkv can't be read natively, it's found by the state record and checked by ffprobe,
+	// even with validation disabled
+	fakeFfprobe := path.Join(t.TempDir(), "ffprobe")
+	script = "#!/bin/sh\necho '{\"streams\": [{\"codec_type\": \"video\", \"codec_name\": \"hevc\"}, " +
+		"{\"codec_type\": \"audio\", \"codec_name\": \"aac\"}], \"format\": {\"duration\": \"54.0\"}}'\n"
+	require.NoError(t, os.WriteFile(fakeFfprobe, []byte(script), 0o755))
+	t.Setenv("BL_FFPROBE", fakeFfprobe)
+
+	video, err := ParseVideoDir(options.InputDir)
+	require.NoError(t, err)
+
+	results := NewCacheVideoConverter(options, nil).Clean([]*VideoInfo{video}, &CleanOptions{DryRun: true})
+	require.NoError(t, results[0].Err)
+	assert.Equal(res.Output, results[0].Output)
+	assert.False(results[0].Unrecorded)
+
+	require.NoError(t, os.WriteFile(res.Output, []byte("changed"), 0o644))
+
+	results = NewCacheVideoConverter(options, nil).Clean([]*VideoInfo{video}, &CleanOptions{DryRun: true})
+	require.ErrorIs(t, results[0].Err, ErrNotConverted)
+}
+
+func TestAudioOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	name, err := AudioProfileName(ContainerMP3)
+	require.NoError(t, err)
+	assert.Equal(ProfileAudioMP3, name)
+
+	_, err = AudioProfileName("flac")
+	require.ErrorIs(t, err, ErrUnknownProfile)
+
+	profile, err := LoadProfile(ProfileAudioOnly, "")
+	require.NoError(t, err)
+
+	inputDir := path.Join(_testInputDir, "26349405204")
+	options := &Options{InputDir: inputDir, OutputDir: t.TempDir(), Profile: profile}
+
+	res, err := ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(filepath.Join(options.OutputDir, "乐乐乐雨_/【星露谷物语】复古小卧室/01 - 【星露谷物语】复古小卧室.m4a"), res.Output,
+		"named by PresetAudio")
+	assert.Equal(int64(612562-9), res.BytesIn, "only the audio m4s of .playurl is read")
+	assert.Equal([]OutputTrack{{TrackAudio, "mp4a"}}, res.Validation.Tracks)
+
+	meta, err := mp4.ReadMetadata(res.Output)
+	require.NoError(t, err)
+	assert.Equal("乐乐乐雨_", meta.Artist)
+	assert.Equal("【星露谷物语】复古小卧室", meta.Album)
+	assert.Equal(1, meta.Track)
+	assert.NotEmpty(meta.Cover)
+
+	// writes the args into the output
+	fakeFfmpeg := path.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\nfor a in \"$@\"; do out=\"$a\"; done\necho \"$@\" > \"$out\"\n"
+	require.NoError(t, os.WriteFile(fakeFfmpeg, []byte(script), 0o755))
+	t.Setenv("BL_FFMPEG", fakeFfmpeg)
+
+	options.Profile, err = LoadProfile(ProfileAudioMP3, "")
+	require.NoError(t, err)
+
+	options.Validate = ValidateNone
+
+	res, err = ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(".mp3", filepath.Ext(res.Output))
+
+	data, err := os.ReadFile(res.Output)
+	require.NoError(t, err)
+
+	args := string(data)
+	assert.Contains(args, "30280.m4s -i ", "the audio stream, then the cover")
+	assert.NotContains(args, "30016.m4s", "no video stream")
+	assert.Contains(args, "-map 0:a? -map 1:v -c:v copy -disposition:v attached_pic")
+	assert.NotContains(args, "-vn")
+	assert.Contains(args, "-c:a libmp3lame -b:a 192k")
+	assert.Contains(args, "-metadata artist=乐乐乐雨_ ")
+	assert.Contains(args, "-metadata track=1")
+
+	// opus has no cover
+	options.Profile, err = LoadProfile(ProfileAudioOpus, "")
+	require.NoError(t, err)
+
+	res, err = ConvertVideo(context.Background(), options)
+	require.NoError(t, err)
+	assert.Equal(".opus", filepath.Ext(res.Output))
+
+	data, err = os.ReadFile(res.Output)
+	require.NoError(t, err)
+	assert.Contains(string(data), "-vn -c:a libopus -b:a 128k -metadata title=")
+	assert.NotContains(string(data), "attached_pic")
+
+	config := path.Join(t.TempDir(), "profiles.json")
+	require.NoError(t, os.WriteFile(config, []byte(`{"profiles": {"video-mp3": {"container": "mp3"}}}`), 0o644))
+
+	_, err = LoadProfile("video-mp3", config)
+	require.ErrorIs(t, err, ErrInvalidProfile, "mp3 can't hold the video")
+}
@@ -0,0 +1,204 @@
+package bilibili
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coghost/bilibili_cache_converter/danmaku"
+	"github.com/coghost/pathlib"
+)
+
+// Names of the cache formats
+const (
+	// FormatDesktop is the layout of the desktop/mac client: videoInfo.json and *.m4s in a video folder
+	FormatDesktop = "desktop"
+	// FormatAndroid is the layout of the android client: <avid>/c_<cid>/entry.json with <quality>/video.m4s, audio.m4s
+	FormatAndroid = "android"
+)
+
+// CacheFormat reads the video folders of a client's cache layout.
+type CacheFormat interface {
+	Name() string
+	// Match tells whether dir is a video folder of the format
+	Match(dir string) bool
+	// ParseVideo reads the VideoInfo of the video folder
+	ParseVideo(dir string) (*VideoInfo, error)
+	// Streams returns the media files of the video folder, the video stream first, or the flv segments in order
+	Streams(dir string) ([]string, error)
+	// Danmaku reads the cached danmaku of the video folder
+	Danmaku(dir string) ([]*danmaku.Elem, error)
+	// Resolution returns the size of the video stream, 0 if unknown
+	Resolution(dir string) (width, height int)
+	// Codecs returns the codecs of the video and audio streams, e.g. avc1.64001E and mp4a.40.2 of .playurl,
+	// or only the codec tags, e.g. avc1 and mp4a, if the cache has no codec strings; empty if unknown
+	Codecs(dir string) (video, audio string)
+	// AudioStream returns the audio stream file of the video folder, empty if there is no separate one,
+	// e.g. flv segments or the streams can't be identified
+	AudioStream(dir string) string
+	// Covers returns the cached cover images of the video and of its group, empty if not cached
+	Covers(dir string) (video, group string)
+}
+
+var _cacheFormats = []CacheFormat{desktopFormat{}, androidFormat{}}
+
+// DetectCacheFormat returns the format of the video folder dir.
+func DetectCacheFormat(dir string) (CacheFormat, error) {
+	for _, format := range _cacheFormats {
+		if format.Match(dir) {
+			return format, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownCacheFormat, dir)
+}
+
+// IsVideoDir tells whether dir is a video folder of any known format.
+func IsVideoDir(dir string) bool {
+	_, err := DetectCacheFormat(dir)
+	return err == nil
+}
+
+// ParseVideoDir reads the VideoInfo of the video folder in any known format.
+func ParseVideoDir(dir string) (*VideoInfo, error) {
+	format, err := DetectCacheFormat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseVideo(format, dir)
+}
+
+func parseVideo(format CacheFormat, dir string) (*VideoInfo, error) {
+	video, err := format.ParseVideo(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	video.Dir = pathlib.Path(dir).AbsPath()
+	video.CacheFormat = format.Name()
+
+	return video, nil
+}
+
+// desktopFormat is the cache of the desktop/mac client.
+type desktopFormat struct{}
+
+func (desktopFormat) Name() string {
+	return FormatDesktop
+}
+
+func (desktopFormat) Match(dir string) bool {
+	return isFile(filepath.Join(dir, _videoInfoFile))
+}
+
+func (desktopFormat) ParseVideo(dir string) (*VideoInfo, error) {
+	return ParseVideoInfo(filepath.Join(dir, _videoInfoFile))
+}
+
+func (desktopFormat) Streams(dir string) ([]string, error) {
+	pattern := _inputSuffix
+	if !strings.HasPrefix(pattern, "*") {
+		pattern = "*" + _inputSuffix
+	}
+
+	inputFs := pathlib.Path(dir)
+
+	files, err := inputFs.ListFilesWithGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, ErrNoM4S
+	}
+
+	return orderStreamFiles(inputFs, files), nil
+}
+
+func (desktopFormat) Danmaku(dir string) ([]*danmaku.Elem, error) {
+	return danmaku.ParseFile(filepath.Join(dir, _danmakuFile))
+}
+
+func (desktopFormat) Resolution(dir string) (int, int) {
+	playURL, err := ParsePlayURL(filepath.Join(dir, _playURLFile))
+	if err != nil {
+		return 0, 0
+	}
+
+	for _, stream := range playURL.Dash.Video {
+		if stream.Width > 0 && stream.Height > 0 {
+			return stream.Width, stream.Height
+		}
+	}
+
+	return 0, 0
+}
+
+func (f desktopFormat) Codecs(dir string) (string, string) {
+	playURL, err := ParsePlayURL(filepath.Join(dir, _playURLFile))
+	if err != nil {
+		return "", ""
+	}
+
+	files, err := f.Streams(dir)
+	if err != nil {
+		return "", ""
+	}
+
+	media, err := playURL.MatchFiles(files)
+	if err != nil {
+		return "", ""
+	}
+
+	video, audio := "", ""
+
+	if media.VideoStream != nil {
+		video = media.VideoStream.Codecs
+	}
+
+	if media.AudioStream != nil {
+		audio = media.AudioStream.Codecs
+	}
+
+	return video, audio
+}
+
+func (desktopFormat) Covers(dir string) (string, string) {
+	return cachedFile(dir, _coverFile), cachedFile(dir, _groupCoverFile)
+}
+
+// cachedFile returns the path of name in dir, empty if it's not a file.
+func cachedFile(dir, name string) string {
+	if file := filepath.Join(dir, name); isFile(file) {
+		return file
+	}
+
+	return ""
+}
+
+// AudioStream of the desktop cache is the m4s matching an id of `.playurl` dash.audio.
+func (f desktopFormat) AudioStream(dir string) string {
+	playURL, err := ParsePlayURL(filepath.Join(dir, _playURLFile))
+	if err != nil {
+		return ""
+	}
+
+	files, err := f.Streams(dir)
+	if err != nil {
+		return ""
+	}
+
+	media, err := playURL.MatchFiles(files)
+	if err != nil {
+		return ""
+	}
+
+	return media.Audio
+}
+
+func isFile(file string) bool {
+	st, err := os.Stat(file)
+	return err == nil && !st.IsDir()
+}
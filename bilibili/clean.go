@@ -0,0 +1,213 @@
+package bilibili
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coghost/pathlib"
+)
+
+// CleanOptions controls how the cache folders of converted videos are removed.
+type CleanOptions struct {
+	// TrashDir moves cache folders into it instead of deleting them, if set
+	TrashDir string
+	// DryRun checks and reports only, nothing is removed
+	DryRun bool
+}
+
+// CleanResult is the result of cleaning one cache folder.
+type CleanResult struct {
+	Video *VideoInfo
+	// Output is the mp4 converted from the cache folder
+	Output string
+	// Size is the reclaimable bytes, TotalSize of videoInfo.json
+	Size int64
+	// TrashedTo is where the folder is moved, empty if deleted
+	TrashedTo string
+	// Unrecorded is set when the output dir has no state file, so Output is found by the name template and
+	// checked by its boxes, tracks and duration only
+	Unrecorded bool
+	// Err is ErrNotConverted when the mp4 is missing or invalid, the folder is kept
+	Err error
+}
+
+// Skipped returns true if the folder is kept because it is not converted yet.
+func (r *CleanResult) Skipped() bool {
+	return errors.Is(r.Err, ErrNotConverted)
+}
+
+// Clean removes the cache folders of videos recorded as converted in the state file of OutputDir, whose outputs
+// are intact and match the cache in tracks and duration, the others are skipped with ErrNotConverted.
+func (c *CacheVideoConverter) Clean(videos []*VideoInfo, cleanOpts *CleanOptions) []*CleanResult {
+	results := []*CleanResult{}
+	state, stateErr := c.options.openState()
+
+	for _, video := range videos {
+		res := &CleanResult{Video: video, Size: int64(video.TotalSize)}
+
+		res.Err = stateErr
+		if res.Err == nil {
+			res.Err = c.cleanVideo(res, state, cleanOpts)
+		}
+
+		results = append(results, res)
+	}
+
+	return results
+}
+
+func (c *CacheVideoConverter) cleanVideo(res *CleanResult, state *stateStore, cleanOpts *CleanOptions) error {
+	video := res.Video
+	if video.Dir == "" {
+		return fmt.Errorf("%w: cache folder of %s is unknown", ErrDirNotFound, video.ItemID)
+	}
+
+	if err := c.verifyOutput(res, state); err != nil {
+		return fmt.Errorf("%w: %w", ErrNotConverted, err)
+	}
+
+	if cleanOpts.TrashDir != "" {
+		res.TrashedTo = trashPath(cleanOpts.TrashDir, video.Dir)
+	}
+
+	if cleanOpts.DryRun {
+		return nil
+	}
+
+	if res.TrashedTo != "" {
+		if err := moveDir(video.Dir, res.TrashedTo); err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(video.Dir); err != nil {
+		return err
+	}
+
+	return removeEmptyParent(video.Dir, pathlib.Path(c.options.InputDir).ExpandUser().AbsPath())
+}
+
+// removeEmptyParent removes the parent of the removed dir if it's empty and inside root, e.g. `<avid>` of
+// the android `<avid>/c_<cid>` folders.
+func removeEmptyParent(dir, root string) error {
+	parent := filepath.Dir(dir)
+
+	rel, err := filepath.Rel(root, parent)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	entries, err := os.ReadDir(parent)
+	if err != nil || len(entries) != 0 {
+		return nil
+	}
+
+	return os.Remove(parent)
+}
+
+// verifyOutput finds the output of res.Video by the state record, which matches the cache by ItemID/Cid and
+// the fingerprint, then validates it against the cache, so the cache is never removed for a file of another video.
+// Without a state file, i.e. outputs converted before it, the mp4 at the path of the name template is checked.
+func (c *CacheVideoConverter) verifyOutput(res *CleanResult, state *stateStore) error {
+	video, options := res.Video, c.options
+
+	format, err := DetectCacheFormat(video.Dir)
+	if err != nil {
+		return err
+	}
+
+	files, err := sourceFiles(format, video.Dir, options.profile())
+	if err != nil {
+		return err
+	}
+
+	if state.exists() {
+		res.Output, err = state.recorded(video, newFingerprint(files, video, options.profile()))
+		if err != nil {
+			return err
+		}
+	} else {
+		if !options.profile().isMP4() {
+			return fmt.Errorf("no state file in %s", state.dir)
+		}
+
+		res.Unrecorded = true
+
+		if res.Output, err = options.OutputPath(video); err != nil {
+			return err
+		}
+	}
+
+	// the output is always validated before the cache is gone
+	checkOpts := *options
+	if checkOpts.Validate == ValidateNone {
+		checkOpts.Validate = ""
+	}
+
+	return checkOutput(context.Background(), &checkOpts, video, res.Output, wantOutput(options, format, video.Dir, video))
+}
+
+// trashPath keeps the folder name in trashDir, a timestamp is appended if it is taken.
+func trashPath(trashDir, dir string) string {
+	dst := filepath.Join(trashDir, filepath.Base(dir))
+	if _, err := os.Stat(dst); err != nil {
+		return dst
+	}
+
+	return fmt.Sprintf("%s-%d", dst, time.Now().Unix())
+}
+
+// moveDir renames src to dst, or copies and removes src when they are on different devices.
+func moveDir(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := copyDir(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+
+		fin, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fin.Close()
+
+		return writeFile(target, func(w io.Writer) error {
+			_, err := io.Copy(w, fin)
+			return err
+		})
+	})
+}
@@ -1,10 +1,13 @@
 package bilibili
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"log"
 	"path"
+	"sync"
+	"time"
 
 	"github.com/coghost/pathlib"
 )
@@ -15,13 +18,74 @@ type Options struct {
 	ForceMerge bool
 
 	UseUploaderAsSubDir bool
+	// NameTemplate is a preset name (group/uploader) or a text/template over VideoInfo,
+	// e.g. `{{.Uname}}/{{.GroupTitle}}/{{pad .P 3}} - {{.Title}} [{{.Bvid}}]`,
+	// UseUploaderAsSubDir picks the preset when it is empty
+	NameTemplate string
+
+	// Muxer is the backend to merge m4s files: native(default) / ffmpeg
+	Muxer string
+
+	// Profile is the codecs and container of the output, the copy profile(streams as is in mp4) if nil
+	Profile *Profile
+
+	// TranscodeToAVC re-encodes hevc/av1 videos as avc(h.264) by ffmpeg, for devices that can't play them,
+	// whatever Muxer is
+	TranscodeToAVC bool
+
+	// Validate is the backend to check the mp4 before it's moved into place: native(default) / ffprobe / none,
+	// a mismatch fails the video
+	Validate string
+	// DurationTolerance is the gap allowed between the mp4 and the cached duration, 2s if not set
+	DurationTolerance time.Duration
+
+	// SkipMetadata disables writing tags and cover art into the mp4
+	SkipMetadata bool
+
+	// ExportDanmaku writes danmaku as xml and ass subtitles next to the mp4
+	ExportDanmaku bool
+
+	// AllowIncomplete converts caches not ready by the integrity check, e.g. to salvage a partial download,
+	// they are skipped by default
+	AllowIncomplete bool
+
+	// ExportNFO writes Kodi/Jellyfin sidecars: `<episode>.nfo` and `<episode>-thumb.jpg` next to the mp4,
+	// `tvshow.nfo`, `folder.jpg` and `poster.jpg` in the group folder
+	ExportNFO bool
+
+	// Stream reads the cache files in place instead of copying them without the cache prefix first,
+	// it falls back to copying when the muxer can't stream, i.e. ffmpeg on windows
+	Stream bool
+
+	// Jobs is the number of videos converted in parallel by CacheVideoConverter
+	Jobs int
+
+	// Progress receives the progress of ConvertVideo, can be nil
+	Progress ProgressFunc
+
+	// state is the state file of OutputDir opened for a CacheVideoConverter run, ConvertVideo opens it if nil
+	state *stateStore
 }
 
-type converter func(*Options) (string, error)
+// openState returns the state store of OutputDir, the one of the run if set.
+func (o *Options) openState() (*stateStore, error) {
+	dir := pathlib.Path(o.OutputDir).ExpandUser().AbsPath()
+	if o.state != nil && o.state.dir == dir {
+		return o.state, nil
+	}
+
+	return openState(dir)
+}
+
+type converter func(context.Context, *Options) (ConversionResult, error)
 
 type CacheVideoConverter struct {
 	options *Options
 	convert converter
+
+	started time.Time
+	results []*ConversionResult
+	state   *stateStore
 }
 
 func NewCacheVideoConverter(options *Options, convert converter) *CacheVideoConverter {
@@ -35,33 +99,169 @@ func NewCacheVideoConverter(options *Options, convert converter) *CacheVideoConv
 	}
 }
 
-func (c *CacheVideoConverter) ConvertByVideo(videoID string) error {
-	options := c.options
-	inputFolder := path.Join(options.InputDir, videoID)
+func (c *CacheVideoConverter) ConvertByVideo(ctx context.Context, videoID string) error {
+	inputFolder := path.Join(c.options.InputDir, videoID)
 
-	options.InputDir = inputFolder
+	jobs := []*ConversionResult{{InputDir: inputFolder}}
 
-	name, err := c.convert(options)
+	// android caches nest the video folder as <avid>/c_<cid>, so it's looked up by cid
+	if !IsVideoDir(inputFolder) {
+		found, err := collectJobs(c.options.InputDir, func(video *VideoInfo) bool {
+			return video.ItemID == videoID
+		})
+		if err == nil && len(found) != 0 {
+			jobs = found[:1]
+		}
+	}
+
+	results := c.runJobs(ctx, jobs)
+
+	return results[0].Err
+}
+
+func (c *CacheVideoConverter) ConvertByGroup(ctx context.Context, groupID string) error {
+	// a video folder of any cache format is not a group folder
+	if IsVideoDir(c.options.InputDir) {
+		return ErrNotGroupFolder
+	}
+
+	log.Printf("scan all videos for %s with group: %s", c.options.InputDir, groupID)
+
+	return c.convertMatched(ctx, func(video *VideoInfo) bool {
+		return video.GroupID == groupID || video.GroupKey() == groupID
+	})
+}
+
+// ConvertAll converts every cached video found in InputDir.
+func (c *CacheVideoConverter) ConvertAll(ctx context.Context) error {
+	log.Printf("scan all videos for %s", c.options.InputDir)
+
+	return c.convertMatched(ctx, func(*VideoInfo) bool {
+		return true
+	})
+}
+
+// ConvertVideos converts the videos selected, e.g. by FilterVideos.
+func (c *CacheVideoConverter) ConvertVideos(ctx context.Context, videos []*VideoInfo) error {
+	jobs := []*ConversionResult{}
+	for _, video := range videos {
+		jobs = append(jobs, &ConversionResult{InputDir: video.Dir, Video: video})
+	}
+
+	return c.summarize(c.runJobs(ctx, jobs))
+}
+
+// Summary returns the summary of the last run.
+func (c *CacheVideoConverter) Summary() *RunSummary {
+	return newRunSummary(c.started, c.results)
+}
+
+// Results returns the results of the last run.
+func (c *CacheVideoConverter) Results() []*ConversionResult {
+	return c.results
+}
+
+func (c *CacheVideoConverter) convertMatched(ctx context.Context, match func(*VideoInfo) bool) error {
+	jobs, err := collectJobs(c.options.InputDir, match)
 	if err != nil {
-		log.Printf("cannot convert %s, %v", inputFolder, err)
-	} else {
-		log.Printf("converted: %s", name)
+		return err
 	}
 
-	return err
+	return c.summarize(c.runJobs(ctx, jobs))
 }
 
-func (c *CacheVideoConverter) ConvertByGroup(groupID string) error {
-	options := c.options
+// summarize returns ErrConvertFailed if any job failed.
+func (c *CacheVideoConverter) summarize(results []*ConversionResult) error {
+	failed := 0
 
-	inputFs := pathlib.Path(options.InputDir)
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+		}
+	}
 
-	// if videoInfo.json found, means this is video folder
-	if inputFs.Join(_videoInfoFile).Exists() {
-		return ErrNotGroupFolder
+	if failed != 0 {
+		return fmt.Errorf("%w: %d of %d videos", ErrConvertFailed, failed, len(results))
+	}
+
+	return nil
+}
+
+// runJobs converts jobs with a pool of Options.Jobs workers, each job gets its own copy of options,
+// and a failed job doesn't stop the others. Jobs not started when ctx is done fail with ErrUserCanceled.
+func (c *CacheVideoConverter) runJobs(ctx context.Context, jobs []*ConversionResult) []*ConversionResult {
+	c.started = time.Now()
+
+	// the jobs share the state loaded at the start of the run, or open it themselves if it fails to load
+	c.state, _ = c.options.openState()
+	workers := min(max(c.options.Jobs, 1), max(len(jobs), 1))
+	queue := make(chan *ConversionResult)
+
+	var wg sync.WaitGroup
+
+	for range workers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for job := range queue {
+				c.runJob(ctx, job)
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		if job.Err != nil {
+			// failed when collecting
+			continue
+		}
+
+		select {
+		case queue <- job:
+		case <-ctx.Done():
+			job.finish(canceled(ctx, ctx.Err()))
+		}
+	}
+
+	close(queue)
+	wg.Wait()
+
+	c.results = jobs
+
+	return jobs
+}
+
+func (c *CacheVideoConverter) runJob(ctx context.Context, job *ConversionResult) {
+	options := *c.options
+	options.InputDir = job.InputDir
+	options.state = c.state
+
+	log.Printf("converting %s...", job.InputDir)
+
+	res, err := c.convert(ctx, &options)
+	if res.InputDir == "" {
+		res.InputDir = job.InputDir
 	}
 
-	log.Printf("scan all videos for %s with group: %s", options.InputDir, groupID)
+	if res.Video == nil {
+		res.Video = job.Video
+	}
+
+	res.finish(err)
+	*job = res
+
+	if job.Err != nil {
+		log.Printf("cannot convert %s, %v", job.InputDir, job.Err)
+	} else {
+		log.Printf("%s: %s", job.Status, job.Output)
+	}
+}
+
+// collectJobs walks input for video folders matched, folders with broken video info are kept as failed jobs.
+func collectJobs(input string, match func(*VideoInfo) bool) ([]*ConversionResult, error) {
+	inputFs := pathlib.Path(input)
+	jobs := []*ConversionResult{}
 
 	errWalk := inputFs.Walk(
 		func(path string, info fs.FileInfo, _ error) error {
@@ -69,43 +269,37 @@ func (c *CacheVideoConverter) ConvertByGroup(groupID string) error {
 				return nil
 			}
 
-			if !info.IsDir() {
+			if info == nil || !info.IsDir() {
 				return nil
 			}
 
 			subDir := inputFs.Join(path)
-			videoFs := subDir.Join(_videoInfoFile)
 
-			if !videoFs.Exists() {
+			format, err := DetectCacheFormat(subDir.AbsPath())
+			if err != nil {
 				return nil
 			}
 
-			videoInfo, err := ParseVideoInfo(videoFs.AbsPath())
+			videoInfo, err := parseVideo(format, subDir.AbsPath())
 			if err != nil {
-				log.Printf("cannot get videoInfo for %s", videoFs)
-				return err
-			}
+				log.Printf("cannot get videoInfo for %s", subDir)
+				job := &ConversionResult{InputDir: subDir.AbsPath()}
+				job.finish(err)
+				jobs = append(jobs, job)
 
-			if videoInfo.GroupID != groupID {
-				// log.Printf("not wanted groupid [wanted/got]: %s != %s", groupID, videoInfo.GroupID)
 				return nil
 			}
 
-			log.Printf("converting %s...", subDir)
-
-			options.InputDir = subDir.AbsPath()
-
-			name, err := c.convert(options)
-			if err != nil {
-				log.Printf("cannot convert %s, %v", subDir.AbsPath(), err)
-			} else {
-				log.Printf("converted: %s", name)
+			if !match(videoInfo) {
+				return nil
 			}
 
-			return err
+			jobs = append(jobs, &ConversionResult{InputDir: subDir.AbsPath(), Video: videoInfo})
+
+			return nil
 		})
 
-	return errWalk
+	return jobs, errWalk
 }
 
 func ScanForAllVideoGroups(input string) (map[string][]*VideoInfo, error) {
@@ -126,21 +320,19 @@ func ScanForAllVideoGroups(input string) (map[string][]*VideoInfo, error) {
 		}
 
 		subDir := inputFs.Join(path)
-		videoFs := subDir.Join(_videoInfoFile)
 
-		if !videoFs.Exists() {
+		format, err := DetectCacheFormat(subDir.AbsPath())
+		if err != nil {
 			return nil
 		}
 
-		videoInfo, err := ParseVideoInfo(videoFs.AbsPath())
+		videoInfo, err := parseVideo(format, subDir.AbsPath())
 		if err != nil {
 			return err
 		}
 
-		groupTitle := videoInfo.GroupTitle
-		if groupTitle == "" {
-			groupTitle = videoInfo.GroupID
-		}
+		// PGC episodes are grouped by season
+		groupTitle := videoInfo.GroupName()
 
 		vg := videoGroups[groupTitle]
 		if len(vg) == 0 {
@@ -0,0 +1,137 @@
+package bilibili
+
+import (
+	"slices"
+	"strings"
+)
+
+// codec ids of dash video streams, i.e. VideoInfo.Codecid
+const (
+	CodecidAVC  = 7
+	CodecidHEVC = 12
+	CodecidAV1  = 13
+)
+
+// codecs of video streams
+const (
+	CodecAVC  = "avc"
+	CodecHEVC = "hevc"
+	CodecAV1  = "av1"
+)
+
+// codec tags of the streams, i.e. the type of mp4 sample entries
+const (
+	_codecAVC  = "avc1"
+	_codecHEVC = "hev1"
+	_codecAV1  = "av01"
+	_codecAAC  = "mp4a"
+	_codecEAC3 = "ec-3"
+	_codecFLAC = "fLaC"
+	// _codecHVC1 is hevc with parameter sets in the sample entry, the only tag apple players accept
+	_codecHVC1 = "hvc1"
+)
+
+// ids of dash audio streams, i.e. the quality of the audio
+const (
+	_audioID64K   = 30216
+	_audioID132K  = 30232
+	_audioID192K  = 30280
+	_audioIDDolby = 30250
+	_audioIDHiRes = 30251
+)
+
+// _avcTranscodeArgs re-encodes the video for devices without hevc/av1 decoders
+var _avcTranscodeArgs = []string{"-c:v", "libx264", "-preset", "medium", "-crf", "23", "-pix_fmt", "yuv420p"}
+
+// codecOfID returns the codec tag of the codec id, empty if unknown.
+func codecOfID(codecid int) string {
+	switch codecid {
+	case CodecidAVC:
+		return _codecAVC
+	case CodecidHEVC:
+		return _codecHEVC
+	case CodecidAV1:
+		return _codecAV1
+	default:
+		return ""
+	}
+}
+
+// audioCodecOfID returns the codec tag of the dash audio stream id, empty if unknown.
+func audioCodecOfID(id int) string {
+	switch id {
+	case _audioID64K, _audioID132K, _audioID192K:
+		return _codecAAC
+	case _audioIDDolby:
+		return _codecEAC3
+	case _audioIDHiRes:
+		return _codecFLAC
+	default:
+		return ""
+	}
+}
+
+// codecFamily maps the codec strings of .playurl, mp4 sample entries, ffprobe and ffmpeg encoders to the same name,
+// e.g. avc1.64001E, avc1, h264, libx264 and h264_nvenc are all avc.
+func codecFamily(codec string) string {
+	tag, _, _ := strings.Cut(strings.ToLower(codec), ".")
+	// hardware encoders, e.g. hevc_videotoolbox
+	tag, _, _ = strings.Cut(tag, "_")
+
+	switch tag {
+	case "avc1", "avc3", "h264", "libx264":
+		return CodecAVC
+	case "hev1", "hvc1", "hevc", "h265", "libx265":
+		return CodecHEVC
+	case "av01", "av1", "libaom-av1", "libsvtav1", "librav1e":
+		return CodecAV1
+	case "vp09", "vp9", "libvpx-vp9":
+		return "vp9"
+	case "mp4a", "aac", "libfdk":
+		return "aac"
+	case "opus", "libopus":
+		return "opus"
+	case "mp3", "libmp3lame":
+		return "mp3"
+	case "ec-3", "eac3":
+		return "eac3"
+	case "flac":
+		return "flac"
+	default:
+		return tag
+	}
+}
+
+// detectCodec returns the codec of the video stream, by VideoInfo.Codecid or the codecs of the cache format,
+// e.g. avc, hevc or av1, empty if unknown.
+func detectCodec(format CacheFormat, dir string, video *VideoInfo) string {
+	if tag := codecOfID(video.Codecid); tag != "" {
+		return codecFamily(tag)
+	}
+
+	if codec, _ := format.Codecs(dir); codec != "" {
+		return codecFamily(codec)
+	}
+
+	// old flv caches are h.264 only
+	if DetectDirVariant(dir) == M4SFLV {
+		return CodecAVC
+	}
+
+	return ""
+}
+
+// DetectVideoCodec returns the codec of the video stream in video.Dir, e.g. avc, hevc or av1, empty if unknown.
+func DetectVideoCodec(video *VideoInfo) string {
+	format, err := DetectCacheFormat(video.Dir)
+	if err != nil {
+		return ""
+	}
+
+	return detectCodec(format, video.Dir, video)
+}
+
+// needsTranscode tells whether the video of codec is re-encoded as avc when toAVC is set.
+func needsTranscode(codec string, toAVC bool) bool {
+	return toAVC && slices.Contains([]string{CodecHEVC, CodecAV1}, codec)
+}
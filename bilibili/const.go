@@ -3,14 +3,33 @@ package bilibili
 import "errors"
 
 const (
-	_videoInfoFile = "videoInfo.json"
-	_inputSuffix   = "m4s"
+	_videoInfoFile  = "videoInfo.json"
+	_playURLFile    = ".playurl"
+	_danmakuFile    = "dm1"
+	_viewFile       = "view"
+	_coverFile      = "image.jpg"
+	_groupCoverFile = "group.jpg"
+	_inputSuffix    = "m4s"
 
 	_outputVideoDotMP4 = ".mp4"
+	_outputDotASS      = ".ass"
+	_outputDotXML      = ".xml"
 	// _outputDotSrt      = ".srt"
+
+	// _stateFile records the videos converted, under the output dir
+	_stateFile = ".bilibili_cache_converter.json"
+	// _tempDirPrefix of job temp dirs under the output dir, followed by pid
+	_tempDirPrefix = ".bcc-tmp-"
+	_tempSuffix    = ".tmp"
+	// _tempOutputName is the name of the output muxed in the job temp dir, without the extension of the container
+	_tempOutputName = "output"
 )
 
 const (
+	// legacy android caches have flv segments named 0.blv, 1.blv...
+	_segmentSuffix = ".blv"
+	_flvSignature  = "FLV"
+
 	// bilibili cached header
 	_cachedM4SHeaderLen = 9
 	// bilibili encryption 9 zero
@@ -18,10 +37,29 @@ const (
 )
 
 var (
-	ErrNoM4S         = errors.New("no m4s file found")
+	ErrNoM4S = errors.New("no m4s file found")
+	// Deprecated: m4s files of other prefixes are accepted now, ErrUnknownM4SFormat is returned if no box is found.
 	ErrNoCachePrefix = errors.New("no prefix of 9 zero")
 	ErrUserCanceled  = errors.New("user canceled the operation")
 	ErrDirNotFound   = errors.New("directly not found")
+	ErrUnknownMuxer  = errors.New("unknown muxer")
+
+	ErrInvalidNameTemplate = errors.New("invalid name template")
+
+	ErrUnknownViewLayout = errors.New("unknown layout of view")
+
+	ErrNoPlayURLData    = errors.New("no data found in playurl")
+	ErrStreamNotMatched = errors.New("no dash stream matched")
 
-	ErrNotGroupFolder = errors.New("not a group folder, video folder found")
+	ErrNotGroupFolder     = errors.New("not a group folder, video folder found")
+	ErrConvertFailed      = errors.New("failed to convert")
+	ErrInvalidFilter      = errors.New("invalid video filter")
+	ErrNotConverted       = errors.New("not converted yet")
+	ErrUnknownM4SFormat   = errors.New("unknown m4s format, no mp4 box found")
+	ErrNotReady           = errors.New("cache is not ready to convert")
+	ErrUnknownCacheFormat = errors.New("unknown cache format, not a video folder")
+	ErrUnknownValidator   = errors.New("unknown validator")
+	ErrInvalidOutput      = errors.New("converted output is not valid")
+	ErrUnknownProfile     = errors.New("unknown profile")
+	ErrInvalidProfile     = errors.New("invalid profile")
 )
@@ -0,0 +1,99 @@
+package bilibili
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// _groupIDPattern matches the group ids --group takes literally: a numeric id, a season key or a bvid.
+var _groupIDPattern = regexp.MustCompile(`^(\d+|ss\d+|BV[0-9A-Za-z]{10})$`)
+
+// VideoFilter selects videos without prompts, all non-empty conditions must match.
+type VideoFilter struct {
+	All bool
+	// Group is a group id (numeric, ss<season id> or bvid), or a regex of group title otherwise
+	Group string
+	// Video is the item id
+	Video    string
+	Bvid     string
+	Uploader string
+
+	groupRegex *regexp.Regexp
+}
+
+// IsEmpty returns true if nothing is selected, which means interactive selection is required.
+func (f *VideoFilter) IsEmpty() bool {
+	return f == nil || (!f.All && f.Group == "" && f.Video == "" && f.Bvid == "" && f.Uploader == "")
+}
+
+func (f *VideoFilter) compile() error {
+	if f.Group == "" || f.groupRegex != nil || _groupIDPattern.MatchString(f.Group) {
+		return nil
+	}
+
+	re, err := regexp.Compile(f.Group)
+	if err != nil {
+		return fmt.Errorf("%w: group %q: %w", ErrInvalidFilter, f.Group, err)
+	}
+
+	f.groupRegex = re
+
+	return nil
+}
+
+// Match checks video against all conditions, uploader matches either uname or uid.
+func (f *VideoFilter) Match(video *VideoInfo) bool {
+	if f.Group != "" && video.GroupID != f.Group && video.GroupKey() != f.Group &&
+		(f.groupRegex == nil || !f.groupRegex.MatchString(video.GroupName())) {
+		return false
+	}
+
+	if f.Video != "" && video.ItemID != f.Video {
+		return false
+	}
+
+	if f.Bvid != "" && !strings.EqualFold(video.Bvid, f.Bvid) {
+		return false
+	}
+
+	if f.Uploader != "" && video.Uname != f.Uploader && fmt.Sprint(video.UID) != f.Uploader {
+		return false
+	}
+
+	return true
+}
+
+// FilterVideos scans input and returns the videos matched, sorted by group title (the season of PGC content)
+// and p (the episode number).
+func FilterVideos(input string, filter *VideoFilter) ([]*VideoInfo, error) {
+	if err := filter.compile(); err != nil {
+		return nil, err
+	}
+
+	videoGroups, err := ScanForAllVideoGroups(input)
+	if err != nil {
+		return nil, err
+	}
+
+	videos := []*VideoInfo{}
+
+	for _, group := range videoGroups {
+		for _, video := range group {
+			if filter.Match(video) {
+				videos = append(videos, video)
+			}
+		}
+	}
+
+	slices.SortFunc(videos, func(a, b *VideoInfo) int {
+		if c := strings.Compare(a.GroupName(), b.GroupName()); c != 0 {
+			return c
+		}
+
+		return a.EpisodeNumber() - b.EpisodeNumber()
+	})
+
+	return videos, nil
+}
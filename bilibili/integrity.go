@@ -0,0 +1,198 @@
+package bilibili
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coghost/bilibili_cache_converter/mp4"
+	"github.com/coghost/bilibili_cache_converter/utils"
+)
+
+// Integrity is the state of a cache folder found by CheckIntegrity.
+type Integrity string
+
+const (
+	// IntegrityReady can be converted
+	IntegrityReady Integrity = "ready"
+	// IntegrityIncomplete is still downloading, or the streams are shorter than the video info tells
+	IntegrityIncomplete Integrity = "incomplete"
+	// IntegrityCorrupt has streams of the full size that can't be parsed
+	IntegrityCorrupt Integrity = "corrupt"
+	// IntegrityMissingVideo has no video stream
+	IntegrityMissingVideo Integrity = "missing-video"
+	// IntegrityMissingAudio has no audio stream
+	IntegrityMissingAudio Integrity = "missing-audio"
+)
+
+const _statusCompleted = "completed"
+
+// IntegrityReport is the result of checking a cache folder.
+type IntegrityReport struct {
+	Dir   string    `json:"dir"`
+	State Integrity `json:"state"`
+	// Problems explains the state, empty if ready
+	Problems []string `json:"problems,omitempty"`
+	// Bytes is the size of the streams without the cache prefix, Expected is LoadedSize/TotalSize of the video info
+	Bytes    int64      `json:"bytes"`
+	Expected int64      `json:"expected"`
+	Video    *VideoInfo `json:"-"`
+}
+
+// Ready tells whether the cache can be converted.
+func (r *IntegrityReport) Ready() bool {
+	return r.State == IntegrityReady
+}
+
+// Err returns nil if ready, or ErrNotReady with the problems.
+func (r *IntegrityReport) Err() error {
+	if r.Ready() {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s: %s", ErrNotReady, r.State, strings.Join(r.Problems, "; "))
+}
+
+func (r *IntegrityReport) addProblem(format string, a ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, a...))
+}
+
+// CheckIntegrity checks the cache folder dir of any known format, an error is returned only if dir is not a video
+// folder or its video info can't be read.
+func CheckIntegrity(dir string) (*IntegrityReport, error) {
+	format, err := DetectCacheFormat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	video, err := parseVideo(format, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return checkIntegrity(format, dir, video), nil
+}
+
+// checkIntegrity compares the download state of video with the streams, and parses the boxes of each stream.
+// A stream failing to parse is corrupt, unless the download is incomplete which explains the truncation.
+func checkIntegrity(format CacheFormat, dir string, video *VideoInfo) *IntegrityReport {
+	report := &IntegrityReport{Dir: dir, Video: video, State: IntegrityReady}
+	incomplete := false
+
+	if video.Status != "" && video.Status != _statusCompleted {
+		incomplete = true
+
+		report.addProblem("download status is %q", video.Status)
+	}
+
+	if video.Progress > 0 && video.Progress < 100 {
+		incomplete = true
+
+		report.addProblem("download progress is %.1f%%", video.Progress)
+	}
+
+	if video.TotalSize > 0 && video.LoadedSize < video.TotalSize {
+		incomplete = true
+
+		report.addProblem("loaded %s of %s", utils.FormatBytes(int64(video.LoadedSize)), utils.FormatBytes(int64(video.TotalSize)))
+	}
+
+	files, err := format.Streams(dir)
+	if err != nil {
+		report.addProblem("no stream found: %v", err)
+		report.State = IntegrityMissingVideo
+
+		if incomplete {
+			report.State = IntegrityIncomplete
+		}
+
+		return report
+	}
+
+	tracks, parseErrs := checkStreams(files, report)
+
+	report.Expected = int64(max(video.LoadedSize, video.TotalSize))
+	if report.Bytes < report.Expected {
+		incomplete = true
+
+		report.addProblem("streams have %s of %s", utils.FormatBytes(report.Bytes), utils.FormatBytes(report.Expected))
+	}
+
+	for _, err := range parseErrs {
+		report.addProblem("%v", err)
+	}
+
+	switch {
+	case incomplete:
+		report.State = IntegrityIncomplete
+	case len(parseErrs) != 0:
+		report.State = IntegrityCorrupt
+	case !tracks["vide"]:
+		report.State = IntegrityMissingVideo
+
+		report.addProblem("no video track")
+	case !tracks["soun"]:
+		report.State = IntegrityMissingAudio
+
+		report.addProblem("no audio track")
+	}
+
+	return report
+}
+
+// checkStreams parses the tracks of files, flv segments as a whole, and sums their sizes into report.Bytes.
+// It returns the handlers of tracks found, e.g. vide and soun.
+func checkStreams(files []string, report *IntegrityReport) (map[string]bool, []error) {
+	handlers := map[string]bool{}
+	errs := []error{}
+	segments := []*io.SectionReader{}
+
+	for _, file := range files {
+		format, err := DetectM4S(file)
+		if st, errStat := os.Stat(file); errStat == nil {
+			report.Bytes += st.Size() - format.Offset
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		fin, r, err := m4sInput{path: file, offset: format.Offset}.open()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		defer fin.Close()
+
+		if format.Variant == M4SFLV {
+			segments = append(segments, r)
+			continue
+		}
+
+		tracks, err := mp4.ReadFragmented(r, r.Size())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", filepath.Base(file), err))
+			continue
+		}
+
+		for _, t := range tracks {
+			handlers[t.Handler] = handlers[t.Handler] || len(t.Samples) != 0
+		}
+	}
+
+	if len(segments) != 0 {
+		tracks, err := mp4.ReadFLV(segments...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		for _, t := range tracks {
+			handlers[t.Handler] = true
+		}
+	}
+
+	return handlers, errs
+}
@@ -0,0 +1,136 @@
+package bilibili
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// _maxPrefixLen is how far to look for the first box
+const _maxPrefixLen = 1024
+
+// M4SVariant is the layout of a cached m4s file.
+type M4SVariant string
+
+const (
+	// M4SPlain is a fragmented mp4 as is
+	M4SPlain M4SVariant = "plain"
+	// M4SZeroPrefix has the 9 bytes "000000000" prefix, written by the desktop client
+	M4SZeroPrefix M4SVariant = "zero-prefix"
+	// M4SPrefixed has a prefix of other length or padding
+	M4SPrefixed M4SVariant = "prefixed"
+	// M4SMixed is reported for a cache folder with streams of different variants
+	M4SMixed M4SVariant = "mixed"
+	// M4SFLV is a .blv segment of legacy android caches, a flv file rather than m4s
+	M4SFLV M4SVariant = "flv"
+	// M4SUnknown has no box found at the beginning
+	M4SUnknown M4SVariant = "unknown"
+)
+
+// the boxes a fragmented mp4 can start with
+var _firstBoxTypes = []string{"ftyp", "styp", "moof", "sidx"}
+
+// M4SFormat is the detected layout of a cached m4s file, the fragmented mp4 starts at Offset.
+type M4SFormat struct {
+	Variant M4SVariant
+	Offset  int64
+}
+
+// DetectM4S finds the first box of file, the bytes before it are taken as the prefix.
+// A flv file, i.e. a .blv segment, is reported as M4SFLV.
+func DetectM4S(file string) (M4SFormat, error) {
+	fin, err := os.Open(file)
+	if err != nil {
+		return M4SFormat{Variant: M4SUnknown}, err
+	}
+	defer fin.Close()
+
+	st, err := fin.Stat()
+	if err != nil {
+		return M4SFormat{Variant: M4SUnknown}, err
+	}
+
+	head := make([]byte, min(st.Size(), _maxPrefixLen+8))
+	if _, err := io.ReadFull(fin, head); err != nil {
+		return M4SFormat{Variant: M4SUnknown}, err
+	}
+
+	if bytes.HasPrefix(head, []byte(_flvSignature)) {
+		return M4SFormat{Variant: M4SFLV}, nil
+	}
+
+	for offset := 0; offset+8 <= len(head); offset++ {
+		if !slices.Contains(_firstBoxTypes, string(head[offset+4:offset+8])) {
+			continue
+		}
+
+		// a box found by chance in the prefix is unlikely to have a sane size
+		size := int64(binary.BigEndian.Uint32(head[offset:]))
+		if size != 1 && (size < 8 || int64(offset)+size > st.Size()) {
+			continue
+		}
+
+		return M4SFormat{Variant: prefixVariant(head[:offset]), Offset: int64(offset)}, nil
+	}
+
+	return M4SFormat{Variant: M4SUnknown}, fmt.Errorf("%w: %s", ErrUnknownM4SFormat, file)
+}
+
+func prefixVariant(prefix []byte) M4SVariant {
+	switch {
+	case len(prefix) == 0:
+		return M4SPlain
+	case string(prefix) == _cachedM4SHeader:
+		return M4SZeroPrefix
+	default:
+		return M4SPrefixed
+	}
+}
+
+// detectInputs returns the m4s files with the offsets of their media data.
+func detectInputs(files []string) ([]m4sInput, error) {
+	inputs := []m4sInput{}
+
+	for _, file := range files {
+		format, err := DetectM4S(file)
+		if err != nil {
+			return nil, err
+		}
+
+		inputs = append(inputs, m4sInput{path: file, offset: format.Offset, flv: format.Variant == M4SFLV})
+	}
+
+	return inputs, nil
+}
+
+// DetectDirVariant returns the variant of the m4s files in a cache folder, M4SMixed if they differ.
+func DetectDirVariant(dir string) M4SVariant {
+	files, err := filepath.Glob(filepath.Join(dir, "*."+_inputSuffix))
+	if format, errFormat := DetectCacheFormat(dir); errFormat == nil {
+		files, err = format.Streams(dir)
+	}
+
+	if err != nil || len(files) == 0 {
+		return M4SUnknown
+	}
+
+	variant := M4SVariant("")
+
+	for _, file := range files {
+		format, _ := DetectM4S(file)
+
+		switch variant {
+		case "":
+			variant = format.Variant
+		case format.Variant:
+		default:
+			return M4SMixed
+		}
+	}
+
+	return variant
+}
@@ -1,111 +1,379 @@
 package bilibili
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/coghost/bilibili_cache_converter/utils"
+	"github.com/coghost/bilibili_cache_converter/danmaku"
+	"github.com/coghost/bilibili_cache_converter/mp4"
 	"github.com/coghost/pathlib"
 )
 
-func ConvertVideo(options *Options) (string, error) {
-	// inputDir, outputDir string, forceMerge bool, useUname bool
+// ConvertVideo converts the cache folder options.InputDir into an mp4 in options.OutputDir.
+// It aborts once ctx is done, with the partial outputs removed, the error wraps ErrUserCanceled if ctx is canceled.
+// The mp4 is checked by options.Validate before it's moved into place.
+// The result is returned with StatusFailed on errors.
+func ConvertVideo(ctx context.Context, options *Options) (res ConversionResult, err error) {
+	res.InputDir = options.InputDir
+	started := time.Now()
+
+	defer func() {
+		res.Duration = time.Since(started)
+		res.finish(err)
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return res, canceled(ctx, err)
+	}
+
 	inputFs := pathlib.Path(options.InputDir).ExpandUser()
 	outputFs := pathlib.Path(options.OutputDir).ExpandUser()
 	log.Printf("input/output: %s vs %s\n", inputFs, outputFs)
 
-	pattern := _inputSuffix
-	if !strings.HasPrefix(pattern, "*") {
-		pattern = "*" + _inputSuffix
+	format, err := DetectCacheFormat(inputFs.AbsPath())
+	if err != nil {
+		return res, err
 	}
 
-	files, err := inputFs.ListFilesWithGlob(pattern)
+	profile := options.profile()
+
+	files, err := sourceFiles(format, inputFs.AbsPath(), profile)
 	if err != nil {
-		return "", err
+		return res, err
 	}
 
-	if len(files) == 0 {
-		return "", ErrNoM4S
+	if _, err := getValidator(options.Validate); err != nil {
+		return res, err
 	}
 
-	videoInfo, err := ParseVideoInfo(inputFs.Join(_videoInfoFile).AbsPath())
+	videoInfo, err := parseVideo(format, inputFs.AbsPath())
 	if err != nil {
-		return "", err
+		return res, err
 	}
 
-	outMP4 := videoInfo.FilenameFromGroupAndVideo() + _outputVideoDotMP4
-	if options.UseUploaderAsSubDir {
-		outMP4 = videoInfo.FilenameFromUnameGroupAndVideo()
+	res.Video = videoInfo
+	res.Profile = profile.Name
+	res.Codec = detectCodec(format, inputFs.AbsPath(), videoInfo)
+	res.Transcoded = profile.copiesVideo() && needsTranscode(res.Codec, options.TranscodeToAVC)
+
+	// only ffmpeg encodes
+	muxerName := options.Muxer
+	if res.Transcoded || !profile.native() {
+		muxerName = MuxerFfmpeg
+	}
+
+	mux, err := getMuxer(muxerName, profile, res.Codec, options.TranscodeToAVC)
+	if err != nil {
+		return res, err
+	}
+
+	outMP4, err := options.outputName(videoInfo)
+	if err != nil {
+		return res, err
 	}
 
 	outputMP4Fs := outputFs.Join(outMP4)
 	if err := outputMP4Fs.MkParentDir(); err != nil {
-		return "", err
+		return res, err
+	}
+
+	res.Output = outputMP4Fs.AbsPath()
+
+	rp := &reporter{
+		inputDir: options.InputDir,
+		fn:       options.Progress,
+		duration: time.Duration(videoInfo.Duration) * time.Second,
 	}
 
-	if !options.ForceMerge && outputMP4Fs.Exists() {
-		log.Printf("already converted, skip: %s", inputFs)
-		return outputMP4Fs.AbsPath(), nil
+	state, err := options.openState()
+	if err != nil {
+		return res, err
 	}
 
-	m4sfiles := []string{}
+	source := newFingerprint(files, videoInfo, profile)
+	want := wantOutput(options, format, inputFs.AbsPath(), videoInfo)
+
+	if !options.ForceMerge {
+		// an output made before the state file is adopted only if it matches the cache
+		adoptable := func(file string) error {
+			return checkOutput(ctx, options, videoInfo, file, want)
+		}
+
+		if output, ok := state.converted(videoInfo, source, res.Output, adoptable); ok {
+			log.Printf("already converted, skip: %s", inputFs)
+			rp.stage(StageDone)
+
+			res.Output = output
+			res.Status = StatusSkipped
 
-	for _, file := range files {
-		name := pathlib.Path(file).Name
-		outFile := outputFs.Join(name).AbsPath()
+			// sidecars of videos converted before are added if missing
+			if options.ExportNFO {
+				if err := exportNFO(format, inputFs.AbsPath(), output, outputFs.AbsPath(), videoInfo, false); err != nil {
+					log.Printf("cannot export nfo of %s: %v", inputFs, err)
+				}
+			}
 
-		if _, err := copyWithout9zeroPrefix(file, outFile); err != nil {
-			return "", err
+			return res, nil
 		}
+	}
+
+	// half-downloaded or broken caches would make broken mp4s
+	integrity := checkIntegrity(format, inputFs.AbsPath(), videoInfo)
+	if !integrity.Ready() {
+		if !options.AllowIncomplete {
+			log.Printf("not ready, skip: %s: %v", inputFs, integrity.Err())
+			rp.stage(StageDone)
 
-		m4sfiles = append(m4sfiles, outFile)
+			res.Integrity = integrity
+			res.Status = StatusSkipped
+
+			return res, nil
+		}
+
+		log.Printf("not ready, convert anyway: %s: %v", inputFs, integrity.Err())
 	}
 
-	_, err = utils.ConvertWithFfmpeg(m4sfiles, outputMP4Fs.AbsPath())
+	sources, err := detectInputs(files)
 	if err != nil {
-		return "", err
+		return res, err
 	}
 
-	for _, file := range m4sfiles {
-		os.Remove(file)
+	for _, src := range sources {
+		if st, err := os.Stat(src.path); err == nil {
+			res.BytesIn += st.Size() - src.offset
+		}
+	}
+
+	// everything is written into the temp dir, the mp4 is renamed into place on success
+	tmpDir, err := mkJobTempDir(outputFs.AbsPath())
+	if err != nil {
+		return res, err
 	}
+	defer os.RemoveAll(tmpDir)
 
-	return outMP4, err
+	inputs, err := prepareInputs(ctx, options.Stream && canStream(muxerName), sources, tmpDir, rp)
+	if err != nil {
+		return res, canceled(ctx, err)
+	}
+
+	// tags are written by the mp4 package, or by ffmpeg into other containers
+	var meta *mp4.Metadata
+	if !options.SkipMetadata {
+		meta = buildMetadata(format, inputFs.AbsPath(), videoInfo)
+	}
+
+	rp.stage(StageMux)
+
+	// ffmpeg picks the container by the extension
+	tmpMP4 := filepath.Join(tmpDir, _tempOutputName+profile.ext())
+	if err := mux(ctx, inputs, tmpMP4, meta, rp); err != nil {
+		return res, canceled(ctx, err)
+	}
+
+	// an invalid mp4 is dropped with the temp dir, and not recorded, so the cache is never cleaned
+	rp.stage(StageValidate)
+
+	res.Validation, err = validateOutput(ctx, options, videoInfo, tmpMP4, want, integrity.Ready())
+	if err != nil {
+		return res, canceled(ctx, err)
+	}
+
+	if err := os.Rename(tmpMP4, res.Output); err != nil {
+		return res, err
+	}
+
+	if err := state.record(videoInfo, source, res.Output); err != nil {
+		log.Printf("cannot record %s: %v", res.Output, err)
+	}
+
+	if options.ExportDanmaku {
+		rp.stage(StageDanmaku)
+
+		if err := exportDanmaku(format, inputFs, outputMP4Fs, videoInfo); err != nil {
+			log.Printf("cannot export danmaku of %s: %v", inputFs, err)
+		}
+	}
+
+	if options.ExportNFO {
+		rp.stage(StageNFO)
+
+		if err := exportNFO(format, inputFs.AbsPath(), res.Output, outputFs.AbsPath(), videoInfo, true); err != nil {
+			log.Printf("cannot export nfo of %s: %v", inputFs, err)
+		}
+	}
+
+	rp.stage(StageDone)
+
+	return res, nil
 }
 
-func copyWithout9zeroPrefix(srcFile, dstFile string) (int64, error) {
-	fin, err := os.Open(srcFile)
+// sourceFiles returns the stream files of the cache folder dir read for profile, ordered video first.
+// The audio-only mode reads the audio stream alone, or drops the video tracks if it's not a separate file.
+func sourceFiles(format CacheFormat, dir string, profile *Profile) ([]string, error) {
+	files, err := format.Streams(dir)
 	if err != nil {
-		return 0, nil
+		return nil, err
 	}
 
-	defer fin.Close()
+	if profile.dropsVideo() {
+		if audio := format.AudioStream(dir); audio != "" {
+			return []string{audio}, nil
+		}
+	}
 
-	var header [_cachedM4SHeaderLen]byte
-	if _, err := io.ReadFull(fin, header[:]); err != nil {
-		return 0, err
+	return files, nil
+}
+
+// wantOutput returns the tracks expected in the output of video converted with options.
+func wantOutput(options *Options, format CacheFormat, dir string, video *VideoInfo) expectedOutput {
+	profile := options.profile()
+	transcoded := profile.copiesVideo() && needsTranscode(detectCodec(format, dir, video), options.TranscodeToAVC)
+	videoCodec, audioCodec := format.Codecs(dir)
+
+	return profile.expectedOutput(videoCodec, audioCodec, transcoded)
+}
+
+// canceled wraps err with ErrUserCanceled when ctx is canceled.
+func canceled(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.Canceled) && !errors.Is(err, ErrUserCanceled) {
+		return fmt.Errorf("%w: %w", ErrUserCanceled, err)
 	}
 
-	if string(header[:]) != _cachedM4SHeader {
-		return 0, fmt.Errorf("not 9 zero header found: %w", ErrNoCachePrefix)
+	return err
+}
+
+// prepareInputs reads the cache files in place when they have no prefix, or stream is set, i.e. streaming is enabled
+// and supported by the muxer, otherwise they are copied into tmpDir without the prefix.
+func prepareInputs(
+	ctx context.Context, stream bool, sources []m4sInput, tmpDir string, rp *reporter,
+) ([]m4sInput, error) {
+	toCopy := map[int]bool{}
+	total := int64(0)
+
+	for i, src := range sources {
+		if src.offset == 0 || stream {
+			continue
+		}
+
+		toCopy[i] = true
+
+		if st, err := os.Stat(src.path); err == nil {
+			total += st.Size() - src.offset
+		}
 	}
 
-	fout, err := os.Create(dstFile)
+	if len(toCopy) != 0 {
+		rp.stage(StageCopy)
+	}
+
+	inputs := []m4sInput{}
+	copied := int64(0)
+
+	for i, src := range sources {
+		if !toCopy[i] {
+			inputs = append(inputs, src)
+			continue
+		}
+
+		outFile := filepath.Join(tmpDir, filepath.Base(src.path))
+
+		n, err := copyWithoutPrefix(ctx, src, outFile, func(written int64) {
+			rp.report(Progress{Stage: StageCopy, Bytes: copied + written, Total: total})
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		inputs = append(inputs, m4sInput{path: outFile})
+		copied += n
+	}
+
+	return inputs, nil
+}
+
+// orderStreamFiles puts the video stream in front of the audio one by `.playurl`,
+// files are returned as is when `.playurl` is not usable.
+func orderStreamFiles(inputFs *pathlib.FsPath, files []string) []string {
+	playURL, err := ParsePlayURL(inputFs.Join(_playURLFile).AbsPath())
+	if err != nil {
+		log.Printf("cannot parse %s, use files in glob order: %v", _playURLFile, err)
+		return files
+	}
+
+	media, err := playURL.MatchFiles(files)
+	if err != nil {
+		log.Printf("cannot identify video/audio, use files in glob order: %v", err)
+		return files
+	}
+
+	return media.Files()
+}
+
+// exportDanmaku writes the cached danmaku as xml and ass files with the same name of the mp4.
+func exportDanmaku(format CacheFormat, inputFs, outputMP4Fs *pathlib.FsPath, videoInfo *VideoInfo) error {
+	elems, err := format.Danmaku(inputFs.AbsPath())
+	if err != nil {
+		return err
+	}
+
+	opts := danmaku.DefaultASSOptions()
+
+	if width, height := format.Resolution(inputFs.AbsPath()); width > 0 && height > 0 {
+		opts.Width, opts.Height = width, height
+	}
+
+	base := strings.TrimSuffix(outputMP4Fs.AbsPath(), filepath.Ext(outputMP4Fs.AbsPath()))
+
+	if err := writeFile(base+_outputDotXML, func(w io.Writer) error {
+		return danmaku.WriteXML(w, elems, videoInfo.Cid)
+	}); err != nil {
+		return err
+	}
+
+	return writeFile(base+_outputDotASS, func(w io.Writer) error {
+		return danmaku.WriteASS(w, elems, opts)
+	})
+}
+
+func writeFile(file string, write func(w io.Writer) error) error {
+	fout, err := os.Create(file)
 	if err != nil {
-		return 0, nil
+		return err
 	}
 	defer fout.Close()
 
-	// Offset is the number of bytes you want to exclude
-	_, err = fin.Seek(_cachedM4SHeaderLen, io.SeekStart)
+	if err := write(fout); err != nil {
+		return err
+	}
+
+	return fout.Close()
+}
+
+// copyWithoutPrefix copies the media data of src into dstFile, onWrite receives the bytes written so far.
+func copyWithoutPrefix(ctx context.Context, src m4sInput, dstFile string, onWrite func(int64)) (int64, error) {
+	fin, r, err := src.open()
+	if err != nil {
+		return 0, err
+	}
+	defer fin.Close()
+
+	fout, err := os.Create(dstFile)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
+	defer fout.Close()
 
-	n, err := io.Copy(fout, fin)
+	n, err := io.Copy(&progressWriter{ctx: ctx, w: fout, onWrite: onWrite}, r)
+	if err != nil {
+		return n, err
+	}
 
-	return n, err
+	return n, fout.Close()
 }
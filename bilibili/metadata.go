@@ -0,0 +1,82 @@
+package bilibili
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coghost/bilibili_cache_converter/mp4"
+)
+
+// buildMetadata gets mp4 tags from videoInfo, with the cached cover of the video in dir if found.
+func buildMetadata(format CacheFormat, dir string, videoInfo *VideoInfo) *mp4.Metadata {
+	meta := &mp4.Metadata{
+		Title:       videoInfo.Title,
+		Artist:      videoInfo.Uname,
+		AlbumArtist: videoInfo.Uname,
+		Album:       videoInfo.GroupName(),
+		Comment:     videoInfo.URLWithP(),
+		Track:       videoInfo.EpisodeNumber(),
+	}
+
+	if videoInfo.IsPGC() && videoInfo.EpisodeID != "" {
+		meta.Comment = "https://www.bilibili.com/bangumi/play/ep" + videoInfo.EpisodeID
+	}
+
+	if videoInfo.Pubdate > 0 {
+		meta.Date = time.Unix(int64(videoInfo.Pubdate), 0).UTC().Format(time.RFC3339)
+	}
+
+	coverFile, _ := format.Covers(dir)
+	if coverFile == "" {
+		log.Printf("no cached cover of %s, tagged without cover art", dir)
+		return meta
+	}
+
+	cover, err := os.ReadFile(coverFile)
+	if err != nil {
+		log.Printf("cannot read cover %s, ignored: %v", coverFile, err)
+		return meta
+	}
+
+	meta.Cover = cover
+
+	return meta
+}
+
+// ffmpegMetadataArgs returns meta as -metadata args of ffmpeg, for containers other than mp4, the cover is not included.
+func ffmpegMetadataArgs(meta *mp4.Metadata) []string {
+	// the date part is what id3 and vorbis comments take
+	date, _, _ := strings.Cut(meta.Date, "T")
+
+	tags := [][2]string{
+		{"title", meta.Title},
+		{"artist", meta.Artist},
+		{"album_artist", meta.AlbumArtist},
+		{"album", meta.Album},
+		{"date", date},
+		{"comment", meta.Comment},
+		{"genre", meta.Genre},
+	}
+
+	if meta.Track > 0 {
+		track := fmt.Sprint(meta.Track)
+		if meta.TrackTotal > 0 {
+			track += fmt.Sprintf("/%d", meta.TrackTotal)
+		}
+
+		tags = append(tags, [2]string{"track", track})
+	}
+
+	args := []string{}
+
+	for _, tag := range tags {
+		if tag[1] != "" {
+			args = append(args, "-metadata", tag[0]+"="+tag[1])
+		}
+	}
+
+	return args
+}
@@ -0,0 +1,251 @@
+package bilibili
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/coghost/bilibili_cache_converter/mp4"
+	"github.com/coghost/bilibili_cache_converter/utils"
+)
+
+const (
+	// MuxerNative remuxes with the built-in mp4 package, no ffmpeg required.
+	MuxerNative = "native"
+	// MuxerFfmpeg shells out to ffmpeg (see BL_FFMPEG).
+	MuxerFfmpeg = "ffmpeg"
+)
+
+// m4sInput is a stream file, its media data starts at offset, i.e. after the cache prefix when streaming
+// from the cache folder, or 0 for a stripped copy.
+type m4sInput struct {
+	path   string
+	offset int64
+	// flv is a .blv segment, segments are concatenated instead of merged as streams
+	flv bool
+}
+
+// open returns the media data of the input, close the file when done.
+func (in m4sInput) open() (*os.File, *io.SectionReader, error) {
+	fin, err := os.Open(in.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := fin.Stat()
+	if err != nil {
+		fin.Close()
+		return nil, nil, err
+	}
+
+	return fin, io.NewSectionReader(fin, in.offset, st.Size()-in.offset), nil
+}
+
+// muxer merges inputs into output, meta is written when not nil.
+// It stops once ctx is done, the partial output is left to the caller.
+type muxer func(ctx context.Context, inputs []m4sInput, output string, meta *mp4.Metadata, rp *reporter) error
+
+// getMuxer returns the muxer of name making the output of profile, codec is the video codec of the cache,
+// which is transcoded as avc by ffmpeg if toAVC is set, see Profile.ffmpegArgs.
+func getMuxer(name string, profile *Profile, codec string, toAVC bool) (muxer, error) {
+	switch name {
+	case "", MuxerNative:
+		return nativeMuxer(profile.dropsVideo()), nil
+	case MuxerFfmpeg:
+		return ffmpegMuxer(profile, profile.ffmpegArgs(codec, toAVC)), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMuxer, name)
+	}
+}
+
+// canStream tells whether the muxer reads the cache files in place, or needs stripped copies.
+func canStream(name string) bool {
+	return name != MuxerFfmpeg || utils.PipeInputSupported
+}
+
+// nativeMuxer remuxes the streams as is, video tracks are dropped if dropVideo is set.
+func nativeMuxer(dropVideo bool) muxer {
+	return func(ctx context.Context, inputs []m4sInput, output string, meta *mp4.Metadata, rp *reporter) error {
+		return muxWithNative(ctx, inputs, output, meta, rp, dropVideo)
+	}
+}
+
+func muxWithNative(
+	ctx context.Context, inputs []m4sInput, output string, meta *mp4.Metadata, rp *reporter, dropVideo bool,
+) error {
+	tracks := []*mp4.Track{}
+	segments := []*io.SectionReader{}
+
+	for _, in := range inputs {
+		fin, r, err := in.open()
+		if err != nil {
+			return err
+		}
+		defer fin.Close()
+
+		if in.flv {
+			segments = append(segments, r)
+			continue
+		}
+
+		got, err := mp4.ReadFragmented(r, r.Size())
+		if err != nil {
+			return err
+		}
+
+		tracks = append(tracks, got...)
+	}
+
+	if len(segments) != 0 {
+		got, err := mp4.ReadFLV(segments...)
+		if err != nil {
+			return err
+		}
+
+		tracks = append(tracks, got...)
+	}
+
+	if dropVideo {
+		tracks = slices.DeleteFunc(tracks, func(t *mp4.Track) bool { return t.Handler == "vide" })
+	}
+
+	for _, t := range tracks {
+		if t.CodecTag() != _codecHEVC {
+			continue
+		}
+
+		if err := t.SetCodecTag(_codecHVC1); err != nil {
+			return err
+		}
+	}
+
+	// the output is about the same size of samples
+	total := int64(0)
+
+	for _, t := range tracks {
+		for _, s := range t.Samples {
+			total += int64(s.Size)
+		}
+	}
+
+	fout, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+
+	pw := &progressWriter{ctx: ctx, w: fout, onWrite: func(written int64) {
+		rp.report(Progress{Stage: StageMux, Bytes: min(written, total), Total: total})
+	}}
+
+	if _, err := mp4.Remux(pw, tracks, meta); err != nil {
+		return err
+	}
+
+	return fout.Close()
+}
+
+// ffmpegMuxer merges the inputs with codecArgs into the container of profile, mp4s are tagged by the mp4 package,
+// others by ffmpeg.
+func ffmpegMuxer(profile *Profile, codecArgs []string) muxer {
+	return func(ctx context.Context, inputs []m4sInput, output string, meta *mp4.Metadata, rp *reporter) error {
+		onProgress := func(t time.Duration) {
+			rp.report(Progress{Stage: StageMux, Time: t})
+		}
+
+		args := codecArgs
+
+		if meta != nil && !profile.isMP4() {
+			var err error
+			if args, err = ffmpegTagArgs(profile, codecArgs, inputs, meta, filepath.Dir(output)); err != nil {
+				return err
+			}
+		}
+
+		if err := ffmpegMerge(ctx, inputs, output, args, onProgress); err != nil {
+			return err
+		}
+
+		if meta == nil || !profile.isMP4() {
+			return nil
+		}
+
+		return mp4.TagFile(output, meta)
+	}
+}
+
+// ffmpegTagArgs adds meta to codecArgs as -metadata, the cover is attached as a picture of mp3s,
+// it's written into dir for ffmpeg to read.
+func ffmpegTagArgs(
+	profile *Profile, codecArgs []string, inputs []m4sInput, meta *mp4.Metadata, dir string,
+) ([]string, error) {
+	args := slices.Clone(codecArgs)
+
+	if profile.container() == ContainerMP3 && len(meta.Cover) != 0 {
+		cover := filepath.Join(dir, _coverFile)
+		if err := os.WriteFile(cover, meta.Cover, 0o644); err != nil {
+			return nil, err
+		}
+
+		// flv segments are a single concat input
+		streams := len(inputs)
+		if slices.ContainsFunc(inputs, func(in m4sInput) bool { return in.flv }) {
+			streams = 1
+		}
+
+		// the cover is the input after the streams, ffmpeg takes it before the output args
+		picture := []string{"-i", cover}
+		for i := range streams {
+			picture = append(picture, "-map", fmt.Sprintf("%d:a?", i))
+		}
+
+		picture = append(picture, "-map", fmt.Sprintf("%d:v", streams),
+			"-c:v", CodecCopy, "-disposition:v", "attached_pic", "-id3v2_version", "3")
+
+		// the picture stream is kept instead
+		args = append(picture, slices.DeleteFunc(args, func(a string) bool { return a == "-vn" })...)
+	}
+
+	return append(args, ffmpegMetadataArgs(meta)...), nil
+}
+
+// ffmpegMerge passes files to ffmpeg as is, or through pipes when there is a prefix to skip.
+// flv segments are joined by the concat demuxer.
+func ffmpegMerge(
+	ctx context.Context, inputs []m4sInput, output string, codecArgs []string, onProgress func(time.Duration),
+) error {
+	files := []string{}
+	readers := []io.Reader{}
+	piped, concat := false, false
+
+	for _, in := range inputs {
+		files = append(files, in.path)
+		piped = piped || in.offset != 0
+		concat = concat || in.flv
+
+		fin, r, err := in.open()
+		if err != nil {
+			return err
+		}
+		defer fin.Close()
+
+		readers = append(readers, r)
+	}
+
+	var err error
+
+	switch {
+	case concat:
+		_, err = utils.ConcatWithFfmpegContext(ctx, files, output, codecArgs, onProgress)
+	case piped:
+		_, err = utils.ConvertReadersWithFfmpegContext(ctx, readers, output, codecArgs, onProgress)
+	default:
+		_, err = utils.ConvertWithFfmpegContext(ctx, files, output, codecArgs, onProgress)
+	}
+
+	return err
+}
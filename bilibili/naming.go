@@ -0,0 +1,177 @@
+package bilibili
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/coghost/bilibili_cache_converter/utils"
+	"github.com/coghost/pathlib"
+	"github.com/spf13/cast"
+)
+
+// Built-in presets of Options.NameTemplate
+const (
+	// PresetGroup names output as `GroupTitle/Title`
+	PresetGroup = "group"
+	// PresetUploader names output as `Uname/GroupTitle/Title`
+	PresetUploader = "uploader"
+	// PresetPGC names output as `Show/Season 01/S01E03 - EpisodeTitle` which media servers recognize,
+	// it's the default of PGC content
+	PresetPGC = "pgc"
+	// PresetAudio names output as `Uname/GroupTitle/01 - Title`, i.e. artist/album/track like music libraries,
+	// it's the default of the audio-only mode
+	PresetAudio = "audio"
+)
+
+var _namePresets = map[string]string{
+	PresetGroup:    `{{.GroupTitle}}/{{.Title}}`,
+	PresetUploader: `{{.Uname}}/{{.GroupTitle}}/{{.Title}}`,
+	PresetPGC: `{{.Show}}/Season {{pad .Season 2}}/S{{pad .Season 2}}E{{pad .Episode 2}}` +
+		`{{with .EpisodeTitle}} - {{.}}{{end}}`,
+	PresetAudio: `{{.Uname}}/{{.GroupTitle}}/{{pad .Episode 2}} - {{.Title}}`,
+}
+
+// _qualityLabels maps qn to the label shown in bilibili player
+var _qualityLabels = map[int]string{
+	6:   "240P",
+	16:  "360P",
+	32:  "480P",
+	64:  "720P",
+	74:  "720P60",
+	80:  "1080P",
+	112: "1080P+",
+	116: "1080P60",
+	120: "4K",
+	125: "HDR",
+	126: "DolbyVision",
+	127: "8K",
+}
+
+var _nameFuncs = template.FuncMap{
+	// pad zero-pads a number, e.g. {{pad .P 3}} => 001
+	"pad": func(v any, width int) string {
+		return fmt.Sprintf("%0*d", width, cast.ToInt64(v))
+	},
+	// date formats a unix timestamp with go layout, e.g. {{date .Pubdate "2006-01-02"}}
+	"date": func(v any, layout string) string {
+		return time.Unix(cast.ToInt64(v), 0).Format(layout)
+	},
+	"sanitize": utils.SanitizeFilename,
+}
+
+// nameFields is the data of name templates, string fields are sanitized so they can't add sub dirs.
+type nameFields struct {
+	VideoInfo
+
+	// Quality is the label of Qn, e.g. 1080P
+	Quality string
+	// Show and Season are split from the season title, e.g. `进击的巨人 第二季` => 进击的巨人, 2
+	Show   string
+	Season int
+	// Episode is the episode number of PGC content, or P
+	Episode int
+}
+
+// QualityLabel returns the label of Qn, e.g. 1080P, or empty if unknown.
+func (v *VideoInfo) QualityLabel() string {
+	return _qualityLabels[v.Qn]
+}
+
+// FilenameFromTemplate renders tmpl (a preset name or a text/template) to a relative filename without extension,
+// `/` in tmpl is the path separator.
+func (v *VideoInfo) FilenameFromTemplate(tmpl string) (string, error) {
+	if preset, ok := _namePresets[tmpl]; ok {
+		tmpl = preset
+	}
+
+	t, err := template.New("name").Funcs(_nameFuncs).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidNameTemplate, err)
+	}
+
+	show, season := v.ShowAndSeason()
+	fields := nameFields{
+		VideoInfo: *v,
+		Quality:   v.QualityLabel(),
+		Show:      utils.SanitizeFilename(show),
+		Season:    season,
+		Episode:   v.EpisodeNumber(),
+	}
+	fields.Title = utils.SanitizeFilename(v.Title)
+	fields.GroupTitle = utils.SanitizeFilename(v.GroupTitle)
+	fields.Uname = utils.SanitizeFilename(v.Uname)
+	fields.TabName = utils.SanitizeFilename(v.TabName)
+	fields.SeasonTitle = utils.SanitizeFilename(v.SeasonTitle)
+	fields.EpisodeTitle = utils.SanitizeFilename(v.EpisodeTitle)
+
+	var sb strings.Builder
+	if err := t.Execute(&sb, fields); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidNameTemplate, err)
+	}
+
+	// empty segments (e.g. from an empty GroupTitle) are dropped
+	segments := []string{}
+
+	for _, seg := range strings.Split(sb.String(), "/") {
+		switch strings.TrimSpace(seg) {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("%w: %q escapes the output dir", ErrInvalidNameTemplate, sb.String())
+		}
+
+		segments = append(segments, seg)
+	}
+
+	if len(segments) == 0 {
+		return "", fmt.Errorf("%w: %q renders to empty name", ErrInvalidNameTemplate, tmpl)
+	}
+
+	name := strings.Join(segments, "/")
+
+	return name, nil
+}
+
+// nameTemplate returns NameTemplate, or when it is empty, PresetAudio for the audio-only mode, PresetPGC for
+// PGC content and the preset picked by UseUploaderAsSubDir for others.
+func (o *Options) nameTemplate(video *VideoInfo) string {
+	if o.NameTemplate != "" {
+		return o.NameTemplate
+	}
+
+	if o.profile().dropsVideo() {
+		return PresetAudio
+	}
+
+	if video.IsPGC() {
+		return PresetPGC
+	}
+
+	if o.UseUploaderAsSubDir {
+		return PresetUploader
+	}
+
+	return PresetGroup
+}
+
+// outputName returns the output filename relative to OutputDir, with the extension of the profile container.
+func (o *Options) outputName(video *VideoInfo) (string, error) {
+	name, err := video.FilenameFromTemplate(o.nameTemplate(video))
+	if err != nil {
+		return "", err
+	}
+
+	return name + o.profile().ext(), nil
+}
+
+// OutputPath returns the absolute path of the output converted from video, e.g. the mp4.
+func (o *Options) OutputPath(video *VideoInfo) (string, error) {
+	name, err := o.outputName(video)
+	if err != nil {
+		return "", err
+	}
+
+	return pathlib.Path(o.OutputDir).ExpandUser().Join(name).AbsPath(), nil
+}
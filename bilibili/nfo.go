@@ -0,0 +1,232 @@
+package bilibili
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coghost/pathlib"
+)
+
+// sidecar files of media servers (Kodi/Jellyfin/Emby)
+const (
+	_nfoDotExt       = ".nfo"
+	_tvshowNFOFile   = "tvshow.nfo"
+	_folderImageFile = "folder.jpg"
+	_posterImageFile = "poster.jpg"
+	_thumbSuffix     = "-thumb.jpg"
+	// _seasonDirPrefix is the season folder of PresetPGC, tvshow.nfo goes to its parent
+	_seasonDirPrefix = "Season "
+	_nfoUniqueIDType = "bilibili"
+)
+
+type nfoUniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+// episodeNFO is `<episode>.nfo` next to the mp4.
+type episodeNFO struct {
+	XMLName   xml.Name      `xml:"episodedetails"`
+	Title     string        `xml:"title"`
+	ShowTitle string        `xml:"showtitle,omitempty"`
+	Season    int           `xml:"season"`
+	Episode   int           `xml:"episode"`
+	Plot      string        `xml:"plot,omitempty"`
+	Runtime   int           `xml:"runtime,omitempty"`
+	Aired     string        `xml:"aired,omitempty"`
+	Director  string        `xml:"director,omitempty"`
+	Studio    string        `xml:"studio,omitempty"`
+	UniqueIDs []nfoUniqueID `xml:"uniqueid"`
+	Thumb     string        `xml:"thumb,omitempty"`
+}
+
+// tvshowNFO is `tvshow.nfo` in the folder of a group.
+type tvshowNFO struct {
+	XMLName   xml.Name      `xml:"tvshow"`
+	Title     string        `xml:"title"`
+	Plot      string        `xml:"plot,omitempty"`
+	Premiered string        `xml:"premiered,omitempty"`
+	Studio    string        `xml:"studio,omitempty"`
+	UniqueIDs []nfoUniqueID `xml:"uniqueid"`
+	Thumb     string        `xml:"thumb,omitempty"`
+}
+
+// exportNFO writes `<episode>.nfo` and `<episode>-thumb.jpg` next to output, and `tvshow.nfo`, `folder.jpg`
+// and `poster.jpg` into the group folder if missing. Episode files are kept if they exist and overwrite is false.
+// The group files are skipped when output is right in outputDir, as it's not a group folder.
+// Images are the covers cached by format in dir, they are skipped if not cached.
+func exportNFO(format CacheFormat, dir, output, outputDir string, video *VideoInfo, overwrite bool) error {
+	base := strings.TrimSuffix(output, filepath.Ext(output))
+
+	videoCover, groupCover := format.Covers(dir)
+	if videoCover == "" && groupCover == "" {
+		log.Printf("no cached cover of %s, nfo exported without images", dir)
+	}
+	show, season := video.ShowAndSeason()
+
+	episode := &episodeNFO{
+		Title:     video.Title,
+		ShowTitle: show,
+		Season:    season,
+		Episode:   video.EpisodeNumber(),
+		Plot:      nfoPlot(video),
+		Aired:     nfoDate(video.Pubdate),
+		Director:  video.Uname,
+		Studio:    video.Uname,
+		UniqueIDs: []nfoUniqueID{{Type: _nfoUniqueIDType, Default: true, Value: nfoEpisodeID(video)}},
+		Thumb:     video.CoverURL,
+	}
+
+	if video.Duration > 0 {
+		// minutes, rounded up so short videos don't get 0
+		episode.Runtime = (video.Duration + 59) / 60
+	}
+
+	errs := []error{
+		writeNFO(base+_nfoDotExt, episode, overwrite),
+		copyImage(base+_thumbSuffix, overwrite, videoCover),
+	}
+
+	showDir := filepath.Dir(output)
+	if strings.HasPrefix(filepath.Base(showDir), _seasonDirPrefix) {
+		showDir = filepath.Dir(showDir)
+	}
+
+	if showDir == pathlib.Path(outputDir).ExpandUser().AbsPath() {
+		return errors.Join(errs...)
+	}
+
+	tvshow := &tvshowNFO{
+		Title:     show,
+		Plot:      strings.TrimSpace(video.Uname + "\n" + nfoGroupURL(video)),
+		Premiered: episode.Aired,
+		Studio:    video.Uname,
+		UniqueIDs: []nfoUniqueID{{Type: _nfoUniqueIDType, Default: true, Value: video.GroupKey()}},
+		Thumb:     video.GroupCoverURL,
+	}
+
+	// the group cover, or the cover of the first video converted
+	errs = append(errs,
+		writeNFO(filepath.Join(showDir, _tvshowNFOFile), tvshow, false),
+		copyImage(filepath.Join(showDir, _folderImageFile), false, groupCover, videoCover),
+		copyImage(filepath.Join(showDir, _posterImageFile), false, groupCover, videoCover),
+	)
+
+	return errors.Join(errs...)
+}
+
+func nfoPlot(video *VideoInfo) string {
+	lines := []string{}
+	if video.Uname != "" {
+		lines = append(lines, video.Uname)
+	}
+
+	lines = append(lines, fmt.Sprintf("views: %d, danmaku: %d", video.View, video.Danmaku), nfoEpisodeURL(video))
+
+	return strings.Join(lines, "\n")
+}
+
+// nfoDate formats a unix timestamp as 2006-01-02, empty if not set.
+func nfoDate(ts int) string {
+	if ts <= 0 {
+		return ""
+	}
+
+	return time.Unix(int64(ts), 0).UTC().Format(time.DateOnly)
+}
+
+func nfoEpisodeID(video *VideoInfo) string {
+	if video.IsPGC() && video.EpisodeID != "" {
+		return "ep" + video.EpisodeID
+	}
+
+	if video.Bvid != "" {
+		return fmt.Sprintf("%s?p=%d", video.Bvid, video.P)
+	}
+
+	return video.ItemID
+}
+
+func nfoEpisodeURL(video *VideoInfo) string {
+	if video.IsPGC() && video.EpisodeID != "" {
+		return "https://www.bilibili.com/bangumi/play/ep" + video.EpisodeID
+	}
+
+	return video.URLWithP()
+}
+
+func nfoGroupURL(video *VideoInfo) string {
+	if video.IsPGC() && video.SeasonID != "" {
+		return "https://www.bilibili.com/bangumi/play/ss" + video.SeasonID
+	}
+
+	if video.Bvid != "" {
+		return "https://www.bilibili.com/video/" + video.Bvid
+	}
+
+	return ""
+}
+
+// writeNFO writes v as xml into file, an existing file is kept unless overwrite.
+func writeNFO(file string, v any, overwrite bool) error {
+	if !overwrite && isFile(file) {
+		return nil
+	}
+
+	return writeFile(file, func(w io.Writer) error {
+		if _, err := io.WriteString(w, xml.Header); err != nil {
+			return err
+		}
+
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+
+		_, err := io.WriteString(w, "\n")
+
+		return err
+	})
+}
+
+// copyImage copies the first of sources found into file, empty sources are skipped,
+// an existing file is kept unless overwrite.
+func copyImage(file string, overwrite bool, sources ...string) error {
+	if !overwrite && isFile(file) {
+		return nil
+	}
+
+	for _, src := range sources {
+		if src == "" {
+			continue
+		}
+
+		fin, err := os.Open(src)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+		defer fin.Close()
+
+		return writeFile(file, func(w io.Writer) error {
+			_, err := io.Copy(w, fin)
+			return err
+		})
+	}
+
+	return nil
+}
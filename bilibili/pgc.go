@@ -0,0 +1,117 @@
+package bilibili
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Types of VideoInfo
+const (
+	// TypeUGC is user uploaded content
+	TypeUGC = "ugc"
+	// TypePGC is bangumi, movies, documentaries... organized in seasons and episodes
+	TypePGC = "pgc"
+)
+
+// _seasonPatterns find the season number in a season title, e.g. 第二季, 第2季, Season 2
+var _seasonPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\s*第([0-9一二三四五六七八九十]+)季\s*`),
+	regexp.MustCompile(`(?i)\s*season\s*([0-9]+)\s*`),
+}
+
+var _chineseDigits = map[rune]int{'一': 1, '二': 2, '三': 3, '四': 4, '五': 5, '六': 6, '七': 7, '八': 8, '九': 9}
+
+// IsPGC tells whether the video is an episode of bangumi, movies or documentaries.
+func (v *VideoInfo) IsPGC() bool {
+	return strings.EqualFold(v.Type, TypePGC) || v.SeasonID != ""
+}
+
+// GroupKey returns the id videos are grouped by: `ss<SeasonID>` of PGC content, GroupID otherwise.
+func (v *VideoInfo) GroupKey() string {
+	if v.IsPGC() && v.SeasonID != "" {
+		return "ss" + v.SeasonID
+	}
+
+	return v.GroupID
+}
+
+// GroupName returns the title videos are grouped by: the season of PGC content, GroupTitle otherwise,
+// falls back to GroupKey if no title is found.
+func (v *VideoInfo) GroupName() string {
+	title := v.GroupTitle
+	if v.IsPGC() && v.SeasonTitle != "" {
+		title = v.SeasonTitle
+	}
+
+	if title == "" {
+		title = v.GroupKey()
+	}
+
+	return title
+}
+
+// EpisodeNumber returns the episode index of PGC content, or P if the index is not a number, e.g. SP.
+func (v *VideoInfo) EpisodeNumber() int {
+	if v.IsPGC() {
+		if n, err := strconv.Atoi(strings.TrimSpace(v.EpisodeIndex)); err == nil && n > 0 {
+			return n
+		}
+	}
+
+	return v.P
+}
+
+// ShowAndSeason splits the season title into the show and the season number, e.g. `进击的巨人 第二季` => 进击的巨人, 2.
+// Season is 1 if no season is found in the title.
+func (v *VideoInfo) ShowAndSeason() (string, int) {
+	return parseSeason(v.GroupName())
+}
+
+func parseSeason(title string) (string, int) {
+	for _, re := range _seasonPatterns {
+		m := re.FindStringSubmatchIndex(title)
+		if m == nil {
+			continue
+		}
+
+		season := parseSeasonNumber(title[m[2]:m[3]])
+		if season == 0 {
+			continue
+		}
+
+		show := strings.TrimSpace(title[:m[0]] + " " + title[m[1]:])
+		show = strings.TrimRight(show, " :：-")
+
+		if show == "" {
+			show = title
+		}
+
+		return show, season
+	}
+
+	return title, 1
+}
+
+// parseSeasonNumber parses arabic numerals or chinese ones up to 99, e.g. 十二.
+func parseSeasonNumber(s string) int {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+
+	n, tens := 0, 0
+
+	for _, r := range s {
+		switch {
+		case r == '十':
+			tens = max(n, 1)
+			n = 0
+		case _chineseDigits[r] != 0:
+			n = _chineseDigits[r]
+		default:
+			return 0
+		}
+	}
+
+	return tens*10 + n
+}
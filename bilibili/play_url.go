@@ -0,0 +1,207 @@
+package bilibili
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coghost/pathlib"
+)
+
+// dash video stream files are named as `cid-n-(30000+id).m4s`
+const _dashVideoIDBase = 30000
+
+type PlayURL struct {
+	From              string          `json:"from"`
+	Quality           int             `json:"quality"`
+	Format            string          `json:"format"`
+	Timelength        int             `json:"timelength"`
+	AcceptFormat      string          `json:"accept_format"`
+	AcceptDescription []string        `json:"accept_description"`
+	AcceptQuality     []int           `json:"accept_quality"`
+	VideoCodecid      int             `json:"video_codecid"`
+	Dash              Dash            `json:"dash"`
+	SupportFormats    []SupportFormat `json:"support_formats"`
+}
+
+type Dash struct {
+	Duration      int          `json:"duration"`
+	MinBufferTime float64      `json:"min_buffer_time"`
+	Video         []DashStream `json:"video"`
+	Audio         []DashStream `json:"audio"`
+	Dolby         *DashDolby   `json:"dolby"`
+	Flac          *DashFlac    `json:"flac"`
+}
+
+type DashDolby struct {
+	Type  int          `json:"type"`
+	Audio []DashStream `json:"audio"`
+}
+
+type DashFlac struct {
+	Display bool        `json:"display"`
+	Audio   *DashStream `json:"audio"`
+}
+
+type DashStream struct {
+	ID        int    `json:"id"`
+	BaseURL   string `json:"base_url"`
+	Bandwidth int    `json:"bandwidth"`
+	MimeType  string `json:"mime_type"`
+	Codecs    string `json:"codecs"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	FrameRate string `json:"frame_rate"`
+	Codecid   int    `json:"codecid"`
+}
+
+type SupportFormat struct {
+	Quality        int      `json:"quality"`
+	Format         string   `json:"format"`
+	NewDescription string   `json:"new_description"`
+	DisplayDesc    string   `json:"display_desc"`
+	Codecs         []string `json:"codecs"`
+}
+
+// MediaFiles is the local m4s files identified as video/audio track.
+type MediaFiles struct {
+	Video       string
+	Audio       string
+	VideoStream *DashStream
+	AudioStream *DashStream
+}
+
+// Files returns the identified files with video in front.
+func (m *MediaFiles) Files() []string {
+	files := []string{}
+
+	for _, file := range []string{m.Video, m.Audio} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// Filename returns the file name of the stream in its url, e.g. `26349405204-1-30016.m4s`
+func (s *DashStream) Filename() string {
+	u, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return ""
+	}
+
+	return path.Base(u.Path)
+}
+
+// MatchFile checks if the cached file is this stream, by name from url or by stream id.
+func (s *DashStream) MatchFile(file string) bool {
+	name := filepath.Base(file)
+	if name == s.Filename() {
+		return true
+	}
+
+	id := streamIDFromFilename(name)
+
+	return id != 0 && (id == s.ID || id == _dashVideoIDBase+s.ID)
+}
+
+// QualityDescription returns the description of current quality, e.g. `流畅 360P`
+func (p *PlayURL) QualityDescription() string {
+	for _, f := range p.SupportFormats {
+		if f.Quality == p.Quality {
+			return f.NewDescription
+		}
+	}
+
+	for i, q := range p.AcceptQuality {
+		if q == p.Quality && i < len(p.AcceptDescription) {
+			return p.AcceptDescription[i]
+		}
+	}
+
+	return ""
+}
+
+// AudioStreams returns all audio streams, including dolby and flac ones.
+func (p *PlayURL) AudioStreams() []DashStream {
+	streams := append([]DashStream{}, p.Dash.Audio...)
+
+	if p.Dash.Dolby != nil {
+		streams = append(streams, p.Dash.Dolby.Audio...)
+	}
+
+	if p.Dash.Flac != nil && p.Dash.Flac.Audio != nil {
+		streams = append(streams, *p.Dash.Flac.Audio)
+	}
+
+	return streams
+}
+
+// MatchFiles identifies which of the files is the video track and which is the audio track.
+func (p *PlayURL) MatchFiles(files []string) (*MediaFiles, error) {
+	media := &MediaFiles{}
+	audios := p.AudioStreams()
+
+	for _, file := range files {
+		for i := range p.Dash.Video {
+			if media.Video == "" && p.Dash.Video[i].MatchFile(file) {
+				media.Video, media.VideoStream = file, &p.Dash.Video[i]
+			}
+		}
+
+		for i := range audios {
+			if media.Audio == "" && file != media.Video && audios[i].MatchFile(file) {
+				media.Audio, media.AudioStream = file, &audios[i]
+			}
+		}
+	}
+
+	if media.Video == "" && media.Audio == "" {
+		return nil, fmt.Errorf("%w: %s", ErrStreamNotMatched, strings.Join(files, ", "))
+	}
+
+	return media, nil
+}
+
+// ParsePlayURL parses the cached `.playurl` file.
+func ParsePlayURL(file string) (*PlayURL, error) {
+	data, err := pathlib.Path(file).GetBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Code    int      `json:"code"`
+		Message string   `json:"message"`
+		Data    *PlayURL `json:"data"`
+	}
+
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Data == nil {
+		return nil, fmt.Errorf("%w: code=%d, message=%s", ErrNoPlayURLData, resp.Code, resp.Message)
+	}
+
+	return resp.Data, nil
+}
+
+// streamIDFromFilename gets stream id from `cid-n-id.m4s`, 0 is returned if not found.
+func streamIDFromFilename(name string) int {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+
+	idx := strings.LastIndex(name, "-")
+	if idx == -1 {
+		return 0
+	}
+
+	id, _ := strconv.Atoi(name[idx+1:])
+
+	return id
+}
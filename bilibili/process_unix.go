@@ -0,0 +1,29 @@
+//go:build !windows
+
+package bilibili
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// processAlive sends signal 0 to pid, which checks the process exists without touching it.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	if pid == os.Getpid() {
+		return true
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = p.Signal(syscall.Signal(0))
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
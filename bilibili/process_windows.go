@@ -0,0 +1,39 @@
+package bilibili
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const (
+	// _processQueryLimitedInformation is enough for GetExitCodeProcess, and granted for processes of other users
+	_processQueryLimitedInformation = 0x1000
+	// _stillActive is the exit code of a running process
+	_stillActive = 259
+)
+
+// processAlive opens pid and checks it has not exited, signals can't be sent on windows.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	if pid == os.Getpid() {
+		return true
+	}
+
+	h, err := syscall.OpenProcess(_processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		// the process exists but is not ours to query
+		return errors.Is(err, syscall.ERROR_ACCESS_DENIED)
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+
+	return code == _stillActive
+}
@@ -0,0 +1,307 @@
+package bilibili
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/coghost/pathlib"
+)
+
+// names of the built-in profiles
+const (
+	ProfileCopy        = "copy"
+	ProfileMobile720p  = "mobile-720p"
+	ProfileArchiveHEVC = "archive-hevc"
+	ProfileAudioOnly   = "audio-only"
+	ProfileAudioMP3    = "audio-mp3"
+	ProfileAudioOpus   = "audio-opus"
+)
+
+// special codecs of Profile
+const (
+	// CodecCopy keeps the stream as is
+	CodecCopy = "copy"
+	// CodecNone drops the stream
+	CodecNone = "none"
+)
+
+// containers of Profile
+const (
+	ContainerMP4  = "mp4"
+	ContainerMKV  = "mkv"
+	ContainerWebM = "webm"
+	// ContainerM4A is mp4 of audio only
+	ContainerM4A = "m4a"
+	// ContainerMP3 and ContainerOpus(ogg) are audio only, the audio must be encoded to them
+	ContainerMP3  = "mp3"
+	ContainerOpus = "opus"
+)
+
+var _containers = []string{ContainerMP4, ContainerMKV, ContainerWebM, ContainerM4A, ContainerMP3, ContainerOpus}
+
+// _audioProfiles are the profiles of the audio-only mode by the output format
+var _audioProfiles = map[string]string{
+	ContainerM4A:  ProfileAudioOnly,
+	ContainerMP3:  ProfileAudioMP3,
+	ContainerOpus: ProfileAudioOpus,
+}
+
+// Profile is how the streams are encoded and contained, the built-in ones are in BuiltinProfiles,
+// others are defined in a profile config file, see LoadProfile.
+type Profile struct {
+	Name string `json:"name"`
+	// VideoCodec is an ffmpeg encoder, e.g. libx264, or copy(default) to keep the stream, none to drop it
+	VideoCodec string `json:"videoCodec,omitempty"`
+	// AudioCodec is an ffmpeg encoder, e.g. aac, or copy(default) to keep the stream, none to drop it
+	AudioCodec string `json:"audioCodec,omitempty"`
+	// CRF of the video encoder, VideoBitrate is used if it's 0
+	CRF int `json:"crf,omitempty"`
+	// VideoBitrate and AudioBitrate of the encoders, e.g. 2M and 128k
+	VideoBitrate string `json:"videoBitrate,omitempty"`
+	AudioBitrate string `json:"audioBitrate,omitempty"`
+	// Preset of the video encoder, e.g. medium
+	Preset string `json:"preset,omitempty"`
+	// MaxHeight scales taller videos down keeping the aspect ratio, 0 keeps the size
+	MaxHeight int `json:"maxHeight,omitempty"`
+	// Container is the output format: mp4(default), mkv, webm, or m4a/mp3/opus for audio only
+	Container string `json:"container,omitempty"`
+	// Args are extra ffmpeg output args, e.g. ["-movflags", "+faststart"]
+	Args []string `json:"args,omitempty"`
+}
+
+// BuiltinProfiles returns the built-in profiles by name, a copy each call.
+func BuiltinProfiles() map[string]*Profile {
+	return map[string]*Profile{
+		ProfileCopy: {Name: ProfileCopy},
+		ProfileMobile720p: {
+			Name: ProfileMobile720p, VideoCodec: "libx264", Preset: "veryfast", CRF: 26, MaxHeight: 720,
+			AudioCodec: "aac", AudioBitrate: "128k", Args: []string{"-movflags", "+faststart"},
+		},
+		ProfileArchiveHEVC: {Name: ProfileArchiveHEVC, VideoCodec: "libx265", Preset: "slow", CRF: 24},
+		ProfileAudioOnly:   {Name: ProfileAudioOnly, VideoCodec: CodecNone, Container: ContainerM4A},
+		ProfileAudioMP3: {
+			Name: ProfileAudioMP3, VideoCodec: CodecNone, AudioCodec: "libmp3lame", AudioBitrate: "192k",
+			Container: ContainerMP3,
+		},
+		ProfileAudioOpus: {
+			Name: ProfileAudioOpus, VideoCodec: CodecNone, AudioCodec: "libopus", AudioBitrate: "128k",
+			Container: ContainerOpus,
+		},
+	}
+}
+
+// AudioProfileName returns the profile of the audio-only mode writing format: m4a(the audio stream as is),
+// mp3 or opus.
+func AudioProfileName(format string) (string, error) {
+	name, ok := _audioProfiles[format]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown audio format %q, available: %s", ErrUnknownProfile, format,
+			strings.Join(slices.Sorted(maps.Keys(_audioProfiles)), "/"))
+	}
+
+	return name, nil
+}
+
+// LoadProfile returns the profile of name, from configFile if it's defined there, or the built-in ones.
+// configFile is a json file of profiles by name, e.g. `{"profiles": {"custom": {"videoCodec": "libsvtav1"}}}`,
+// it's ignored if empty.
+func LoadProfile(name, configFile string) (*Profile, error) {
+	profiles := BuiltinProfiles()
+
+	if configFile != "" {
+		data, err := os.ReadFile(pathlib.Path(configFile).ExpandUser().AbsPath())
+		if err != nil {
+			return nil, err
+		}
+
+		var config struct {
+			Profiles map[string]*Profile `json:"profiles"`
+		}
+
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidProfile, configFile, err)
+		}
+
+		for key, p := range config.Profiles {
+			if p == nil {
+				continue
+			}
+
+			p.Name = key
+			profiles[key] = p
+		}
+	}
+
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+	}
+
+	return profile, profile.validate()
+}
+
+func (p *Profile) validate() error {
+	if p.Container != "" && !slices.Contains(_containers, p.Container) {
+		return fmt.Errorf("%w: %s: unknown container %q, available: %v", ErrInvalidProfile, p.Name, p.Container, _containers)
+	}
+
+	if (p.container() == ContainerMP3 || p.container() == ContainerOpus) && !p.dropsVideo() {
+		return fmt.Errorf("%w: %s: %s is audio only, set videoCodec to none", ErrInvalidProfile, p.Name, p.Container)
+	}
+
+	if p.dropsVideo() && p.dropsAudio() {
+		return fmt.Errorf("%w: %s: both streams are dropped", ErrInvalidProfile, p.Name)
+	}
+
+	return nil
+}
+
+// profile returns Options.Profile, or the copy profile if it's nil.
+func (o *Options) profile() *Profile {
+	if o.Profile != nil {
+		return o.Profile
+	}
+
+	return &Profile{Name: ProfileCopy}
+}
+
+func (p *Profile) container() string {
+	if p.Container == "" {
+		return ContainerMP4
+	}
+
+	return p.Container
+}
+
+// ext returns the extension of the output, e.g. `.mp4`.
+func (p *Profile) ext() string {
+	return "." + p.container()
+}
+
+// isMP4 tells whether the output is read by the mp4 package, i.e. tagged and validated natively.
+func (p *Profile) isMP4() bool {
+	return p.container() == ContainerMP4 || p.container() == ContainerM4A
+}
+
+func (p *Profile) copiesVideo() bool {
+	return p.VideoCodec == "" || p.VideoCodec == CodecCopy
+}
+
+func (p *Profile) copiesAudio() bool {
+	return p.AudioCodec == "" || p.AudioCodec == CodecCopy
+}
+
+func (p *Profile) dropsVideo() bool {
+	return p.VideoCodec == CodecNone
+}
+
+func (p *Profile) dropsAudio() bool {
+	return p.AudioCodec == CodecNone
+}
+
+// native tells whether the native muxer can make the output, i.e. nothing is encoded into an mp4.
+func (p *Profile) native() bool {
+	return (p.copiesVideo() || p.dropsVideo()) && (p.copiesAudio() || p.dropsAudio()) && p.isMP4() && len(p.Args) == 0
+}
+
+// ffmpegArgs returns the codec args of ffmpeg for the video of codec, hevc/av1 are transcoded as avc if toAVC is set
+// and the video is copied.
+func (p *Profile) ffmpegArgs(codec string, toAVC bool) []string {
+	args := []string{}
+
+	switch {
+	case p.dropsVideo():
+		args = append(args, "-vn")
+	case p.copiesVideo() && needsTranscode(codec, toAVC):
+		args = append(args, _avcTranscodeArgs...)
+	case p.copiesVideo():
+		args = append(args, "-c:v", CodecCopy)
+
+		if codec == CodecHEVC && p.isMP4() {
+			args = append(args, "-tag:v", _codecHVC1)
+		}
+	default:
+		args = append(args, p.videoEncoderArgs()...)
+	}
+
+	switch {
+	case p.dropsAudio():
+		args = append(args, "-an")
+	case p.copiesAudio():
+		args = append(args, "-c:a", CodecCopy)
+	default:
+		args = append(args, "-c:a", p.AudioCodec)
+
+		if p.AudioBitrate != "" {
+			args = append(args, "-b:a", p.AudioBitrate)
+		}
+	}
+
+	return append(args, p.Args...)
+}
+
+func (p *Profile) videoEncoderArgs() []string {
+	args := []string{"-c:v", p.VideoCodec}
+
+	if p.Preset != "" {
+		args = append(args, "-preset", p.Preset)
+	}
+
+	switch {
+	case p.CRF > 0:
+		args = append(args, "-crf", fmt.Sprint(p.CRF))
+	case p.VideoBitrate != "":
+		args = append(args, "-b:v", p.VideoBitrate)
+	}
+
+	if p.MaxHeight > 0 {
+		// -2 keeps the width even, which most encoders require
+		args = append(args, "-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", p.MaxHeight))
+	}
+
+	family := codecFamily(p.VideoCodec)
+
+	// 8 bit 4:2:0 is what players decode
+	if family == CodecAVC || family == CodecHEVC {
+		args = append(args, "-pix_fmt", "yuv420p")
+	}
+
+	if family == CodecHEVC && p.isMP4() {
+		args = append(args, "-tag:v", _codecHVC1)
+	}
+
+	return args
+}
+
+// expectedOutput returns the tracks expected in the output of the profile, with the codecs of the cache
+// (i.e. those of .playurl) for copied streams.
+func (p *Profile) expectedOutput(videoCodec, audioCodec string, transcoded bool) expectedOutput {
+	want := expectedOutput{videoTracks: 1, audioTracks: 1, videoCodec: videoCodec, audioCodec: audioCodec}
+
+	switch {
+	case p.dropsVideo():
+		want.videoTracks, want.videoCodec = 0, ""
+	case transcoded:
+		want.videoCodec = _codecAVC
+	case !p.copiesVideo():
+		want.videoCodec = p.VideoCodec
+	}
+
+	switch {
+	case p.dropsAudio():
+		want.audioTracks, want.audioCodec = 0, ""
+	case !p.copiesAudio():
+		want.audioCodec = p.AudioCodec
+	}
+
+	return want
+}
+
+// String returns the name and the ffmpeg args, for logs.
+func (p *Profile) String() string {
+	return fmt.Sprintf("%s(%s, %s)", p.Name, p.container(), strings.Join(p.ffmpegArgs("", false), " "))
+}
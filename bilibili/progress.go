@@ -0,0 +1,98 @@
+package bilibili
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Stage of ConvertVideo, reported to ProgressFunc when it changes.
+type Stage string
+
+const (
+	// StageCopy strips the cache prefix of m4s files
+	StageCopy Stage = "copy"
+	// StageMux merges streams into the mp4
+	StageMux Stage = "mux"
+	// StageValidate checks the mp4 before it's moved into place
+	StageValidate Stage = "validate"
+	// StageDanmaku exports danmaku subtitles
+	StageDanmaku Stage = "danmaku"
+	// StageNFO exports media server sidecars
+	StageNFO Stage = "nfo"
+	// StageDone is reported once the video is converted or skipped
+	StageDone Stage = "done"
+)
+
+// Progress of converting the video in InputDir.
+type Progress struct {
+	InputDir string
+	Stage    Stage
+
+	// Bytes of Total copied(StageCopy), or written by the native muxer(StageMux)
+	Bytes int64
+	Total int64
+	// Time is the output time reported by `ffmpeg -progress`(StageMux)
+	Time time.Duration
+	// Percent of the stage, from 0 to 100
+	Percent float64
+}
+
+// ProgressFunc is called from the converting goroutine, it should return quickly.
+type ProgressFunc func(Progress)
+
+// reporter fills InputDir and Percent of progress before calling ProgressFunc, which can be nil.
+type reporter struct {
+	inputDir string
+	fn       ProgressFunc
+	// duration of the video, for the percentage of ffmpeg time
+	duration time.Duration
+}
+
+func (r *reporter) report(p Progress) {
+	if r == nil || r.fn == nil {
+		return
+	}
+
+	p.InputDir = r.inputDir
+
+	switch {
+	case p.Total > 0:
+		p.Percent = float64(p.Bytes) * 100 / float64(p.Total)
+	case p.Time > 0 && r.duration > 0:
+		p.Percent = float64(p.Time) * 100 / float64(r.duration)
+	case p.Stage == StageDone:
+		p.Percent = 100
+	}
+
+	p.Percent = min(p.Percent, 100)
+
+	r.fn(p)
+}
+
+func (r *reporter) stage(stage Stage) {
+	r.report(Progress{Stage: stage})
+}
+
+// progressWriter counts bytes written, and fails once ctx is done so long copies can be aborted.
+type progressWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	written int64
+	onWrite func(written int64)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	if err := pw.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+
+	if pw.onWrite != nil {
+		pw.onWrite(pw.written)
+	}
+
+	return n, err
+}
@@ -0,0 +1,147 @@
+package bilibili
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/coghost/bilibili_cache_converter/utils"
+)
+
+// lines of ffmpeg stderr kept in ConversionResult
+const _stderrTailLines = 20
+
+// Status of a ConversionResult.
+type Status string
+
+const (
+	StatusConverted Status = "converted"
+	// StatusSkipped means the output exists already, or the cache is not ready (see Integrity)
+	StatusSkipped Status = "skipped"
+	StatusFailed  Status = "failed"
+)
+
+// ConversionResult is the result of converting one cache folder.
+type ConversionResult struct {
+	InputDir string `json:"inputDir"`
+	// Output is the absolute path of the mp4, empty if it's unknown
+	Output string `json:"output,omitempty"`
+	Status Status `json:"status"`
+	// BytesIn is the size of the m4s streams, without the cache prefix
+	BytesIn int64 `json:"bytesIn"`
+	// BytesOut is the size of the mp4
+	BytesOut int64 `json:"bytesOut"`
+	// Duration is the time spent on converting
+	Duration time.Duration `json:"-"`
+	// Profile is the name of Options.Profile converted with
+	Profile string `json:"profile,omitempty"`
+	// Codec of the cached video stream, e.g. avc, hevc or av1, empty if unknown
+	Codec string `json:"codec,omitempty"`
+	// Transcoded is set when the video is re-encoded as avc by Options.TranscodeToAVC
+	Transcoded bool `json:"transcoded,omitempty"`
+	// StderrTail is the last lines of ffmpeg stderr when it fails
+	StderrTail string `json:"stderrTail,omitempty"`
+	// Integrity is set when skipped as the cache is not ready
+	Integrity *IntegrityReport `json:"integrity,omitempty"`
+	// Validation is the check of the mp4, the video fails if it's not valid
+	Validation *ValidationReport `json:"validation,omitempty"`
+	Video      *VideoInfo        `json:"video,omitempty"`
+	Err        error             `json:"-"`
+}
+
+func (r *ConversionResult) MarshalJSON() ([]byte, error) {
+	type result ConversionResult
+
+	errMsg := ""
+	if r.Err != nil {
+		errMsg = r.Err.Error()
+	}
+
+	return json.Marshal(struct {
+		*result
+		Duration string `json:"duration"`
+		Error    string `json:"error,omitempty"`
+	}{(*result)(r), r.Duration.String(), errMsg})
+}
+
+// finish sets Status and the fields derived from err.
+func (r *ConversionResult) finish(err error) {
+	r.Err = err
+
+	switch {
+	case err != nil:
+		r.Status = StatusFailed
+
+		var cmdErr *utils.CommandError
+		if errors.As(err, &cmdErr) {
+			r.StderrTail = cmdErr.StderrTail(_stderrTailLines)
+		}
+	case r.Status == "":
+		r.Status = StatusConverted
+	}
+
+	if r.Output != "" && r.Status != StatusFailed {
+		if st, err := os.Stat(r.Output); err == nil {
+			r.BytesOut = st.Size()
+		}
+	}
+}
+
+// RunSummary aggregates the results of a CacheVideoConverter run.
+type RunSummary struct {
+	Started   time.Time     `json:"started"`
+	Duration  time.Duration `json:"-"`
+	Total     int           `json:"total"`
+	Converted int           `json:"converted"`
+	Skipped   int           `json:"skipped"`
+	Failed    int           `json:"failed"`
+	BytesIn   int64         `json:"bytesIn"`
+	BytesOut  int64         `json:"bytesOut"`
+
+	Results []*ConversionResult `json:"results"`
+}
+
+func (s *RunSummary) MarshalJSON() ([]byte, error) {
+	type summary RunSummary
+
+	return json.Marshal(struct {
+		*summary
+		Duration string `json:"duration"`
+	}{(*summary)(s), s.Duration.String()})
+}
+
+func newRunSummary(started time.Time, results []*ConversionResult) *RunSummary {
+	s := &RunSummary{
+		Started:  started,
+		Duration: time.Since(started),
+		Total:    len(results),
+		Results:  results,
+	}
+
+	for _, res := range results {
+		switch res.Status {
+		case StatusConverted:
+			s.Converted++
+		case StatusSkipped:
+			s.Skipped++
+		default:
+			s.Failed++
+		}
+
+		s.BytesIn += res.BytesIn
+		s.BytesOut += res.BytesOut
+	}
+
+	return s
+}
+
+// WriteJSON saves the summary into file.
+func (s *RunSummary) WriteJSON(file string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, data, 0o644)
+}
@@ -0,0 +1,100 @@
+package bilibili
+
+import (
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// ScanGroup is a group of cached videos, keyed by the title as ScanForAllVideoGroups does.
+type ScanGroup struct {
+	Title   string       `json:"title"`
+	GroupID string       `json:"groupId"`
+	Videos  []*ScanEntry `json:"videos"`
+}
+
+// ScanEntry is a cached video with the fields derived from its cache folder and the output dir.
+type ScanEntry struct {
+	*VideoInfo
+
+	CachePath string `json:"cachePath"`
+	// CacheFormat is the layout of the cache folder, desktop or android
+	CacheFormat string `json:"cacheFormat"`
+	// Output is the mp4 path by Options.NameTemplate
+	Output    string `json:"output"`
+	Converted bool   `json:"converted"`
+	// Size is the bytes of the cache folder on disk
+	Size    int64  `json:"size"`
+	Quality string `json:"quality"`
+	// Codec of the video stream, e.g. avc, hevc or av1, empty if unknown
+	Codec string `json:"codec"`
+	// M4SVariant is the layout of the cached m4s files, e.g. zero-prefix
+	M4SVariant M4SVariant `json:"m4sVariant"`
+}
+
+// ScanVideos scans InputDir, groups are sorted by title and videos by p, or the episode number of PGC content.
+func ScanVideos(options *Options) ([]*ScanGroup, error) {
+	videoGroups, err := ScanForAllVideoGroups(options.InputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []*ScanGroup{}
+
+	for _, title := range slices.Sorted(maps.Keys(videoGroups)) {
+		videos := videoGroups[title]
+		slices.SortStableFunc(videos, func(a, b *VideoInfo) int { return a.EpisodeNumber() - b.EpisodeNumber() })
+
+		group := &ScanGroup{Title: title, GroupID: videos[0].GroupKey()}
+
+		for _, video := range videos {
+			group.Videos = append(group.Videos, newScanEntry(options, video))
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+func newScanEntry(options *Options, video *VideoInfo) *ScanEntry {
+	entry := &ScanEntry{
+		VideoInfo:   video,
+		CachePath:   video.Dir,
+		CacheFormat: video.CacheFormat,
+		Size:        dirSize(video.Dir),
+		Quality:     video.QualityLabel(),
+		Codec:       DetectVideoCodec(video),
+
+		M4SVariant: DetectDirVariant(video.Dir),
+	}
+
+	if output, err := options.OutputPath(video); err == nil {
+		entry.Output = output
+		_, err = os.Stat(output)
+		entry.Converted = err == nil
+	}
+
+	return entry
+}
+
+// dirSize returns the total size of regular files in dir, unreadable files are ignored.
+func dirSize(dir string) int64 {
+	size := int64(0)
+
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size
+}
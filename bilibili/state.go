@@ -0,0 +1,291 @@
+package bilibili
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const _stateVersion = 1
+
+// Fingerprint identifies the cached source and the profile converted with, it changes when the video is
+// re-downloaded, e.g. at a different quality, or converted with another profile.
+type Fingerprint struct {
+	// Sizes of the m4s files by name
+	Sizes      map[string]int64 `json:"sizes"`
+	UpdateTime int64            `json:"updateTime"`
+	Qn         int              `json:"qn"`
+	// Profile is empty for the copy profile, as in records made before profiles
+	Profile string `json:"profile,omitempty"`
+}
+
+func (f Fingerprint) Equal(other Fingerprint) bool {
+	return f.UpdateTime == other.UpdateTime && f.Qn == other.Qn && f.Profile == other.Profile &&
+		maps.Equal(f.Sizes, other.Sizes)
+}
+
+// StateRecord is a video converted, keyed by ItemID/Cid in the state file.
+type StateRecord struct {
+	ItemID string      `json:"itemId"`
+	Cid    int         `json:"cid"`
+	Source Fingerprint `json:"source"`
+	// Output is relative to the output dir, so the dir can be moved
+	Output   string    `json:"output"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Checksum string    `json:"checksum"`
+	// ConvertedAt is when the record is added
+	ConvertedAt time.Time `json:"convertedAt"`
+}
+
+type stateFile struct {
+	Version int                     `json:"version"`
+	Videos  map[string]*StateRecord `json:"videos"`
+}
+
+// stateStore is the state file of an output dir, shared by the jobs of a CacheVideoConverter run.
+type stateStore struct {
+	mu   sync.Mutex
+	dir  string
+	file string
+	data stateFile
+	// written are the keys recorded by this store, others are reloaded from the file on save
+	written map[string]bool
+}
+
+// openState loads the state file of outputDir, a broken state file is ignored.
+func openState(outputDir string) (*stateStore, error) {
+	s := &stateStore{
+		dir:     outputDir,
+		file:    filepath.Join(outputDir, _stateFile),
+		written: map[string]bool{},
+	}
+
+	data, err := readStateFile(s.file)
+	if err != nil {
+		return nil, err
+	}
+
+	s.data = *data
+
+	return s, nil
+}
+
+// readStateFile returns an empty state if file is missing or broken.
+func readStateFile(file string) (*stateFile, error) {
+	empty := &stateFile{Version: _stateVersion, Videos: map[string]*StateRecord{}}
+
+	raw, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return empty, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	data := &stateFile{}
+	if err := json.Unmarshal(raw, data); err != nil || data.Videos == nil {
+		log.Printf("cannot load %s, start from scratch: %v", file, err)
+		return empty, nil
+	}
+
+	return data, nil
+}
+
+func stateKey(video *VideoInfo) string {
+	return fmt.Sprintf("%s/%d", video.ItemID, video.Cid)
+}
+
+func newFingerprint(files []string, video *VideoInfo, profile *Profile) Fingerprint {
+	fp := Fingerprint{Sizes: map[string]int64{}, UpdateTime: video.UpdateTime, Qn: video.Qn}
+
+	if profile.Name != ProfileCopy {
+		fp.Profile = profile.Name
+	}
+
+	for _, file := range files {
+		if st, err := os.Stat(file); err == nil {
+			fp.Sizes[filepath.Base(file)] = st.Size()
+		}
+	}
+
+	return fp
+}
+
+// converted returns the output of video if it is recorded with the same source and the output is intact.
+// An output converted before the state file(expected) is adopted if adoptable passes, i.e. its tracks and duration
+// match the cache, as the file at the path may come from another video.
+func (s *stateStore) converted(
+	video *VideoInfo, source Fingerprint, expected string, adoptable func(file string) error,
+) (string, bool) {
+	s.mu.Lock()
+	rec, ok := s.data.Videos[stateKey(video)]
+	s.mu.Unlock()
+
+	// outputs converted before the state file are copies
+	if !ok {
+		if source.Profile != "" || !isFile(expected) {
+			return "", false
+		}
+
+		if err := adoptable(expected); err != nil {
+			log.Printf("%s is not adopted as converted, convert again: %v", expected, err)
+			return "", false
+		}
+
+		if err := s.record(video, source, expected); err != nil {
+			log.Printf("cannot record %s: %v", expected, err)
+		}
+
+		return expected, true
+	}
+
+	if !rec.Source.Equal(source) {
+		log.Printf("cache of %s changed since converted, convert again", video.ItemID)
+		return "", false
+	}
+
+	output := filepath.Join(s.dir, rec.Output)
+	if err := rec.verify(output); err != nil {
+		log.Printf("converted output is changed, convert again: %v", err)
+		return "", false
+	}
+
+	return output, true
+}
+
+// recorded returns the output recorded for video converted from source, after checking it's intact.
+func (s *stateStore) recorded(video *VideoInfo, source Fingerprint) (string, error) {
+	s.mu.Lock()
+	rec, ok := s.data.Videos[stateKey(video)]
+	s.mu.Unlock()
+
+	if !ok {
+		return "", fmt.Errorf("%s is not recorded in %s", video.ItemID, s.file)
+	}
+
+	if !rec.Source.Equal(source) {
+		return "", fmt.Errorf("cache of %s changed since converted", video.ItemID)
+	}
+
+	output := filepath.Join(s.dir, rec.Output)
+
+	return output, rec.verify(output)
+}
+
+// exists tells whether the state file is saved, i.e. any video is recorded in the output dir.
+func (s *stateStore) exists() bool {
+	return isFile(s.file)
+}
+
+// record saves output of video into the state file.
+func (s *stateStore) record(video *VideoInfo, source Fingerprint, output string) error {
+	st, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := fileChecksum(output)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(s.dir, output)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Videos[stateKey(video)] = &StateRecord{
+		ItemID:      video.ItemID,
+		Cid:         video.Cid,
+		Source:      source,
+		Output:      filepath.ToSlash(rel),
+		Size:        st.Size(),
+		ModTime:     st.ModTime(),
+		Checksum:    checksum,
+		ConvertedAt: time.Now(),
+	}
+	s.written[stateKey(video)] = true
+
+	return s.save()
+}
+
+// save writes to a temp file then renames, so the state file is never half-written.
+// Records written by others since loaded, e.g. another process converting into the same dir, are kept.
+func (s *stateStore) save() error {
+	if disk, err := readStateFile(s.file); err == nil {
+		for key, rec := range disk.Videos {
+			if !s.written[key] {
+				s.data.Videos[key] = rec
+			}
+		}
+	}
+
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.file + _tempSuffix
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.file)
+}
+
+// verify checks size and modification time, the checksum is only computed when the latter is changed.
+func (r *StateRecord) verify(output string) error {
+	st, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+
+	if st.Size() != r.Size {
+		return fmt.Errorf("%s: size %d, want %d", output, st.Size(), r.Size)
+	}
+
+	if st.ModTime().Equal(r.ModTime) {
+		return nil
+	}
+
+	checksum, err := fileChecksum(output)
+	if err != nil {
+		return err
+	}
+
+	if checksum != r.Checksum {
+		return fmt.Errorf("%s: checksum mismatched", output)
+	}
+
+	return nil
+}
+
+func fileChecksum(file string) (string, error) {
+	fin, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fin.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fin); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
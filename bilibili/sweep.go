@@ -0,0 +1,69 @@
+package bilibili
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// _strayM4SPattern is the name of m4s files older versions stripped into the output root, i.e. the cache names
+// `<cid>-<n>-<streamid>.m4s`, others are not made by this tool
+var _strayM4SPattern = regexp.MustCompile(`^\d+-\d+-\d+\.` + _inputSuffix + `$`)
+
+// mkJobTempDir creates the temp dir of a job under outputDir, so outputs can be renamed into place atomically.
+// The pid in its name tells SweepTemp whether the owner is still running.
+func mkJobTempDir(outputDir string) (string, error) {
+	return os.MkdirTemp(outputDir, fmt.Sprintf("%s%d-", _tempDirPrefix, os.Getpid()))
+}
+
+// SweepTemp removes the artifacts left in outputDir by interrupted runs: job temp dirs of processes not running,
+// m4s files stripped into the output root by older versions (named as in the cache), and the temp state file.
+// The removed paths are returned.
+func SweepTemp(outputDir string) ([]string, error) {
+	entries, err := os.ReadDir(outputDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		switch {
+		case entry.IsDir() && strings.HasPrefix(name, _tempDirPrefix):
+			if processAlive(tempDirOwner(name)) {
+				continue
+			}
+		case !entry.IsDir() && (_strayM4SPattern.MatchString(name) || name == _stateFile+_tempSuffix):
+		default:
+			continue
+		}
+
+		file := filepath.Join(outputDir, name)
+		if err := os.RemoveAll(file); err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, file)
+	}
+
+	return removed, nil
+}
+
+// tempDirOwner returns the pid in the name of a job temp dir, 0 if not found.
+func tempDirOwner(name string) int {
+	pidStr, _, _ := strings.Cut(strings.TrimPrefix(name, _tempDirPrefix), "-")
+	pid, _ := strconv.Atoi(pidStr)
+
+	return pid
+}
@@ -0,0 +1,245 @@
+package bilibili
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coghost/bilibili_cache_converter/mp4"
+	"github.com/coghost/bilibili_cache_converter/utils"
+	"github.com/spf13/cast"
+)
+
+const (
+	// ValidateNative reads the output with the built-in mp4 package.
+	ValidateNative = "native"
+	// ValidateFfprobe shells out to ffprobe (see BL_FFPROBE).
+	ValidateFfprobe = "ffprobe"
+	// ValidateNone skips the validation.
+	ValidateNone = "none"
+)
+
+// _durationTolerance is the default gap allowed between the output and the cached duration,
+// which is in whole seconds
+const _durationTolerance = 2 * time.Second
+
+// types of OutputTrack
+const (
+	TrackVideo = "video"
+	TrackAudio = "audio"
+)
+
+// OutputTrack is a track found in the converted mp4.
+type OutputTrack struct {
+	Type string `json:"type"`
+	// Codec is the codec tag, e.g. avc1, or the codec name of ffprobe if the tag is unknown, e.g. h264
+	Codec string `json:"codec"`
+}
+
+// ValidationReport is the result of checking the converted mp4.
+type ValidationReport struct {
+	Validator string        `json:"validator"`
+	Seconds   float64       `json:"seconds"`
+	Tracks    []OutputTrack `json:"tracks"`
+	// Problems are the mismatches found, empty if valid
+	Problems []string `json:"problems,omitempty"`
+}
+
+// Valid tells whether no problem is found.
+func (r *ValidationReport) Valid() bool {
+	return len(r.Problems) == 0
+}
+
+// Err returns nil if valid, or ErrInvalidOutput with the problems.
+func (r *ValidationReport) Err() error {
+	if r.Valid() {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrInvalidOutput, strings.Join(r.Problems, "; "))
+}
+
+func (r *ValidationReport) addProblem(format string, a ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, a...))
+}
+
+func (r *ValidationReport) codecs(typ string) []string {
+	codecs := []string{}
+
+	for _, t := range r.Tracks {
+		if t.Type == typ {
+			codecs = append(codecs, t.Codec)
+		}
+	}
+
+	return codecs
+}
+
+// expectedOutput is the number and codecs of tracks in the output, empty codecs are not checked.
+type expectedOutput struct {
+	videoTracks, audioTracks int
+	videoCodec, audioCodec   string
+}
+
+// validator reads the tracks and duration of the mp4 file.
+type validator func(ctx context.Context, file string) (*ValidationReport, error)
+
+func getValidator(name string) (validator, error) {
+	switch name {
+	case "", ValidateNative:
+		return validateWithNative, nil
+	case ValidateFfprobe:
+		return validateWithFfprobe, nil
+	case ValidateNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownValidator, name)
+	}
+}
+
+func validateWithNative(_ context.Context, file string) (*ValidationReport, error) {
+	info, err := mp4.Probe(file)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ValidationReport{Validator: ValidateNative, Seconds: info.Duration.Seconds()}
+
+	for _, t := range info.Tracks {
+		typ := t.Handler
+
+		switch t.Handler {
+		case "vide":
+			typ = TrackVideo
+		case "soun":
+			typ = TrackAudio
+		}
+
+		report.Tracks = append(report.Tracks, OutputTrack{Type: typ, Codec: t.Codec})
+	}
+
+	return report, nil
+}
+
+func validateWithFfprobe(ctx context.Context, file string) (*ValidationReport, error) {
+	out, err := utils.FfprobeContext(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	var probed struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+			CodecType string `json:"codec_type"`
+			CodecTag  string `json:"codec_tag_string"`
+			// AttachedPic is set for cover art, e.g. of mp3s
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+
+	if err := json.Unmarshal([]byte(out), &probed); err != nil {
+		return nil, err
+	}
+
+	report := &ValidationReport{Validator: ValidateFfprobe, Seconds: cast.ToFloat64(probed.Format.Duration)}
+
+	for _, s := range probed.Streams {
+		if s.Disposition.AttachedPic != 0 {
+			continue
+		}
+
+		codec := s.CodecTag
+		// e.g. [0][0][0][0] if the tag is not set
+		if codec == "" || strings.HasPrefix(codec, "[") {
+			codec = s.CodecName
+		}
+
+		report.Tracks = append(report.Tracks, OutputTrack{Type: s.CodecType, Codec: codec})
+	}
+
+	return report, nil
+}
+
+// validateOutput checks the converted file has the tracks and codecs of want, and a duration close to the cached one.
+// Only the file itself is checked when strict is false, i.e. the cache is not ready but converted anyway,
+// which may be short or lack a stream. Files other than mp4 are read by ffprobe, as the native validator can't.
+// It returns nil without error if validation is disabled.
+func validateOutput(
+	ctx context.Context, options *Options, video *VideoInfo, file string, want expectedOutput, strict bool,
+) (*ValidationReport, error) {
+	name := options.Validate
+	if (name == "" || name == ValidateNative) && !options.profile().isMP4() {
+		name = ValidateFfprobe
+	}
+
+	validate, err := getValidator(name)
+	if err != nil || validate == nil {
+		return nil, err
+	}
+
+	report, err := validate(ctx, file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOutput, err)
+	}
+
+	if !strict {
+		return report, nil
+	}
+
+	counts := map[string]int{TrackVideo: want.videoTracks, TrackAudio: want.audioTracks}
+
+	for _, typ := range []string{TrackVideo, TrackAudio} {
+		if n := len(report.codecs(typ)); n != counts[typ] {
+			report.addProblem("%d %s tracks, expected %d", n, typ, counts[typ])
+		}
+	}
+
+	tolerance := options.DurationTolerance
+	if tolerance <= 0 {
+		tolerance = _durationTolerance
+	}
+
+	if video.Duration > 0 {
+		got := time.Duration(report.Seconds * float64(time.Second))
+		if want := time.Duration(video.Duration) * time.Second; got < want-tolerance || got > want+tolerance {
+			report.addProblem("duration %s, expected %s", got.Round(time.Millisecond), want)
+		}
+	}
+
+	for _, expected := range [][2]string{{TrackVideo, want.videoCodec}, {TrackAudio, want.audioCodec}} {
+		typ, want := expected[0], expected[1]
+
+		got := report.codecs(typ)
+		if want == "" || len(got) == 0 {
+			continue
+		}
+
+		if codecFamily(got[0]) != codecFamily(want) {
+			report.addProblem("%s codec %s, expected %s", typ, got[0], want)
+		}
+	}
+
+	return report, report.Err()
+}
+
+// checkOutput validates file strictly against the cache, as an output not converted in this run, e.g. before
+// removing the cache, it fails if validation is disabled.
+func checkOutput(ctx context.Context, options *Options, video *VideoInfo, file string, want expectedOutput) error {
+	report, err := validateOutput(ctx, options, video, file, want, true)
+	if err != nil {
+		return err
+	}
+
+	if report == nil {
+		return fmt.Errorf("%w: %s is not checked, validation is disabled", ErrInvalidOutput, file)
+	}
+
+	return nil
+}
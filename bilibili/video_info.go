@@ -3,8 +3,9 @@ package bilibili
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"path/filepath"
 
-	"github.com/coghost/bilibili_cache_converter/utils"
 	"github.com/coghost/pathlib"
 	"github.com/spf13/cast"
 )
@@ -54,26 +55,40 @@ type VideoInfo struct {
 	Speed          int     `json:"speed"`
 	CompletionTime int64   `json:"completionTime"`
 	ReportedSize   int     `json:"reportedSize"`
+
+	// SeasonID/EpisodeID/EpisodeIndex of PGC content may be number or string as GroupID/ItemID,
+	// EpisodeIndex is the episode number shown on the page, e.g. 3, or SP for specials
+	SeasonID        string `json:"-"`
+	EpisodeID       string `json:"-"`
+	EpisodeIndex    string `json:"-"`
+	SeasonIDRaw     any    `json:"seasonId"`
+	EpisodeIDRaw    any    `json:"episodeId"`
+	EpisodeIndexRaw any    `json:"episodeIndex"`
+	SeasonTitle     string `json:"seasonTitle"`
+	EpisodeTitle    string `json:"episodeTitle"`
+
+	// Dir is the absolute path of the cache folder
+	Dir string `json:"-"`
+	// CacheFormat is the name of the cache layout, desktop or android
+	CacheFormat string `json:"-"`
+
+	// ViewInfo is the danmaku info decoded from the `view` file next to videoInfo.json, shown by the scan tree,
+	// nil if not available
+	ViewInfo *ViewInfo `json:"-"`
 }
 
-// FilenameFromGroupAndVideo generates filename as `GroupTitle/Title.mp4`,
+// FilenameFromGroupAndVideo generates filename as `GroupTitle/Title` (preset "group"),
 // and will replace common unsafe characters with underscores
 func (v *VideoInfo) FilenameFromGroupAndVideo() string {
-	grpTitle := utils.SanitizeFilename(v.GroupTitle)
-	vidTitle := utils.SanitizeFilename(v.Title)
-	outMP4 := fmt.Sprintf("%s/%s", grpTitle, vidTitle)
+	outMP4, _ := v.FilenameFromTemplate(PresetGroup)
 
 	return outMP4
 }
 
-// FilenameFromGroupAndVideo generates filename as `Uname/GroupTitle/Title.mp4`,
+// FilenameFromUnameGroupAndVideo generates filename as `Uname/GroupTitle/Title` (preset "uploader"),
 // and will replace common unsafe characters with underscores
 func (v *VideoInfo) FilenameFromUnameGroupAndVideo() string {
-	grpTitle := utils.SanitizeFilename(v.GroupTitle)
-	vidTitle := utils.SanitizeFilename(v.Title)
-	uname := utils.SanitizeFilename(v.Uname)
-
-	outMP4 := fmt.Sprintf("%s/%s/%s", uname, grpTitle, vidTitle)
+	outMP4, _ := v.FilenameFromTemplate(PresetUploader)
 
 	return outMP4
 }
@@ -98,6 +113,20 @@ func ParseVideoInfo(file string) (*VideoInfo, error) {
 
 	video.GroupID = cast.ToString(video.GroupIDRaw)
 	video.ItemID = cast.ToString(video.ItemIDRaw)
+	video.SeasonID = cast.ToString(video.SeasonIDRaw)
+	video.EpisodeID = cast.ToString(video.EpisodeIDRaw)
+	video.EpisodeIndex = cast.ToString(video.EpisodeIndexRaw)
+	video.Dir = filepath.Dir(pathlib.Path(file).AbsPath())
+
+	viewFs := pathlib.Path(filepath.Join(filepath.Dir(file), _viewFile))
+	if viewFs.Exists() {
+		view, err := ParseViewInfo(viewFs.AbsPath())
+		if err != nil {
+			log.Printf("cannot parse %s, ignored: %v", viewFs, err)
+		}
+
+		video.ViewInfo = view
+	}
 
 	return video, err
 }
@@ -0,0 +1,163 @@
+package bilibili
+
+import (
+	"fmt"
+
+	"github.com/coghost/bilibili_cache_converter/utils"
+	"github.com/coghost/pathlib"
+)
+
+// ViewInfo is decoded from the cached `view` file, which is the danmaku view(DmWebViewReply) of the video:
+// the danmaku count, interactive(command) danmaku and expression keywords. It carries no description or page info,
+// the client doesn't cache them, so names, tags and nfo are made from videoInfo.json only.
+type ViewInfo struct {
+	State    int    `json:"state"`
+	Text     string `json:"text,omitempty"`
+	TextSide string `json:"textSide,omitempty"`
+
+	// SegmentPageSize is the duration(ms) of each danmaku segment
+	SegmentPageSize int64 `json:"segmentPageSize"`
+	SegmentTotal    int64 `json:"segmentTotal"`
+	// RecommendText is the notice about danmaku filtering
+	RecommendText string   `json:"recommendText,omitempty"`
+	SpecialDms    []string `json:"specialDms,omitempty"`
+	DanmakuCount  int64    `json:"danmakuCount"`
+	// CommandDms are the interactive danmaku, e.g. votes, links or up's notes
+	CommandDms []CommandDm `json:"commandDms,omitempty"`
+	// Keywords trigger the danmaku expressions
+	Keywords []string `json:"keywords,omitempty"`
+}
+
+type CommandDm struct {
+	ID       int64  `json:"id"`
+	Oid      int64  `json:"oid"`
+	Mid      string `json:"mid"`
+	Command  string `json:"command"`
+	Content  string `json:"content"`
+	Progress int32  `json:"progress"`
+	Ctime    string `json:"ctime"`
+	Mtime    string `json:"mtime"`
+	Extra    string `json:"extra"`
+	IDStr    string `json:"idStr"`
+}
+
+// ParseViewInfo decodes the cached `view` file, fields not in the known layout are ignored.
+func ParseViewInfo(file string) (*ViewInfo, error) {
+	data, err := pathlib.Path(file).GetBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := utils.ParseProto(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnknownViewLayout, err)
+	}
+
+	view := &ViewInfo{}
+	known := 0
+
+	for _, f := range fields {
+		switch {
+		case f.Num == 1 && f.Type == utils.ProtoVarint:
+			view.State = int(f.Int())
+		case f.Num == 2 && f.Type == utils.ProtoBytes:
+			view.Text = string(f.Bytes)
+		case f.Num == 3 && f.Type == utils.ProtoBytes:
+			view.TextSide = string(f.Bytes)
+		case f.Num == 4 && f.Type == utils.ProtoBytes:
+			for _, sf := range tryParseProto(f.Bytes) {
+				switch sf.Num {
+				case 1:
+					view.SegmentPageSize = sf.Int()
+				case 2:
+					view.SegmentTotal = sf.Int()
+				}
+			}
+		case f.Num == 5 && f.Type == utils.ProtoBytes:
+			for _, sf := range tryParseProto(f.Bytes) {
+				if sf.Num == 2 && sf.Type == utils.ProtoBytes {
+					view.RecommendText = string(sf.Bytes)
+				}
+			}
+		case f.Num == 6 && f.Type == utils.ProtoBytes:
+			view.SpecialDms = append(view.SpecialDms, string(f.Bytes))
+		case f.Num == 8 && f.Type == utils.ProtoVarint:
+			view.DanmakuCount = f.Int()
+		case f.Num == 9 && f.Type == utils.ProtoBytes:
+			view.CommandDms = append(view.CommandDms, decodeCommandDm(f.Bytes))
+		case f.Num == 12 && f.Type == utils.ProtoBytes:
+			view.Keywords = append(view.Keywords, decodeExpressionKeywords(f.Bytes)...)
+		default:
+			continue
+		}
+
+		known++
+	}
+
+	if known == 0 {
+		return nil, fmt.Errorf("%w: no known field found in %s", ErrUnknownViewLayout, file)
+	}
+
+	return view, nil
+}
+
+func decodeCommandDm(data []byte) CommandDm {
+	cmd := CommandDm{}
+
+	for _, f := range tryParseProto(data) {
+		switch f.Num {
+		case 1:
+			cmd.ID = f.Int()
+		case 2:
+			cmd.Oid = f.Int()
+		case 3:
+			cmd.Mid = string(f.Bytes)
+		case 4:
+			cmd.Command = string(f.Bytes)
+		case 5:
+			cmd.Content = string(f.Bytes)
+		case 6:
+			cmd.Progress = int32(f.Int())
+		case 7:
+			cmd.Ctime = string(f.Bytes)
+		case 8:
+			cmd.Mtime = string(f.Bytes)
+		case 9:
+			cmd.Extra = string(f.Bytes)
+		case 10:
+			cmd.IDStr = string(f.Bytes)
+		}
+	}
+
+	return cmd
+}
+
+// decodeExpressionKeywords gets keywords from Expressions{repeated Expression data = 1},
+// Expression{repeated string keyword = 1, string url = 2}
+func decodeExpressionKeywords(data []byte) []string {
+	keywords := []string{}
+
+	for _, f := range tryParseProto(data) {
+		if f.Num != 1 || f.Type != utils.ProtoBytes {
+			continue
+		}
+
+		for _, ef := range tryParseProto(f.Bytes) {
+			if ef.Num == 1 && ef.Type == utils.ProtoBytes {
+				keywords = append(keywords, string(ef.Bytes))
+			}
+		}
+	}
+
+	return keywords
+}
+
+// tryParseProto returns no fields when data is not a valid message, so unknown layouts are skipped.
+func tryParseProto(data []byte) []utils.ProtoField {
+	fields, err := utils.ParseProto(data)
+	if err != nil {
+		return nil
+	}
+
+	return fields
+}
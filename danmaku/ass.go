@@ -0,0 +1,265 @@
+package danmaku
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// the "normal" fontsize of bilibili danmaku
+	_defaultFontsize = 25
+	// bilibili fontsize is designed for a player about 720p high
+	_designHeight = 720
+)
+
+type ASSOptions struct {
+	// Width/Height is the PlayResX/PlayResY, usually the video resolution
+	Width  int
+	Height int
+
+	FontName string
+	// ScrollDuration is how many seconds a scrolling danmaku stays on screen
+	ScrollDuration float64
+	// FixedDuration is how many seconds a top/bottom danmaku stays on screen
+	FixedDuration float64
+	// Opacity from 0 to 1
+	Opacity float64
+}
+
+func DefaultASSOptions() *ASSOptions {
+	return &ASSOptions{
+		Width:          1920,
+		Height:         1080,
+		FontName:       "Microsoft YaHei",
+		ScrollDuration: 8,
+		FixedDuration:  4,
+		Opacity:        0.8,
+	}
+}
+
+// lane keeps the last danmaku placed in one row.
+type lane struct {
+	start float64
+	end   float64
+	width float64
+	speed float64
+}
+
+type assLayout struct {
+	opts       *ASSOptions
+	scale      float64
+	lineHeight float64
+	scroll     []lane
+	top        []lane
+	bottom     []lane
+}
+
+// WriteASS writes elems as ass subtitles, scrolling/top/bottom danmaku are placed in rows without overlapping if possible.
+func WriteASS(w io.Writer, elems []*Elem, opts *ASSOptions) error {
+	if opts == nil {
+		opts = DefaultASSOptions()
+	}
+
+	scale := float64(opts.Height) / _designHeight
+	lineHeight := math.Ceil(_defaultFontsize * scale * 1.15)
+	rows := max(int(float64(opts.Height)/lineHeight), 1)
+
+	layout := &assLayout{
+		opts:       opts,
+		scale:      scale,
+		lineHeight: lineHeight,
+		scroll:     make([]lane, rows),
+		top:        make([]lane, rows),
+		bottom:     make([]lane, rows),
+	}
+
+	if _, err := io.WriteString(w, assHeader(opts, scale)); err != nil {
+		return err
+	}
+
+	for _, e := range elems {
+		line := layout.dialogue(e)
+		if line == "" {
+			continue
+		}
+
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func assHeader(opts *ASSOptions, scale float64) string {
+	alpha := fmt.Sprintf("%02X", int(math.Round(255*(1-opts.Opacity))))
+	fontsize := int(math.Round(_defaultFontsize * scale))
+
+	return "[Script Info]\n" +
+		"ScriptType: v4.00+\n" +
+		"Collisions: Normal\n" +
+		fmt.Sprintf("PlayResX: %d\nPlayResY: %d\n", opts.Width, opts.Height) +
+		"WrapStyle: 2\n" +
+		"ScaledBorderAndShadow: yes\n\n" +
+		"[V4+ Styles]\n" +
+		"Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, " +
+		"Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, " +
+		"Alignment, MarginL, MarginR, MarginV, Encoding\n" +
+		fmt.Sprintf("Style: Danmaku,%s,%d,&H%sFFFFFF,&H%sFFFFFF,&H%s000000,&H%s000000,0,0,0,0,100,100,0,0,1,1,0,7,0,0,0,1\n\n",
+			opts.FontName, fontsize, alpha, alpha, alpha, alpha) +
+		"[Events]\n" +
+		"Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n"
+}
+
+// dialogue returns the ass event of e, or empty if the mode is not supported.
+func (l *assLayout) dialogue(e *Elem) string {
+	fontsize := float64(e.Fontsize)
+	if fontsize <= 0 {
+		fontsize = _defaultFontsize
+	}
+
+	fontsize *= l.scale
+	width := textWidth(e.Content, fontsize)
+	start := float64(e.Progress) / 1000
+	screenW := float64(l.opts.Width)
+
+	var (
+		end      float64
+		position string
+	)
+
+	switch e.Mode {
+	case ModeScroll, ModeScroll2, ModeScroll3, ModeReverse:
+		end = start + l.opts.ScrollDuration
+		speed := (screenW + width) / l.opts.ScrollDuration
+		row := pickScrollLane(l.scroll, start, width, speed, screenW)
+		l.scroll[row] = lane{start: start, end: end, width: width, speed: speed}
+		y := float64(row) * l.lineHeight
+
+		if e.Mode == ModeReverse {
+			position = fmt.Sprintf(`\move(%d,%d,%d,%d)`, -int(width), int(y), int(screenW), int(y))
+		} else {
+			position = fmt.Sprintf(`\move(%d,%d,%d,%d)`, int(screenW), int(y), -int(width), int(y))
+		}
+	case ModeTop:
+		end = start + l.opts.FixedDuration
+		row := pickFixedLane(l.top, start)
+		l.top[row] = lane{start: start, end: end}
+		position = fmt.Sprintf(`\an8\pos(%d,%d)`, int(screenW/2), int(float64(row)*l.lineHeight))
+	case ModeBottom:
+		end = start + l.opts.FixedDuration
+		row := pickFixedLane(l.bottom, start)
+		l.bottom[row] = lane{start: start, end: end}
+		position = fmt.Sprintf(`\an2\pos(%d,%d)`, int(screenW/2), l.opts.Height-int(float64(row)*l.lineHeight))
+	default:
+		// advanced/code/bas danmaku cannot be rendered as plain subtitles
+		return ""
+	}
+
+	tags := position
+	if e.Fontsize != 0 && e.Fontsize != _defaultFontsize {
+		tags += fmt.Sprintf(`\fs%d`, int(math.Round(fontsize)))
+	}
+
+	color := e.Color & 0xFFFFFF
+	if color != 0xFFFFFF {
+		tags += `\c&H` + bgr(color) + "&"
+	}
+
+	if isDark(color) {
+		tags += `\3c&HFFFFFF&`
+	}
+
+	return fmt.Sprintf("Dialogue: 2,%s,%s,Danmaku,,0000,0000,0000,,{%s}%s\n",
+		assTime(start), assTime(end), tags, escapeASS(e.Content))
+}
+
+// pickScrollLane returns the first row where e neither overlaps nor catches up with the previous one,
+// or the row freed the soonest.
+func pickScrollLane(lanes []lane, start, width, speed, screenW float64) int {
+	best, bestWait := 0, math.MaxFloat64
+
+	for i, prev := range lanes {
+		if prev.speed == 0 {
+			return i
+		}
+
+		// time until the tail of prev enters the screen
+		wait := prev.start + prev.width/prev.speed - start
+		// time until prev leaves, e must not reach the left edge before that
+		catchUp := prev.end - (start + screenW/speed)
+		wait = max(wait, catchUp)
+
+		if wait <= 0 {
+			return i
+		}
+
+		if wait < bestWait {
+			best, bestWait = i, wait
+		}
+	}
+
+	return best
+}
+
+func pickFixedLane(lanes []lane, start float64) int {
+	best := 0
+
+	for i, prev := range lanes {
+		if prev.end <= start {
+			return i
+		}
+
+		if prev.end < lanes[best].end {
+			best = i
+		}
+	}
+
+	return best
+}
+
+// textWidth estimates the rendered width, CJK characters take a full em and others half.
+func textWidth(text string, fontsize float64) float64 {
+	width := 0.0
+
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			width += fontsize / 2
+		} else {
+			width += fontsize
+		}
+	}
+
+	return width
+}
+
+func assTime(seconds float64) string {
+	cs := int(math.Round(seconds * 100))
+
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
+
+func bgr(rgb uint32) string {
+	return fmt.Sprintf("%02X%02X%02X", rgb&0xFF, rgb>>8&0xFF, rgb>>16&0xFF)
+}
+
+func isDark(rgb uint32) bool {
+	r, g, b := float64(rgb>>16&0xFF), float64(rgb>>8&0xFF), float64(rgb&0xFF)
+
+	return 0.299*r+0.587*g+0.114*b < 64
+}
+
+func escapeASS(text string) string {
+	replacer := strings.NewReplacer(
+		"\\", "＼",
+		"{", "｛",
+		"}", "｝",
+		"\r\n", `\N`,
+		"\n", `\N`,
+	)
+
+	return replacer.Replace(text)
+}
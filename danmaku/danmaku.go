@@ -0,0 +1,134 @@
+/*
+Package danmaku decodes the cached danmaku(bullet comments) file `dm1` and exports it as bilibili xml or ass subtitles.
+*/
+package danmaku
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/coghost/bilibili_cache_converter/utils"
+)
+
+// Danmaku modes
+const (
+	ModeScroll   = 1
+	ModeScroll2  = 2
+	ModeScroll3  = 3
+	ModeBottom   = 4
+	ModeTop      = 5
+	ModeReverse  = 6
+	ModeAdvanced = 7
+	ModeCode     = 8
+	ModeBAS      = 9
+)
+
+var ErrNoElems = errors.New("no danmaku found")
+
+// Elem is the DanmakuElem of bilibili DmSegMobileReply.
+type Elem struct {
+	ID int64 `json:"id"`
+	// Progress is the time in video, in milliseconds
+	Progress int32  `json:"progress"`
+	Mode     int32  `json:"mode"`
+	Fontsize int32  `json:"fontsize"`
+	Color    uint32 `json:"color"`
+	MidHash  string `json:"midHash"`
+	Content  string `json:"content"`
+	// Ctime is the unix time when sent
+	Ctime  int64  `json:"ctime"`
+	Weight int32  `json:"weight"`
+	Action string `json:"action"`
+	Pool   int32  `json:"pool"`
+	IDStr  string `json:"idStr"`
+	Attr   int32  `json:"attr"`
+}
+
+// Decode decodes DmSegMobileReply, elems are sorted by progress.
+func Decode(data []byte) ([]*Elem, error) {
+	fields, err := utils.ParseProto(data)
+	if err != nil {
+		return nil, err
+	}
+
+	elems := []*Elem{}
+
+	for _, field := range fields {
+		// repeated DanmakuElem elems = 1
+		if field.Num != 1 || field.Type != utils.ProtoBytes {
+			continue
+		}
+
+		elem, err := decodeElem(field.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		elems = append(elems, elem)
+	}
+
+	sort.SliceStable(elems, func(i, j int) bool {
+		return elems[i].Progress < elems[j].Progress
+	})
+
+	return elems, nil
+}
+
+// ParseFile decodes the cached `dm1` file.
+func ParseFile(file string) ([]*Elem, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	elems, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", file, err)
+	}
+
+	return elems, nil
+}
+
+func decodeElem(data []byte) (*Elem, error) {
+	fields, err := utils.ParseProto(data)
+	if err != nil {
+		return nil, err
+	}
+
+	elem := &Elem{}
+
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			elem.ID = f.Int()
+		case 2:
+			elem.Progress = int32(f.Int())
+		case 3:
+			elem.Mode = int32(f.Int())
+		case 4:
+			elem.Fontsize = int32(f.Int())
+		case 5:
+			elem.Color = uint32(f.Varint)
+		case 6:
+			elem.MidHash = string(f.Bytes)
+		case 7:
+			elem.Content = string(f.Bytes)
+		case 8:
+			elem.Ctime = f.Int()
+		case 9:
+			elem.Weight = int32(f.Int())
+		case 10:
+			elem.Action = string(f.Bytes)
+		case 11:
+			elem.Pool = int32(f.Int())
+		case 12:
+			elem.IDStr = string(f.Bytes)
+		case 13:
+			elem.Attr = int32(f.Int())
+		}
+	}
+
+	return elem, nil
+}
@@ -0,0 +1,84 @@
+package danmaku
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coghost/bilibili_cache_converter/fixtures/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var _dm1File = filepath.Join(testutil.GetProjectRoot(), "fixtures", "26349405204", "dm1")
+
+func TestParseFile(t *testing.T) {
+	assert := assert.New(t)
+
+	elems, err := ParseFile(_dm1File)
+	require.NoError(t, err, "decode dm1")
+
+	// same as the danmaku count in videoInfo.json
+	require.Len(t, elems, 13)
+
+	for i := 1; i < len(elems); i++ {
+		assert.LessOrEqual(elems[i-1].Progress, elems[i].Progress, "sorted by progress")
+	}
+
+	var first *Elem
+
+	for _, e := range elems {
+		if e.Content == "好好看" {
+			first = e
+		}
+	}
+
+	require.NotNil(t, first, "content decoded")
+	assert.Equal(int32(42445), first.Progress)
+	assert.Equal(int32(ModeScroll), first.Mode)
+	assert.Equal(int32(25), first.Fontsize)
+	assert.Equal(uint32(0xFFFFFF), first.Color)
+	assert.Equal("525ace4e", first.MidHash)
+	assert.Equal("1697047659619654400", first.IDStr)
+}
+
+func TestExport(t *testing.T) {
+	assert := assert.New(t)
+
+	elems, err := ParseFile(_dm1File)
+	require.NoError(t, err, "decode dm1")
+
+	var xmlOut bytes.Buffer
+
+	require.NoError(t, WriteXML(&xmlOut, elems, 26349405204))
+	assert.Contains(xmlOut.String(), "<chatid>26349405204</chatid>")
+	assert.Contains(xmlOut.String(), `<d p="42.44500,1,25,16777215,`)
+	assert.Contains(xmlOut.String(), ">好好看</d>")
+	assert.Equal(len(elems), strings.Count(xmlOut.String(), "<d p="))
+
+	parsed, err := ParseXML(bytes.NewReader(xmlOut.Bytes()))
+	require.NoError(t, err, "parse xml back")
+	require.Len(t, parsed, len(elems))
+
+	for i, e := range parsed {
+		assert.Equal(elems[i].Progress, e.Progress)
+		assert.Equal(elems[i].Content, e.Content)
+		assert.Equal(elems[i].Color, e.Color)
+		assert.Equal(elems[i].IDStr, e.IDStr)
+	}
+
+	var assOut bytes.Buffer
+
+	opts := DefaultASSOptions()
+	opts.Width, opts.Height = 576, 360
+
+	require.NoError(t, WriteASS(&assOut, elems, opts))
+	assert.Contains(assOut.String(), "PlayResX: 576\nPlayResY: 360\n")
+	assert.Contains(assOut.String(), "Dialogue: 2,0:00:42.45,0:00:50.45,Danmaku,,0000,0000,0000,,{\\move(576,")
+	assert.Equal(len(elems), strings.Count(assOut.String(), "Dialogue:"))
+}
+
+func TestEscapeASS(t *testing.T) {
+	assert.Equal(t, `a｛b｝＼c\Nd`, escapeASS("a{b}\\c\nd"))
+}
@@ -0,0 +1,121 @@
+package danmaku
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// WriteXML writes elems in the classic bilibili `<i><d p="...">` xml format.
+func WriteXML(w io.Writer, elems []*Elem, cid int) error {
+	header := xml.Header + "<i>" +
+		"<chatserver>chat.bilibili.com</chatserver>" +
+		fmt.Sprintf("<chatid>%d</chatid>", cid) +
+		"<mission>0</mission>" +
+		fmt.Sprintf("<maxlimit>%d</maxlimit>", len(elems)) +
+		"<state>0</state><real_name>0</real_name><source>k-v</source>\n"
+
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+
+	for _, e := range elems {
+		id := e.IDStr
+		if id == "" {
+			id = fmt.Sprint(e.ID)
+		}
+
+		// time,mode,fontsize,color,ctime,pool,midHash,id,weight
+		p := fmt.Sprintf("%.5f,%d,%d,%d,%d,%d,%s,%s,%d",
+			float64(e.Progress)/1000, e.Mode, e.Fontsize, e.Color, e.Ctime, e.Pool, e.MidHash, id, e.Weight)
+
+		if _, err := io.WriteString(w, `<d p="`+escapeXML(p)+`">`+escapeXML(e.Content)+"</d>\n"); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, "</i>\n")
+
+	return err
+}
+
+type xmlDoc struct {
+	Items []struct {
+		P       string `xml:"p,attr"`
+		Content string `xml:",chardata"`
+	} `xml:"d"`
+}
+
+// ParseXML reads the classic `<i><d p="...">` xml, e.g. danmaku.xml of android caches, elems are sorted by progress.
+func ParseXML(r io.Reader) ([]*Elem, error) {
+	doc := xmlDoc{}
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	elems := []*Elem{}
+
+	for _, item := range doc.Items {
+		// time,mode,fontsize,color,ctime,pool,midHash,id[,weight]
+		p := strings.Split(item.P, ",")
+		if len(p) < 8 {
+			continue
+		}
+
+		progress, _ := strconv.ParseFloat(p[0], 64)
+		e := &Elem{
+			Progress: int32(progress * 1000),
+			Mode:     cast.ToInt32(p[1]),
+			Fontsize: cast.ToInt32(p[2]),
+			Color:    cast.ToUint32(p[3]),
+			Ctime:    cast.ToInt64(p[4]),
+			Pool:     cast.ToInt32(p[5]),
+			MidHash:  p[6],
+			IDStr:    p[7],
+			Content:  item.Content,
+		}
+
+		e.ID, _ = strconv.ParseInt(p[7], 10, 64)
+
+		if len(p) > 8 {
+			e.Weight = cast.ToInt32(p[8])
+		}
+
+		elems = append(elems, e)
+	}
+
+	sort.SliceStable(elems, func(i, j int) bool {
+		return elems[i].Progress < elems[j].Progress
+	})
+
+	return elems, nil
+}
+
+// ParseXMLFile reads the xml danmaku file.
+func ParseXMLFile(file string) ([]*Elem, error) {
+	fin, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	elems, err := ParseXML(fin)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", file, err)
+	}
+
+	return elems, nil
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+
+	return b.String()
+}
@@ -0,0 +1,229 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// boxHeader locates a box inside a source stream.
+type boxHeader struct {
+	typ    string
+	offset int64
+	hdrLen int64
+	size   int64
+}
+
+func (h boxHeader) payloadOffset() int64 {
+	return h.offset + h.hdrLen
+}
+
+func (h boxHeader) payloadSize() int64 {
+	return h.size - h.hdrLen
+}
+
+// readBoxHeaders lists the sibling boxes found in r between start and end.
+func readBoxHeaders(r io.ReaderAt, start, end int64) ([]boxHeader, error) {
+	headers := []boxHeader{}
+
+	var buf [_largeBoxHeaderLen]byte
+
+	for offset := start; offset < end; {
+		if end-offset < _boxHeaderLen {
+			// trailing padding is tolerated
+			break
+		}
+
+		if _, err := r.ReadAt(buf[:_boxHeaderLen], offset); err != nil {
+			return nil, err
+		}
+
+		h := boxHeader{
+			typ:    string(buf[4:8]),
+			offset: offset,
+			hdrLen: _boxHeaderLen,
+			size:   int64(binary.BigEndian.Uint32(buf[:4])),
+		}
+
+		switch h.size {
+		case 0:
+			h.size = end - offset
+		case 1:
+			if _, err := r.ReadAt(buf[_boxHeaderLen:], offset+_boxHeaderLen); err != nil {
+				return nil, err
+			}
+
+			h.hdrLen = _largeBoxHeaderLen
+			h.size = int64(binary.BigEndian.Uint64(buf[_boxHeaderLen:]))
+		}
+
+		if h.size < h.hdrLen || offset+h.size > end {
+			return nil, fmt.Errorf("%w: %q at %d with size %d", ErrInvalidBox, h.typ, offset, h.size)
+		}
+
+		headers = append(headers, h)
+		offset += h.size
+	}
+
+	return headers, nil
+}
+
+// readBox loads the whole box (header included) into memory.
+func readBox(r io.ReaderAt, h boxHeader) (rawBox, error) {
+	data := make([]byte, h.size)
+	if _, err := r.ReadAt(data, h.offset); err != nil {
+		return rawBox{}, err
+	}
+
+	return rawBox{typ: h.typ, raw: data, payload: data[h.hdrLen:]}, nil
+}
+
+// rawBox is a box loaded in memory.
+type rawBox struct {
+	typ string
+	// raw is the whole box including the header
+	raw     []byte
+	payload []byte
+}
+
+// children splits the payload of a container box into boxes.
+func (b rawBox) children() ([]rawBox, error) {
+	return splitBoxes(b.payload)
+}
+
+// child returns the first descendant box following the given path of types.
+func (b rawBox) child(path ...string) (rawBox, bool) {
+	current := b
+
+	for _, typ := range path {
+		boxes, err := current.children()
+		if err != nil {
+			return rawBox{}, false
+		}
+
+		found := false
+
+		for _, box := range boxes {
+			if box.typ == typ {
+				current = box
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return rawBox{}, false
+		}
+	}
+
+	return current, true
+}
+
+func splitBoxes(data []byte) ([]rawBox, error) {
+	boxes := []rawBox{}
+
+	for len(data) >= _boxHeaderLen {
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		typ := string(data[4:8])
+		hdrLen := uint64(_boxHeaderLen)
+
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < _largeBoxHeaderLen {
+				return nil, fmt.Errorf("%w: truncated %q", ErrInvalidBox, typ)
+			}
+
+			size = binary.BigEndian.Uint64(data[8:16])
+			hdrLen = _largeBoxHeaderLen
+		}
+
+		if size < hdrLen || size > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: %q with size %d", ErrInvalidBox, typ, size)
+		}
+
+		boxes = append(boxes, rawBox{typ: typ, raw: data[:size], payload: data[hdrLen:size]})
+		data = data[size:]
+	}
+
+	return boxes, nil
+}
+
+// fieldReader reads big endian fields from a box payload, the first error is kept in err.
+type fieldReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func newFieldReader(data []byte) *fieldReader {
+	return &fieldReader{data: data}
+}
+
+func (r *fieldReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+
+	if r.off+n > len(r.data) {
+		r.err = fmt.Errorf("%w: need %d bytes at %d, only %d", ErrInvalidBox, n, r.off, len(r.data))
+		return make([]byte, n)
+	}
+
+	b := r.data[r.off : r.off+n]
+	r.off += n
+
+	return b
+}
+
+func (r *fieldReader) skip(n int) {
+	r.next(n)
+}
+
+func (r *fieldReader) u8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *fieldReader) u16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *fieldReader) u32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *fieldReader) u64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+// versionAndFlags reads the full box header.
+func (r *fieldReader) versionAndFlags() (uint8, uint32) {
+	v := r.u32()
+	return uint8(v >> 24), v & 0x00ffffff
+}
+
+// mkBox builds a box with the payloads concatenated.
+func mkBox(typ string, payloads ...[]byte) []byte {
+	size := _boxHeaderLen
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	out := make([]byte, 0, size)
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	out = append(out, typ...)
+
+	for _, p := range payloads {
+		out = append(out, p...)
+	}
+
+	return out
+}
+
+// mkFullBox builds a box with version and flags in front of the payloads.
+func mkFullBox(typ string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	vf := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0x00ffffff)
+	return mkBox(typ, append([][]byte{vf}, payloads...)...)
+}
@@ -0,0 +1,45 @@
+package mp4
+
+import "errors"
+
+const (
+	_boxHeaderLen      = 8
+	_largeBoxHeaderLen = 16
+
+	// output movie timescale, same as ffmpeg
+	_movieTimescale = 1000
+)
+
+const (
+	// tfhd flags
+	_tfhdBaseDataOffset         = 0x000001
+	_tfhdSampleDescriptionIndex = 0x000002
+	_tfhdDefaultSampleDuration  = 0x000008
+	_tfhdDefaultSampleSize      = 0x000010
+	_tfhdDefaultSampleFlags     = 0x000020
+
+	// trun flags
+	_trunDataOffset            = 0x000001
+	_trunFirstSampleFlags      = 0x000004
+	_trunSampleDuration        = 0x000100
+	_trunSampleSize            = 0x000200
+	_trunSampleFlags           = 0x000400
+	_trunSampleCompositionTime = 0x000800
+
+	// sample_is_non_sync_sample in sample flags
+	_sampleNonSync = 0x00010000
+)
+
+var (
+	ErrInvalidBox    = errors.New("invalid mp4 box")
+	ErrNotMP4        = errors.New("not a progressive mp4 file")
+	ErrNoMoov        = errors.New("no moov box found")
+	ErrNoTrack       = errors.New("no track found")
+	ErrNoSamples     = errors.New("no samples found")
+	ErrUnknownTrack  = errors.New("fragment refers to unknown track")
+	ErrMissingHeader = errors.New("required track header box is missing")
+
+	ErrNotFLV           = errors.New("not a flv file")
+	ErrInvalidFLV       = errors.New("invalid flv tag")
+	ErrUnsupportedCodec = errors.New("unsupported codec, only h.264 and aac are remuxed")
+)
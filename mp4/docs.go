@@ -0,0 +1,4 @@
+/*
+Package mp4 remuxes fragmented mp4 streams (the dash `.m4s` files cached by bilibili) into a single progressive mp4 with `moov` in front, without the help of ffmpeg.
+*/
+package mp4
@@ -0,0 +1,709 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	_flvHeaderLen    = 9
+	_flvTagHeaderLen = 11
+	// PreviousTagSize follows every tag
+	_flvTagSizeLen = 4
+
+	_flvTagAudio = 8
+	_flvTagVideo = 9
+
+	_flvCodecAVC      = 7
+	_flvSoundAAC      = 10
+	_flvKeyFrame      = 1
+	_flvSequenceStart = 0
+	_flvPacketData    = 1
+
+	// flv timestamps are in milliseconds
+	_flvTimescale = 1000
+	// samples per AAC frame
+	_aacFrameLen = 1024
+)
+
+var _aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// flvSample is a media sample found in the flv segments, dts is in milliseconds.
+type flvSample struct {
+	offset int64
+	size   uint32
+	dts    int64
+	cts    int32
+	sync   bool
+}
+
+// flvStream collects the samples of the video or audio tags.
+type flvStream struct {
+	// config is AVCDecoderConfigurationRecord or AudioSpecificConfig, the first one is used
+	config  []byte
+	samples []flvSample
+}
+
+// OpenFLV reads the tracks of the flv segments, samples are read from the files until closeInputs is called.
+func OpenFLV(segments ...string) (tracks []*Track, closeInputs func(), err error) {
+	files := []*os.File{}
+	closeInputs = func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			closeInputs()
+		}
+	}()
+
+	readers := []*io.SectionReader{}
+
+	for _, segment := range segments {
+		fin, err := os.Open(segment)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		files = append(files, fin)
+
+		st, err := fin.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		readers = append(readers, io.NewSectionReader(fin, 0, st.Size()))
+	}
+
+	tracks, err = ReadFLV(readers...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tracks, closeInputs, nil
+}
+
+// ReadFLV demuxes the H.264 and AAC tracks of flv segments played one after another, e.g. the .blv segments
+// of legacy bilibili caches. A segment with timestamps restarting from 0 is shifted to the end of the previous one.
+func ReadFLV(segments ...*io.SectionReader) ([]*Track, error) {
+	if len(segments) == 0 {
+		return nil, ErrNoTrack
+	}
+
+	src := newConcatReader(segments)
+	video, audio := &flvStream{}, &flvStream{}
+	end := int64(0)
+
+	for i, seg := range segments {
+		segEnd, err := readFLVSegment(seg, src.starts[i], end, video, audio)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", i, err)
+		}
+
+		end = max(end, segEnd)
+	}
+
+	tracks := []*Track{}
+
+	if len(video.samples) != 0 {
+		t, err := newFLVVideoTrack(video)
+		if err != nil {
+			return nil, err
+		}
+
+		tracks = append(tracks, t)
+	}
+
+	if len(audio.samples) != 0 {
+		t, err := newFLVAudioTrack(audio)
+		if err != nil {
+			return nil, err
+		}
+
+		tracks = append(tracks, t)
+	}
+
+	if len(tracks) == 0 {
+		return nil, ErrNoTrack
+	}
+
+	for i, t := range tracks {
+		t.ID = uint32(i + 1)
+		t.src = src
+	}
+
+	return tracks, nil
+}
+
+// readFLVSegment appends the samples of seg, base is the offset of seg in the concatenated source
+// and end is the time the previous segments last to. It returns the time this segment lasts to.
+func readFLVSegment(seg *io.SectionReader, base, end int64, video, audio *flvStream) (int64, error) {
+	header := make([]byte, _flvHeaderLen)
+	if _, err := seg.ReadAt(header, 0); err != nil || string(header[:3]) != "FLV" {
+		return 0, ErrNotFLV
+	}
+
+	pos := int64(binary.BigEndian.Uint32(header[5:])) + _flvTagSizeLen
+	shift := int64(-1)
+	last := int64(0)
+	frameDuration := int64(0)
+	lastVideo := int64(-1)
+	tagHeader := make([]byte, _flvTagHeaderLen)
+
+	for pos < seg.Size() {
+		if _, err := seg.ReadAt(tagHeader, pos); err != nil {
+			return 0, fmt.Errorf("%w: tag header at %d", ErrInvalidFLV, pos)
+		}
+
+		typ := tagHeader[0] & 0x1f
+		dataSize := int64(tagHeader[1])<<16 | int64(tagHeader[2])<<8 | int64(tagHeader[3])
+		ts := int64(tagHeader[7])<<24 | int64(tagHeader[4])<<16 | int64(tagHeader[5])<<8 | int64(tagHeader[6])
+		dataOffset := pos + _flvTagHeaderLen
+
+		if dataOffset+dataSize > seg.Size() {
+			return 0, fmt.Errorf("%w: tag at %d is truncated", ErrInvalidFLV, pos)
+		}
+
+		pos = dataOffset + dataSize + _flvTagSizeLen
+
+		if (typ != _flvTagVideo && typ != _flvTagAudio) || dataSize < 2 {
+			continue
+		}
+
+		// timestamps restarting from 0 are moved after the previous segment
+		if shift < 0 {
+			shift = 0
+			if ts < end {
+				shift = end - ts
+			}
+		}
+
+		ts += shift
+		last = max(last, ts)
+
+		var err error
+		if typ == _flvTagVideo {
+			err = readFLVVideoTag(seg, base, dataOffset, dataSize, ts, video)
+
+			if lastVideo >= 0 && ts > lastVideo {
+				frameDuration = ts - lastVideo
+			}
+
+			lastVideo = ts
+		} else {
+			err = readFLVAudioTag(seg, base, dataOffset, dataSize, ts, audio)
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return last + frameDuration, nil
+}
+
+func readFLVVideoTag(seg *io.SectionReader, base, offset, size, ts int64, video *flvStream) error {
+	// frame type/codec id(1) + AVCPacketType(1) + composition time(3)
+	const headerLen = 5
+
+	if size < headerLen {
+		return nil
+	}
+
+	header := make([]byte, headerLen)
+	if _, err := seg.ReadAt(header, offset); err != nil {
+		return err
+	}
+
+	if codec := header[0] & 0x0f; codec != _flvCodecAVC {
+		return fmt.Errorf("%w: video codec id %d", ErrUnsupportedCodec, codec)
+	}
+
+	switch header[1] {
+	case _flvSequenceStart:
+		if video.config == nil {
+			video.config = make([]byte, size-headerLen)
+			if _, err := seg.ReadAt(video.config, offset+headerLen); err != nil {
+				return err
+			}
+		}
+	case _flvPacketData:
+		// composition time is a signed 24 bits integer
+		cts := int32(uint32(header[2])<<24|uint32(header[3])<<16|uint32(header[4])<<8) >> 8
+
+		video.samples = append(video.samples, flvSample{
+			offset: base + offset + headerLen,
+			size:   uint32(size - headerLen),
+			dts:    ts,
+			cts:    cts,
+			sync:   header[0]>>4 == _flvKeyFrame,
+		})
+	}
+
+	return nil
+}
+
+func readFLVAudioTag(seg *io.SectionReader, base, offset, size, ts int64, audio *flvStream) error {
+	// sound format/rate/size/type(1) + AACPacketType(1)
+	const headerLen = 2
+
+	header := make([]byte, headerLen)
+	if _, err := seg.ReadAt(header, offset); err != nil {
+		return err
+	}
+
+	if format := header[0] >> 4; format != _flvSoundAAC {
+		return fmt.Errorf("%w: sound format %d", ErrUnsupportedCodec, format)
+	}
+
+	switch header[1] {
+	case _flvSequenceStart:
+		if audio.config == nil {
+			audio.config = make([]byte, size-headerLen)
+			if _, err := seg.ReadAt(audio.config, offset+headerLen); err != nil {
+				return err
+			}
+		}
+	case _flvPacketData:
+		audio.samples = append(audio.samples, flvSample{
+			offset: base + offset + headerLen,
+			size:   uint32(size - headerLen),
+			dts:    ts,
+			sync:   true,
+		})
+	}
+
+	return nil
+}
+
+func newFLVVideoTrack(video *flvStream) (*Track, error) {
+	if video.config == nil {
+		return nil, fmt.Errorf("%w: no AVC sequence header", ErrInvalidFLV)
+	}
+
+	width, height := avcResolution(video.config)
+
+	t := &Track{
+		Handler:     "vide",
+		Timescale:   _flvTimescale,
+		tkhd:        mkFLVTkhd(0, width, height),
+		hdlr:        mkHdlr("vide", "VideoHandler"),
+		mediaHeader: mkFullBox("vmhd", 0, 1, make([]byte, 8)),
+		dinf:        mkDinf(),
+		stsd:        mkStsd(mkAVC1(width, height, video.config)),
+	}
+
+	for i, s := range video.samples {
+		duration := int64(0)
+
+		switch {
+		case i+1 < len(video.samples):
+			duration = video.samples[i+1].dts - s.dts
+		case i > 0:
+			duration = s.dts - video.samples[i-1].dts
+		}
+
+		t.Samples = append(t.Samples, Sample{
+			Offset:            s.offset,
+			Size:              s.size,
+			Duration:          uint32(max(duration, 0)),
+			CompositionOffset: s.cts,
+			Sync:              s.sync,
+		})
+	}
+
+	t.runs = singleSampleRuns(len(t.Samples))
+
+	return t, nil
+}
+
+func newFLVAudioTrack(audio *flvStream) (*Track, error) {
+	if len(audio.config) < 2 {
+		return nil, fmt.Errorf("%w: no AAC sequence header", ErrInvalidFLV)
+	}
+
+	rate, channels := aacConfig(audio.config)
+	if rate == 0 {
+		return nil, fmt.Errorf("%w: AudioSpecificConfig %x", ErrInvalidFLV, audio.config)
+	}
+
+	t := &Track{
+		Handler:     "soun",
+		Timescale:   rate,
+		tkhd:        mkFLVTkhd(0x0100, 0, 0),
+		hdlr:        mkHdlr("soun", "SoundHandler"),
+		mediaHeader: mkFullBox("smhd", 0, 0, make([]byte, 4)),
+		dinf:        mkDinf(),
+		stsd:        mkStsd(mkMP4A(rate, channels, audio.config)),
+	}
+
+	for _, s := range audio.samples {
+		t.Samples = append(t.Samples, Sample{Offset: s.offset, Size: s.size, Duration: _aacFrameLen, Sync: true})
+	}
+
+	t.runs = singleSampleRuns(len(t.Samples))
+
+	return t, nil
+}
+
+// singleSampleRuns makes a run of each sample, as samples of flv tags are never contiguous.
+func singleSampleRuns(n int) [][2]int {
+	runs := make([][2]int, n)
+	for i := range runs {
+		runs[i] = [2]int{i, i + 1}
+	}
+
+	return runs
+}
+
+// mkFLVTkhd builds a tkhd for mkTkhd to copy the flags, volume and size from.
+func mkFLVTkhd(volume uint16, width, height uint16) []byte {
+	// creation/modification time, track_ID, reserved, duration and reserved
+	payload := make([]byte, 28)
+	// layer, alternate_group
+	payload = append(payload, make([]byte, 4)...)
+	payload = binary.BigEndian.AppendUint16(payload, volume)
+	payload = append(payload, 0, 0)
+
+	for _, m := range _unityMatrix {
+		payload = binary.BigEndian.AppendUint32(payload, m)
+	}
+
+	// width and height are 16.16 fixed point
+	payload = binary.BigEndian.AppendUint32(payload, uint32(width)<<16)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(height)<<16)
+
+	// track enabled and in movie
+	return mkFullBox("tkhd", 0, 0x000003, payload)
+}
+
+func mkHdlr(handler, name string) []byte {
+	payload := make([]byte, 4)
+	payload = append(payload, handler...)
+	payload = append(payload, make([]byte, 12)...)
+	payload = append(payload, name...)
+
+	return mkFullBox("hdlr", 0, 0, payload, []byte{0})
+}
+
+// mkDinf refers to the media data in the same file.
+func mkDinf() []byte {
+	dref := mkFullBox("dref", 0, 0, binary.BigEndian.AppendUint32(nil, 1), mkFullBox("url ", 0, 1))
+	return mkBox("dinf", dref)
+}
+
+func mkStsd(entry []byte) []byte {
+	return mkFullBox("stsd", 0, 0, binary.BigEndian.AppendUint32(nil, 1), entry)
+}
+
+func mkAVC1(width, height uint16, avcC []byte) []byte {
+	// reserved(6) + data_reference_index(2) + pre_defined/reserved(16)
+	payload := make([]byte, 6)
+	payload = binary.BigEndian.AppendUint16(payload, 1)
+	payload = append(payload, make([]byte, 16)...)
+	payload = binary.BigEndian.AppendUint16(payload, width)
+	payload = binary.BigEndian.AppendUint16(payload, height)
+	// 72 dpi
+	payload = binary.BigEndian.AppendUint32(payload, 0x00480000)
+	payload = binary.BigEndian.AppendUint32(payload, 0x00480000)
+	payload = binary.BigEndian.AppendUint32(payload, 0)
+	// frame_count, compressorname(32)
+	payload = binary.BigEndian.AppendUint16(payload, 1)
+	payload = append(payload, make([]byte, 32)...)
+	// depth, pre_defined -1
+	payload = binary.BigEndian.AppendUint16(payload, 0x0018)
+	payload = binary.BigEndian.AppendUint16(payload, 0xffff)
+
+	return mkBox("avc1", payload, mkBox("avcC", avcC))
+}
+
+func mkMP4A(rate uint32, channels uint16, asc []byte) []byte {
+	// reserved(6) + data_reference_index(2) + reserved(8)
+	payload := make([]byte, 6)
+	payload = binary.BigEndian.AppendUint16(payload, 1)
+	payload = append(payload, make([]byte, 8)...)
+	payload = binary.BigEndian.AppendUint16(payload, channels)
+	payload = binary.BigEndian.AppendUint16(payload, 16)
+	payload = append(payload, make([]byte, 4)...)
+	// 16.16 fixed point, rates above 65535 are left to the esds
+	payload = binary.BigEndian.AppendUint32(payload, min(rate, 0xffff)<<16)
+
+	// object type AAC, audio stream, buffer size and bitrates unknown
+	decoderConfig := mkDescriptor(0x04, []byte{0x40, 0x15}, make([]byte, 11), mkDescriptor(0x05, asc))
+	// ES_ID(2) and flags(1), SLConfig predefined 2 for mp4
+	es := mkDescriptor(0x03, make([]byte, 3), decoderConfig, mkDescriptor(0x06, []byte{0x02}))
+
+	return mkBox("mp4a", payload, mkFullBox("esds", 0, 0, es))
+}
+
+// mkDescriptor builds an MPEG-4 descriptor with the size in the 4 bytes form.
+func mkDescriptor(tag byte, payloads ...[]byte) []byte {
+	size := 0
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	out := []byte{tag, 0x80 | byte(size>>21&0x7f), 0x80 | byte(size>>14&0x7f), 0x80 | byte(size>>7&0x7f), byte(size & 0x7f)}
+
+	for _, p := range payloads {
+		out = append(out, p...)
+	}
+
+	return out
+}
+
+// aacConfig reads the sample rate and channels of AudioSpecificConfig, rate is 0 if unknown.
+func aacConfig(asc []byte) (uint32, uint16) {
+	br := &bitReader{data: asc}
+	br.bits(5) // audioObjectType
+
+	rate := uint32(0)
+	if index := br.bits(4); index == 0x0f {
+		rate = uint32(br.bits(24))
+	} else if int(index) < len(_aacSampleRates) {
+		rate = _aacSampleRates[index]
+	}
+
+	channels := uint16(br.bits(4))
+	if br.err != nil {
+		return 0, 0
+	}
+
+	return rate, channels
+}
+
+// avcResolution reads the picture size from the first SPS of AVCDecoderConfigurationRecord, 0 if unknown.
+func avcResolution(avcC []byte) (uint16, uint16) {
+	// configurationVersion, profile, compatibility, level, lengthSize(1) + numOfSPS(1) + spsLength(2)
+	const spsOffset = 8
+
+	if len(avcC) < spsOffset || avcC[5]&0x1f == 0 {
+		return 0, 0
+	}
+
+	spsLen := int(binary.BigEndian.Uint16(avcC[6:]))
+	if len(avcC) < spsOffset+spsLen || spsLen < 2 {
+		return 0, 0
+	}
+
+	// skip the NAL header
+	return spsResolution(unescapeRBSP(avcC[spsOffset+1 : spsOffset+spsLen]))
+}
+
+// unescapeRBSP removes emulation_prevention_three_byte.
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
+
+// spsResolution parses seq_parameter_set_rbsp of H.264 (7.3.2.1.1) up to the frame cropping.
+func spsResolution(sps []byte) (uint16, uint16) {
+	br := &bitReader{data: sps}
+	profile := br.bits(8)
+	br.bits(16) // constraint flags, level
+	br.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint64(1)
+
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = br.ue()
+		if chromaFormat == 3 {
+			br.bits(1) // separate_colour_plane_flag
+		}
+
+		br.ue()              // bit_depth_luma_minus8
+		br.ue()              // bit_depth_chroma_minus8
+		br.bits(1)           // qpprime_y_zero_transform_bypass_flag
+		if br.bits(1) == 1 { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+
+			for i := range lists {
+				if br.bits(1) == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+
+					br.skipScalingList(size)
+				}
+			}
+		}
+	}
+
+	br.ue() // log2_max_frame_num_minus4
+
+	switch br.ue() { // pic_order_cnt_type
+	case 0:
+		br.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		br.bits(1) // delta_pic_order_always_zero_flag
+		br.se()    // offset_for_non_ref_pic
+		br.se()    // offset_for_top_to_bottom_field
+
+		// num_ref_frames_in_pic_order_cnt_cycle is at most 255
+		for range min(br.ue(), 255) {
+			br.se() // offset_for_ref_frame
+		}
+	}
+
+	br.ue()    // max_num_ref_frames
+	br.bits(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthInMbs := br.ue() + 1
+	heightInMapUnits := br.ue() + 1
+	frameMbsOnly := br.bits(1)
+
+	if frameMbsOnly == 0 {
+		br.bits(1) // mb_adaptive_frame_field_flag
+	}
+
+	br.bits(1) // direct_8x8_inference_flag
+
+	width := widthInMbs * 16
+	height := (2 - frameMbsOnly) * heightInMapUnits * 16
+
+	if br.bits(1) == 1 { // frame_cropping_flag
+		left, right, top, bottom := br.ue(), br.ue(), br.ue(), br.ue()
+
+		// crop units of 4:2:0, which is what bilibili serves
+		cropX, cropY := uint64(2), 2*(2-frameMbsOnly)
+		if chromaFormat == 0 || chromaFormat == 3 {
+			cropX, cropY = 1, 2-frameMbsOnly
+		}
+
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+
+	if br.err != nil || width > 0xffff || height > 0xffff {
+		return 0, 0
+	}
+
+	return uint16(width), uint16(height)
+}
+
+// bitReader reads the bits of a RBSP, the first error is kept in err.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bits(n int) uint64 {
+	v := uint64(0)
+
+	for range n {
+		if r.pos >= len(r.data)*8 {
+			r.err = fmt.Errorf("%w: need %d bits at %d", ErrInvalidFLV, n, r.pos)
+			return 0
+		}
+
+		v = v<<1 | uint64(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+
+	return v
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint64 {
+	zeros := 0
+	for r.bits(1) == 0 && r.err == nil && zeros < 32 {
+		zeros++
+	}
+
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int64 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int64(v/2 + 1)
+	}
+
+	return -int64(v / 2)
+}
+
+func (r *bitReader) skipScalingList(size int) {
+	last, next := int64(8), int64(8)
+
+	for range size {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// concatReader reads segments as one source, the offsets of a segment follow the previous one.
+type concatReader struct {
+	segments []*io.SectionReader
+	starts   []int64
+}
+
+func newConcatReader(segments []*io.SectionReader) *concatReader {
+	c := &concatReader{segments: segments}
+	start := int64(0)
+
+	for _, seg := range segments {
+		c.starts = append(c.starts, start)
+		start += seg.Size()
+	}
+
+	return c
+}
+
+func (c *concatReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+
+	for i, seg := range c.segments {
+		end := c.starts[i] + seg.Size()
+		if len(p) == 0 || off >= end {
+			continue
+		}
+
+		m, err := seg.ReadAt(p[:min(int64(len(p)), end-off)], off-c.starts[i])
+		n += m
+		p = p[m:]
+		off += int64(m)
+
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+
+	if len(p) != 0 {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,460 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+)
+
+// Sample is a media sample located in the source stream.
+type Sample struct {
+	Offset            int64
+	Size              uint32
+	Duration          uint32
+	CompositionOffset int32
+	Sync              bool
+}
+
+// Edit is an entry of the edit list, SegmentDuration is in the movie timescale of the source.
+type Edit struct {
+	SegmentDuration uint64
+	MediaTime       int64
+	MediaRate       uint32
+}
+
+// Track is a track demuxed from a fragmented mp4 stream.
+type Track struct {
+	ID        uint32
+	Handler   string
+	Timescale uint32
+	Samples   []Sample
+	Edits     []Edit
+
+	// timescale of the source mvhd, used by Edits
+	movieTimescale uint32
+	// runs are [start, end) sample indexes, samples of a run are contiguous in src
+	runs [][2]int
+
+	src io.ReaderAt
+
+	// raw boxes copied to the output as is
+	tkhd, mdhd, hdlr, mediaHeader, dinf, stsd []byte
+}
+
+// Duration returns the sum of sample durations in the track timescale.
+func (t *Track) Duration() uint64 {
+	var total uint64
+	for _, s := range t.Samples {
+		total += uint64(s.Duration)
+	}
+
+	return total
+}
+
+// stsd header(8) + version/flags(4) + entry_count(4) + entry size(4)
+const _codecTagOffset = _boxHeaderLen + 12
+
+// CodecTag returns the type of the first sample entry, e.g. avc1, hev1 or mp4a.
+func (t *Track) CodecTag() string {
+	if len(t.stsd) < _codecTagOffset+4 {
+		return ""
+	}
+
+	return string(t.stsd[_codecTagOffset : _codecTagOffset+4])
+}
+
+// SetCodecTag changes the type of the first sample entry, e.g. hev1 to hvc1, which has the same layout.
+func (t *Track) SetCodecTag(tag string) error {
+	if len(tag) != 4 || len(t.stsd) < _codecTagOffset+4 {
+		return fmt.Errorf("%w: cannot set codec tag %q", ErrInvalidBox, tag)
+	}
+
+	// stsd may share the memory of the source moov
+	stsd := append([]byte{}, t.stsd...)
+	copy(stsd[_codecTagOffset:], tag)
+	t.stsd = stsd
+
+	return nil
+}
+
+type trackDefaults struct {
+	duration uint32
+	size     uint32
+	flags    uint32
+}
+
+// ReadFragmented demuxes all tracks of the fragmented mp4 stream found in r.
+func ReadFragmented(r io.ReaderAt, size int64) ([]*Track, error) {
+	headers, err := readBoxHeaders(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		tracks   []*Track
+		defaults map[uint32]trackDefaults
+	)
+
+	for _, h := range headers {
+		switch h.typ {
+		case "moov":
+			moov, err := readBox(r, h)
+			if err != nil {
+				return nil, err
+			}
+
+			tracks, defaults, err = parseMoov(moov)
+			if err != nil {
+				return nil, err
+			}
+		case "moof":
+			if tracks == nil {
+				return nil, fmt.Errorf("%w: moof before moov", ErrNoMoov)
+			}
+
+			moof, err := readBox(r, h)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := parseMoof(moof, h.offset, tracks, defaults); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if tracks == nil {
+		return nil, ErrNoMoov
+	}
+
+	for _, t := range tracks {
+		t.src = r
+	}
+
+	return tracks, nil
+}
+
+func parseMoov(moov rawBox) ([]*Track, map[uint32]trackDefaults, error) {
+	boxes, err := moov.children()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tracks := []*Track{}
+	defaults := make(map[uint32]trackDefaults)
+
+	var movieTimescale uint32
+
+	for _, box := range boxes {
+		switch box.typ {
+		case "mvhd":
+			fr := newFieldReader(box.payload)
+			if v, _ := fr.versionAndFlags(); v == 1 {
+				fr.skip(16)
+			} else {
+				fr.skip(8)
+			}
+
+			movieTimescale = fr.u32()
+			if fr.err != nil {
+				return nil, nil, fr.err
+			}
+		case "trak":
+			t, err := parseTrak(box)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			tracks = append(tracks, t)
+		case "mvex":
+			trexes, err := box.children()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for _, trex := range trexes {
+				if trex.typ != "trex" {
+					continue
+				}
+
+				fr := newFieldReader(trex.payload)
+				fr.versionAndFlags()
+				id := fr.u32()
+				fr.skip(4) // default_sample_description_index
+
+				defaults[id] = trackDefaults{duration: fr.u32(), size: fr.u32(), flags: fr.u32()}
+				if fr.err != nil {
+					return nil, nil, fr.err
+				}
+			}
+		}
+	}
+
+	if len(tracks) == 0 {
+		return nil, nil, ErrNoTrack
+	}
+
+	for _, t := range tracks {
+		t.movieTimescale = movieTimescale
+	}
+
+	return tracks, defaults, nil
+}
+
+func parseTrak(trak rawBox) (*Track, error) {
+	t := &Track{}
+
+	tkhd, ok := trak.child("tkhd")
+	if !ok {
+		return nil, fmt.Errorf("%w: tkhd", ErrMissingHeader)
+	}
+
+	fr := newFieldReader(tkhd.payload)
+	if v, _ := fr.versionAndFlags(); v == 1 {
+		fr.skip(16)
+	} else {
+		fr.skip(8)
+	}
+
+	t.ID = fr.u32()
+	t.tkhd = tkhd.raw
+
+	mdhd, ok := trak.child("mdia", "mdhd")
+	if !ok {
+		return nil, fmt.Errorf("%w: mdhd", ErrMissingHeader)
+	}
+
+	fr = newFieldReader(mdhd.payload)
+	if v, _ := fr.versionAndFlags(); v == 1 {
+		fr.skip(16)
+	} else {
+		fr.skip(8)
+	}
+
+	t.Timescale = fr.u32()
+	t.mdhd = mdhd.raw
+
+	if fr.err != nil {
+		return nil, fr.err
+	}
+
+	hdlr, ok := trak.child("mdia", "hdlr")
+	if !ok || len(hdlr.payload) < 12 {
+		return nil, fmt.Errorf("%w: hdlr", ErrMissingHeader)
+	}
+
+	// version/flags(4) + pre_defined(4) + handler_type(4)
+	t.Handler = string(hdlr.payload[8:12])
+	t.hdlr = hdlr.raw
+
+	minf, ok := trak.child("mdia", "minf")
+	if !ok {
+		return nil, fmt.Errorf("%w: minf", ErrMissingHeader)
+	}
+
+	minfBoxes, err := minf.children()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, box := range minfBoxes {
+		switch box.typ {
+		case "vmhd", "smhd", "sthd", "nmhd":
+			t.mediaHeader = box.raw
+		case "dinf":
+			t.dinf = box.raw
+		}
+	}
+
+	stsd, ok := minf.child("stbl", "stsd")
+	if !ok {
+		return nil, fmt.Errorf("%w: stsd", ErrMissingHeader)
+	}
+
+	t.stsd = stsd.raw
+
+	if elst, ok := trak.child("edts", "elst"); ok {
+		t.Edits, err = parseElst(elst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func parseElst(elst rawBox) ([]Edit, error) {
+	fr := newFieldReader(elst.payload)
+	version, _ := fr.versionAndFlags()
+	count := fr.u32()
+
+	edits := []Edit{}
+
+	for i := uint32(0); i < count && fr.err == nil; i++ {
+		var e Edit
+
+		if version == 1 {
+			e.SegmentDuration = fr.u64()
+			e.MediaTime = int64(fr.u64())
+		} else {
+			e.SegmentDuration = uint64(fr.u32())
+			e.MediaTime = int64(int32(fr.u32()))
+		}
+
+		e.MediaRate = fr.u32()
+		edits = append(edits, e)
+	}
+
+	return edits, fr.err
+}
+
+func parseMoof(moof rawBox, moofOffset int64, tracks []*Track, defaults map[uint32]trackDefaults) error {
+	trafs, err := moof.children()
+	if err != nil {
+		return err
+	}
+
+	for _, traf := range trafs {
+		if traf.typ != "traf" {
+			continue
+		}
+
+		if err := parseTraf(traf, moofOffset, tracks, defaults); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseTraf(traf rawBox, moofOffset int64, tracks []*Track, defaults map[uint32]trackDefaults) error {
+	tfhd, ok := traf.child("tfhd")
+	if !ok {
+		return fmt.Errorf("%w: tfhd", ErrMissingHeader)
+	}
+
+	fr := newFieldReader(tfhd.payload)
+	_, flags := fr.versionAndFlags()
+	trackID := fr.u32()
+
+	var track *Track
+
+	for _, t := range tracks {
+		if t.ID == trackID {
+			track = t
+		}
+	}
+
+	if track == nil {
+		return fmt.Errorf("%w: %d", ErrUnknownTrack, trackID)
+	}
+
+	def := defaults[trackID]
+	baseOffset := moofOffset
+
+	if flags&_tfhdBaseDataOffset != 0 {
+		baseOffset = int64(fr.u64())
+	}
+
+	if flags&_tfhdSampleDescriptionIndex != 0 {
+		fr.skip(4)
+	}
+
+	if flags&_tfhdDefaultSampleDuration != 0 {
+		def.duration = fr.u32()
+	}
+
+	if flags&_tfhdDefaultSampleSize != 0 {
+		def.size = fr.u32()
+	}
+
+	if flags&_tfhdDefaultSampleFlags != 0 {
+		def.flags = fr.u32()
+	}
+
+	if fr.err != nil {
+		return fr.err
+	}
+
+	boxes, err := traf.children()
+	if err != nil {
+		return err
+	}
+
+	dataOffset := baseOffset
+
+	for _, box := range boxes {
+		if box.typ != "trun" {
+			continue
+		}
+
+		dataOffset, err = parseTrun(box, baseOffset, dataOffset, track, def)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseTrun appends the samples of the run to track, and returns the offset right after its data.
+func parseTrun(trun rawBox, baseOffset, dataOffset int64, track *Track, def trackDefaults) (int64, error) {
+	fr := newFieldReader(trun.payload)
+	version, flags := fr.versionAndFlags()
+	count := fr.u32()
+
+	if flags&_trunDataOffset != 0 {
+		dataOffset = baseOffset + int64(int32(fr.u32()))
+	}
+
+	firstFlags, hasFirstFlags := def.flags, false
+	if flags&_trunFirstSampleFlags != 0 {
+		firstFlags, hasFirstFlags = fr.u32(), true
+	}
+
+	start := len(track.Samples)
+
+	for i := uint32(0); i < count && fr.err == nil; i++ {
+		s := Sample{Offset: dataOffset, Duration: def.duration, Size: def.size}
+		sampleFlags := def.flags
+
+		if i == 0 && hasFirstFlags {
+			sampleFlags = firstFlags
+		}
+
+		if flags&_trunSampleDuration != 0 {
+			s.Duration = fr.u32()
+		}
+
+		if flags&_trunSampleSize != 0 {
+			s.Size = fr.u32()
+		}
+
+		if flags&_trunSampleFlags != 0 {
+			sampleFlags = fr.u32()
+		}
+
+		if flags&_trunSampleCompositionTime != 0 {
+			cto := fr.u32()
+			if version == 0 {
+				s.CompositionOffset = int32(min(cto, 1<<31-1))
+			} else {
+				s.CompositionOffset = int32(cto)
+			}
+		}
+
+		s.Sync = sampleFlags&_sampleNonSync == 0
+		dataOffset += int64(s.Size)
+
+		track.Samples = append(track.Samples, s)
+	}
+
+	if fr.err != nil {
+		return 0, fr.err
+	}
+
+	if end := len(track.Samples); end > start {
+		track.runs = append(track.runs, [2]int{start, end})
+	}
+
+	return dataOffset, nil
+}
@@ -0,0 +1,370 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// data type indicators of ilst items
+const (
+	_dataTypeImplicit = 0
+	_dataTypeUTF8     = 1
+	_dataTypeJPEG     = 13
+	_dataTypePNG      = 14
+)
+
+// Metadata is written as iTunes-style ilst tags, empty fields are skipped.
+type Metadata struct {
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	// Date is in the form of 2006-01-02T15:04:05Z
+	Date       string
+	Comment    string
+	Genre      string
+	Encoder    string
+	Track      int
+	TrackTotal int
+	// Cover is a jpeg or png image
+	Cover []byte
+}
+
+func (m *Metadata) items() [][]byte {
+	items := [][]byte{}
+
+	for _, kv := range []struct{ key, value string }{
+		{"\xa9nam", m.Title},
+		{"\xa9ART", m.Artist},
+		{"aART", m.AlbumArtist},
+		{"\xa9alb", m.Album},
+		{"\xa9day", m.Date},
+		{"\xa9cmt", m.Comment},
+		{"\xa9gen", m.Genre},
+		{"\xa9too", m.Encoder},
+	} {
+		if kv.value != "" {
+			items = append(items, mkIlstItem(kv.key, _dataTypeUTF8, []byte(kv.value)))
+		}
+	}
+
+	if m.Track > 0 {
+		trkn := make([]byte, 8)
+		binary.BigEndian.PutUint16(trkn[2:], uint16(min(m.Track, math.MaxUint16)))
+		binary.BigEndian.PutUint16(trkn[4:], uint16(min(m.TrackTotal, math.MaxUint16)))
+		items = append(items, mkIlstItem("trkn", _dataTypeImplicit, trkn))
+	}
+
+	if len(m.Cover) > 0 {
+		typ := uint32(_dataTypeJPEG)
+		if bytes.HasPrefix(m.Cover, []byte("\x89PNG")) {
+			typ = _dataTypePNG
+		}
+
+		items = append(items, mkIlstItem("covr", typ, m.Cover))
+	}
+
+	return items
+}
+
+func mkIlstItem(key string, dataType uint32, value []byte) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, dataType)
+	// locale
+	payload = binary.BigEndian.AppendUint32(payload, 0)
+	payload = append(payload, value...)
+
+	return mkBox(key, mkBox("data", payload))
+}
+
+// mkUdta returns nil if there is nothing to write.
+func mkUdta(meta *Metadata) []byte {
+	if meta == nil {
+		return nil
+	}
+
+	items := meta.items()
+	if len(items) == 0 {
+		return nil
+	}
+
+	// handler mdir, manufacturer appl
+	hdlr := make([]byte, 4, 21)
+	hdlr = append(hdlr, "mdir"...)
+	hdlr = append(hdlr, "appl"...)
+	hdlr = append(hdlr, make([]byte, 9)...)
+
+	meta4 := mkFullBox("meta", 0, 0, mkFullBox("hdlr", 0, 0, hdlr), mkBox("ilst", items...))
+
+	return mkBox("udta", meta4)
+}
+
+// TagFile writes meta into the progressive mp4 file, existing udta of moov is replaced.
+// Chunk offsets are shifted when moov is placed in front of mdat.
+func TagFile(file string, meta *Metadata) error {
+	fin, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	st, err := fin.Stat()
+	if err != nil {
+		return err
+	}
+
+	headers, err := readBoxHeaders(fin, 0, st.Size())
+	if err != nil {
+		return err
+	}
+
+	moovIndex := -1
+
+	for i, h := range headers {
+		if h.typ == "moov" {
+			moovIndex = i
+		}
+	}
+
+	if moovIndex == -1 {
+		return ErrNoMoov
+	}
+
+	moov, err := readBox(fin, headers[moovIndex])
+	if err != nil {
+		return err
+	}
+
+	newMoov, err := retagMoov(moov, meta)
+	if err != nil {
+		return err
+	}
+
+	// media data after moov is moved by the size change
+	shift := int64(len(newMoov)) - headers[moovIndex].size
+	if shift != 0 && hasMdatAfter(headers, moovIndex) {
+		if err := shiftChunkOffsets(newMoov, shift); err != nil {
+			return err
+		}
+	}
+
+	fout, err := os.CreateTemp(filepath.Dir(file), ".tagging-*"+filepath.Ext(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fout.Name())
+	defer fout.Close()
+
+	for i, h := range headers {
+		if i == moovIndex {
+			_, err = fout.Write(newMoov)
+		} else {
+			_, err = io.Copy(fout, io.NewSectionReader(fin, h.offset, h.size))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := fout.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(fout.Name(), file)
+}
+
+// retagMoov rebuilds moov with its udta replaced by meta.
+func retagMoov(moov rawBox, meta *Metadata) ([]byte, error) {
+	children, err := moov.children()
+	if err != nil {
+		return nil, err
+	}
+
+	boxes := [][]byte{}
+
+	for _, c := range children {
+		if c.typ != "udta" {
+			// copied, as chunk offsets may be changed in place
+			boxes = append(boxes, append([]byte{}, c.raw...))
+		}
+	}
+
+	if udta := mkUdta(meta); udta != nil {
+		boxes = append(boxes, udta)
+	}
+
+	return mkBox("moov", boxes...), nil
+}
+
+func hasMdatAfter(headers []boxHeader, index int) bool {
+	for _, h := range headers[index+1:] {
+		if h.typ == "mdat" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// shiftChunkOffsets adds shift to every stco/co64 entry of moov in place.
+func shiftChunkOffsets(moov []byte, shift int64) error {
+	boxes, err := splitBoxes(moov)
+	if err != nil || len(boxes) != 1 {
+		return fmt.Errorf("%w: moov", ErrInvalidBox)
+	}
+
+	traks, err := boxes[0].children()
+	if err != nil {
+		return err
+	}
+
+	for _, trak := range traks {
+		if trak.typ != "trak" {
+			continue
+		}
+
+		stbl, ok := trak.child("mdia", "minf", "stbl")
+		if !ok {
+			continue
+		}
+
+		tables, err := stbl.children()
+		if err != nil {
+			return err
+		}
+
+		for _, table := range tables {
+			if table.typ != "stco" && table.typ != "co64" {
+				continue
+			}
+
+			entrySize := 4
+			if table.typ == "co64" {
+				entrySize = 8
+			}
+
+			// version/flags(4) + entry_count(4)
+			if len(table.payload) < 8 {
+				return fmt.Errorf("%w: %s is too short", ErrInvalidBox, table.typ)
+			}
+
+			entries := table.payload[8:]
+			for i := 0; i+entrySize <= len(entries); i += entrySize {
+				if entrySize == 8 {
+					v := int64(binary.BigEndian.Uint64(entries[i:])) + shift
+					binary.BigEndian.PutUint64(entries[i:], uint64(v))
+
+					continue
+				}
+
+				v := int64(binary.BigEndian.Uint32(entries[i:])) + shift
+				if v < 0 || v > math.MaxUint32 {
+					return fmt.Errorf("%w: chunk offset %d overflows stco", ErrInvalidBox, v)
+				}
+
+				binary.BigEndian.PutUint32(entries[i:], uint32(v))
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadMetadata reads the ilst tags of the mp4 file, nil is returned if no tag is found.
+func ReadMetadata(file string) (*Metadata, error) {
+	fin, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	st, err := fin.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := readBoxHeaders(fin, 0, st.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range headers {
+		if h.typ != "moov" {
+			continue
+		}
+
+		moov, err := readBox(fin, h)
+		if err != nil {
+			return nil, err
+		}
+
+		meta, ok := moov.child("udta", "meta")
+		if !ok || len(meta.payload) < 4 {
+			return nil, nil
+		}
+
+		// meta is a full box, skip version/flags
+		metaBox := rawBox{typ: meta.typ, payload: meta.payload[4:]}
+
+		ilst, ok := metaBox.child("ilst")
+		if !ok {
+			return nil, nil
+		}
+
+		return parseIlst(ilst)
+	}
+
+	return nil, ErrNoMoov
+}
+
+func parseIlst(ilst rawBox) (*Metadata, error) {
+	items, err := ilst.children()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{}
+
+	for _, item := range items {
+		data, ok := item.child("data")
+		// type indicator(4) + locale(4)
+		if !ok || len(data.payload) < 8 {
+			continue
+		}
+
+		value := data.payload[8:]
+
+		switch item.typ {
+		case "\xa9nam":
+			m.Title = string(value)
+		case "\xa9ART":
+			m.Artist = string(value)
+		case "aART":
+			m.AlbumArtist = string(value)
+		case "\xa9alb":
+			m.Album = string(value)
+		case "\xa9day":
+			m.Date = string(value)
+		case "\xa9cmt":
+			m.Comment = string(value)
+		case "\xa9gen":
+			m.Genre = string(value)
+		case "\xa9too":
+			m.Encoder = string(value)
+		case "trkn":
+			if len(value) >= 6 {
+				m.Track = int(binary.BigEndian.Uint16(value[2:]))
+				m.TrackTotal = int(binary.BigEndian.Uint16(value[4:]))
+			}
+		case "covr":
+			m.Cover = append([]byte{}, value...)
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,392 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/coghost/bilibili_cache_converter/fixtures/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bilibili cached m4s has a 9 bytes prefix
+const _cachedPrefixLen = 9
+
+var _fixtureDir = filepath.Join(testutil.GetProjectRoot(), "fixtures", "26349405204")
+
+func mustReadFixtureTracks(t *testing.T, name string) []*Track {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(_fixtureDir, name))
+	require.NoError(t, err, "read fixture")
+
+	r := bytes.NewReader(data[_cachedPrefixLen:])
+	tracks, err := ReadFragmented(r, r.Size())
+	require.NoError(t, err, "read fragmented")
+
+	return tracks
+}
+
+func TestReadFragmented(t *testing.T) {
+	assert := assert.New(t)
+
+	video := mustReadFixtureTracks(t, "26349405204-1-30016.m4s")
+	require.Len(t, video, 1)
+	assert.Equal("vide", video[0].Handler)
+	assert.Equal("avc1", video[0].CodecTag())
+	assert.Equal(uint32(16000), video[0].Timescale)
+	assert.NotEmpty(video[0].Samples)
+	assert.True(video[0].Samples[0].Sync, "first video sample is a key frame")
+	assert.Len(video[0].Edits, 2)
+
+	audio := mustReadFixtureTracks(t, "26349405204-1-30280.m4s")
+	require.Len(t, audio, 1)
+	assert.Equal("soun", audio[0].Handler)
+	assert.Equal("mp4a", audio[0].CodecTag())
+	assert.Equal(uint32(44100), audio[0].Timescale)
+
+	// both streams last about 53.5s
+	assert.InDelta(53.5, float64(video[0].Duration())/float64(video[0].Timescale), 0.2)
+	assert.InDelta(53.5, float64(audio[0].Duration())/float64(audio[0].Timescale), 0.2)
+}
+
+func TestRemux(t *testing.T) {
+	assert := assert.New(t)
+
+	tracks := mustReadFixtureTracks(t, "26349405204-1-30016.m4s")
+	tracks = append(tracks, mustReadFixtureTracks(t, "26349405204-1-30280.m4s")...)
+
+	var out bytes.Buffer
+
+	n, err := Remux(&out, tracks, nil)
+	require.NoError(t, err, "remux")
+	assert.Equal(int64(out.Len()), n, "bytes written")
+
+	r := bytes.NewReader(out.Bytes())
+	headers, err := readBoxHeaders(r, 0, r.Size())
+	require.NoError(t, err, "read output boxes")
+	require.Len(t, headers, 3)
+	assert.Equal([]string{"ftyp", "moov", "mdat"}, []string{headers[0].typ, headers[1].typ, headers[2].typ}, "moov in front")
+
+	totalSize := int64(0)
+	for _, tr := range tracks {
+		for _, s := range tr.Samples {
+			totalSize += int64(s.Size)
+		}
+	}
+
+	assert.Equal(totalSize, headers[2].payloadSize(), "mdat holds all samples")
+
+	assertFirstSamples(t, out.Bytes(), tracks)
+}
+
+// assertFirstSamples checks the first chunk of each trak starts with the first sample of the source.
+func assertFirstSamples(t *testing.T, data []byte, tracks []*Track) {
+	t.Helper()
+
+	r := bytes.NewReader(data)
+	headers, err := readBoxHeaders(r, 0, r.Size())
+	require.NoError(t, err, "read output boxes")
+
+	var moov rawBox
+
+	for _, h := range headers {
+		if h.typ == "moov" {
+			moov, err = readBox(r, h)
+			require.NoError(t, err)
+		}
+	}
+
+	traks := []rawBox{}
+	boxes, err := moov.children()
+	require.NoError(t, err)
+
+	for _, b := range boxes {
+		if b.typ == "trak" {
+			traks = append(traks, b)
+		}
+	}
+
+	require.Len(t, traks, len(tracks))
+
+	for i, trak := range traks {
+		stsz, ok := trak.child("mdia", "minf", "stbl", "stsz")
+		require.True(t, ok, "stsz")
+		assert.Equal(t, uint32(len(tracks[i].Samples)), binary.BigEndian.Uint32(stsz.payload[8:12]), "sample count")
+
+		stco, ok := trak.child("mdia", "minf", "stbl", "stco")
+		require.True(t, ok, "stco")
+
+		first := tracks[i].Samples[0]
+		offset := int64(binary.BigEndian.Uint32(stco.payload[8:12]))
+		want := make([]byte, first.Size)
+		_, err = tracks[i].src.ReadAt(want, first.Offset)
+		require.NoError(t, err)
+
+		got := make([]byte, first.Size)
+		_, err = io.ReadFull(io.NewSectionReader(r, offset, int64(first.Size)), got)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "first sample copied")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	tracks := mustReadFixtureTracks(t, "26349405204-1-30016.m4s")
+	tracks = append(tracks, mustReadFixtureTracks(t, "26349405204-1-30280.m4s")...)
+
+	cover, err := os.ReadFile(filepath.Join(_fixtureDir, "image.jpg"))
+	require.NoError(t, err)
+
+	meta := &Metadata{
+		Title:      "【星露谷物语】复古小卧室",
+		Artist:     "乐乐乐雨_",
+		Album:      "【星露谷物语】复古小卧室",
+		Date:       "2024-10-19T01:30:53Z",
+		Comment:    "https://www.bilibili.com/video/BV1JcCUYSEEL/?p=1",
+		Track:      1,
+		TrackTotal: 3,
+		Cover:      cover,
+	}
+
+	outFile := filepath.Join(t.TempDir(), "out.mp4")
+	fout, err := os.Create(outFile)
+	require.NoError(t, err)
+
+	_, err = Remux(fout, tracks, nil)
+	require.NoError(t, err)
+	require.NoError(t, fout.Close())
+
+	got, err := ReadMetadata(outFile)
+	require.NoError(t, err)
+	assert.Nil(got, "no tags by default")
+
+	// moov is in front of mdat, so chunk offsets must be shifted after tagging
+	require.NoError(t, TagFile(outFile, meta), "tag file")
+
+	got, err = ReadMetadata(outFile)
+	require.NoError(t, err)
+	assert.Equal(meta, got, "tags written")
+
+	data, err := os.ReadFile(outFile)
+	require.NoError(t, err)
+	assertFirstSamples(t, data, tracks)
+
+	var out bytes.Buffer
+
+	_, err = Remux(&out, tracks, meta)
+	require.NoError(t, err)
+	assert.Equal(data, out.Bytes(), "tagging while remuxing gets the same file")
+
+	// a truncated stco is an error rather than a panic
+	moov := mkBox("moov", mkBox("trak", mkBox("mdia", mkBox("minf", mkBox("stbl", mkBox("stco", []byte{0, 0, 0, 0}))))))
+	require.ErrorIs(t, shiftChunkOffsets(moov, 100), ErrInvalidBox)
+}
+
+func TestVerify(t *testing.T) {
+	tracks := mustReadFixtureTracks(t, "26349405204-1-30016.m4s")
+
+	var out bytes.Buffer
+
+	_, err := Remux(&out, tracks, nil)
+	require.NoError(t, err)
+
+	outFile := filepath.Join(t.TempDir(), "out.mp4")
+	require.NoError(t, os.WriteFile(outFile, out.Bytes(), 0o644))
+	assert.NoError(t, Verify(outFile))
+
+	require.NoError(t, os.WriteFile(outFile, out.Bytes()[:out.Len()-1], 0o644))
+	assert.ErrorIs(t, Verify(outFile), ErrInvalidBox, "truncated")
+
+	cached := filepath.Join(_fixtureDir, "26349405204-1-30016.m4s")
+	assert.ErrorIs(t, Verify(cached), ErrInvalidBox, "cached m4s has a prefix")
+}
+
+func TestProbe(t *testing.T) {
+	assert := assert.New(t)
+
+	tracks := append(mustReadFixtureTracks(t, "26349405204-1-30016.m4s"), mustReadFixtureTracks(t, "26349405204-1-30280.m4s")...)
+
+	var out bytes.Buffer
+
+	_, err := Remux(&out, tracks, nil)
+	require.NoError(t, err)
+
+	outFile := filepath.Join(t.TempDir(), "out.mp4")
+	require.NoError(t, os.WriteFile(outFile, out.Bytes(), 0o644))
+
+	info, err := Probe(outFile)
+	require.NoError(t, err)
+	require.Len(t, info.Tracks, 2)
+	assert.Positive(info.Duration)
+
+	for i, want := range []struct{ handler, codec string }{{"vide", "avc1"}, {"soun", "mp4a"}} {
+		got := info.Tracks[i]
+		assert.Equal(want.handler, got.Handler)
+		assert.Equal(want.codec, got.Codec)
+		assert.Len(tracks[i].Samples, got.Samples)
+		assert.InDelta(float64(tracks[i].Duration())/float64(tracks[i].Timescale), got.Duration.Seconds(), 0.001)
+		assert.InDelta(info.Duration.Seconds(), got.Duration.Seconds(), 0.1)
+	}
+
+	require.NoError(t, os.WriteFile(outFile, out.Bytes()[:out.Len()-1], 0o644))
+
+	_, err = Probe(outFile)
+	assert.ErrorIs(err, ErrInvalidBox, "truncated")
+
+	// the edit of duration 0 in the audio stream spans the whole media
+	out.Reset()
+
+	_, err = Remux(&out, tracks[1:], nil)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(outFile, out.Bytes(), 0o644))
+
+	info, err = Probe(outFile)
+	require.NoError(t, err)
+	assert.InDelta(info.Tracks[0].Duration.Seconds(), info.Duration.Seconds(), 0.1, "audio only")
+}
+
+// _fixtureASC is the AudioSpecificConfig of the fixture audio: AAC LC, 44100Hz, stereo
+var _fixtureASC = []byte{0x12, 0x10}
+
+// fixtureAVCC returns the avcC payload of the fixture video.
+func fixtureAVCC(t *testing.T, video *Track) []byte {
+	t.Helper()
+
+	i := bytes.Index(video.stsd, []byte("avcC"))
+	require.Positive(t, i, "avcC")
+
+	size := int(binary.BigEndian.Uint32(video.stsd[i-4:]))
+
+	return video.stsd[i+4 : i-4+size]
+}
+
+// writeFLV writes the samples of video and audio decoded in [from, to) seconds as a flv,
+// timestamps restart from 0 as the .blv segments do.
+func writeFLV(t *testing.T, video, audio *Track, from, to float64) []byte {
+	t.Helper()
+
+	type tag struct {
+		typ  byte
+		ts   int64
+		data []byte
+	}
+
+	tags := []tag{
+		{_flvTagVideo, 0, append([]byte{0x17, 0, 0, 0, 0}, fixtureAVCC(t, video)...)},
+		{_flvTagAudio, 0, append([]byte{0xaf, 0}, _fixtureASC...)},
+	}
+
+	for _, tr := range []*Track{video, audio} {
+		dts := uint64(0)
+
+		for _, s := range tr.Samples {
+			sec := float64(dts) / float64(tr.Timescale)
+			dts += uint64(s.Duration)
+
+			if sec < from || sec >= to {
+				continue
+			}
+
+			data := make([]byte, s.Size)
+			_, err := tr.src.ReadAt(data, s.Offset)
+			require.NoError(t, err)
+
+			ts := int64((sec - from) * _flvTimescale)
+
+			if tr == audio {
+				tags = append(tags, tag{_flvTagAudio, ts, append([]byte{0xaf, 1}, data...)})
+				continue
+			}
+
+			frameType := byte(2)
+			if s.Sync {
+				frameType = _flvKeyFrame
+			}
+
+			cts := s.CompositionOffset * _flvTimescale / int32(tr.Timescale)
+			header := []byte{frameType<<4 | _flvCodecAVC, 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+			tags = append(tags, tag{_flvTagVideo, ts, append(header, data...)})
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].ts < tags[j].ts })
+
+	out := []byte("FLV\x01\x05")
+	out = binary.BigEndian.AppendUint32(out, _flvHeaderLen)
+	out = binary.BigEndian.AppendUint32(out, 0)
+
+	for _, tg := range tags {
+		size := len(tg.data)
+		out = append(out, tg.typ, byte(size>>16), byte(size>>8), byte(size))
+		out = append(out, byte(tg.ts>>16), byte(tg.ts>>8), byte(tg.ts), byte(tg.ts>>24), 0, 0, 0)
+		out = append(out, tg.data...)
+		out = binary.BigEndian.AppendUint32(out, uint32(_flvTagHeaderLen+size))
+	}
+
+	return out
+}
+
+func TestReadFLV(t *testing.T) {
+	assert := assert.New(t)
+
+	video := mustReadFixtureTracks(t, "26349405204-1-30016.m4s")[0]
+	audio := mustReadFixtureTracks(t, "26349405204-1-30280.m4s")[0]
+
+	// split at a key frame in the middle, as the segments are cut
+	split, dts := 0.0, uint64(0)
+
+	for _, s := range video.Samples {
+		if sec := float64(dts) / float64(video.Timescale); s.Sync && sec > 20 {
+			split = sec
+			break
+		}
+
+		dts += uint64(s.Duration)
+	}
+
+	require.Positive(t, split)
+
+	segments := []*io.SectionReader{}
+
+	for _, seg := range [][2]float64{{0, split}, {split, 1000}} {
+		data := writeFLV(t, video, audio, seg[0], seg[1])
+		segments = append(segments, io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	}
+
+	tracks, err := ReadFLV(segments...)
+	require.NoError(t, err)
+	require.Len(t, tracks, 2)
+
+	assert.Equal("avc1", tracks[0].CodecTag())
+	assert.Equal("mp4a", tracks[1].CodecTag())
+	assert.Len(tracks[0].Samples, len(video.Samples))
+	assert.Len(tracks[1].Samples, len(audio.Samples))
+	assert.Equal(uint32(44100), tracks[1].Timescale)
+
+	// the second segment restarts from 0, so it's shifted after the first one
+	assert.InDelta(53.5, float64(tracks[0].Duration())/float64(tracks[0].Timescale), 0.2)
+	assert.InDelta(53.5, float64(tracks[1].Duration())/float64(tracks[1].Timescale), 0.2)
+
+	// width and height are parsed from SPS, the same as the fixture tkhd
+	assert.Equal(video.tkhd[len(video.tkhd)-8:], tracks[0].tkhd[len(tracks[0].tkhd)-8:], "width and height")
+
+	var out bytes.Buffer
+
+	_, err = Remux(&out, tracks, nil)
+	require.NoError(t, err)
+	assertFirstSamples(t, out.Bytes(), tracks)
+
+	outFile := filepath.Join(t.TempDir(), "out.mp4")
+	require.NoError(t, os.WriteFile(outFile, out.Bytes(), 0o644))
+	assert.NoError(Verify(outFile))
+
+	_, err = ReadFLV(io.NewSectionReader(bytes.NewReader([]byte("not flv data")), 0, 12))
+	assert.ErrorIs(err, ErrNotFLV)
+}
@@ -0,0 +1,579 @@
+package mp4
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// chunk is a run of contiguous samples of one track, written to mdat as a whole.
+type chunk struct {
+	track  int
+	first  int
+	count  int
+	offset int64
+	size   int64
+	// start is the decode time in seconds, used to interleave tracks
+	start float64
+}
+
+// RemuxFiles merges the fragmented mp4 inputs (e.g. the dash video and audio streams) into output,
+// meta is optional.
+func RemuxFiles(output string, meta *Metadata, inputs ...string) error {
+	tracks, closeInputs, err := OpenFragmented(inputs...)
+	if err != nil {
+		return err
+	}
+	defer closeInputs()
+
+	fout, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+
+	if _, err := Remux(fout, tracks, meta); err != nil {
+		return err
+	}
+
+	return fout.Close()
+}
+
+// OpenFragmented reads the tracks of the fragmented mp4 inputs, samples are read from the files
+// until closeInputs is called.
+func OpenFragmented(inputs ...string) (tracks []*Track, closeInputs func(), err error) {
+	files := []*os.File{}
+	closeInputs = func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			closeInputs()
+		}
+	}()
+
+	for _, input := range inputs {
+		fin, err := os.Open(input)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		files = append(files, fin)
+
+		st, err := fin.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		got, err := ReadFragmented(fin, st.Size())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tracks = append(tracks, got...)
+	}
+
+	return tracks, closeInputs, nil
+}
+
+// Remux writes tracks into w as a progressive mp4 with moov in front of mdat, meta is optional.
+func Remux(w io.Writer, tracks []*Track, meta *Metadata) (int64, error) {
+	if len(tracks) == 0 {
+		return 0, ErrNoTrack
+	}
+
+	for _, t := range tracks {
+		if len(t.Samples) == 0 {
+			return 0, ErrNoSamples
+		}
+	}
+
+	chunks, mdatSize := interleave(tracks)
+	udta := mkUdta(meta)
+
+	ftyp := mkFtyp(tracks)
+
+	mdatHdrLen := int64(_boxHeaderLen)
+	if mdatSize+_boxHeaderLen > math.MaxUint32 {
+		mdatHdrLen = _largeBoxHeaderLen
+	}
+
+	// moov size only depends on whether co64 is used, so build it once to measure
+	useCo64 := false
+	moovSize := int64(len(mkMoov(tracks, chunks, udta, 0, useCo64)))
+
+	if int64(len(ftyp))+moovSize+mdatHdrLen+mdatSize > math.MaxUint32 {
+		useCo64 = true
+		moovSize = int64(len(mkMoov(tracks, chunks, udta, 0, useCo64)))
+	}
+
+	mdatStart := int64(len(ftyp)) + moovSize + mdatHdrLen
+	moov := mkMoov(tracks, chunks, udta, mdatStart, useCo64)
+
+	bw := bufio.NewWriterSize(w, 1<<20)
+	written := int64(0)
+
+	for _, b := range [][]byte{ftyp, moov, mkMdatHeader(mdatSize, mdatHdrLen)} {
+		n, err := bw.Write(b)
+		written += int64(n)
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	for _, c := range chunks {
+		n, err := io.Copy(bw, io.NewSectionReader(tracks[c.track].src, c.offset, c.size))
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, bw.Flush()
+}
+
+// interleave orders the sample runs of all tracks by decode time.
+func interleave(tracks []*Track) ([]chunk, int64) {
+	chunks := []chunk{}
+
+	for ti, t := range tracks {
+		dts := uint64(0)
+		next := 0
+
+		for _, run := range t.runs {
+			for ; next < run[0]; next++ {
+				dts += uint64(t.Samples[next].Duration)
+			}
+
+			c := chunk{
+				track:  ti,
+				first:  run[0],
+				count:  run[1] - run[0],
+				offset: t.Samples[run[0]].Offset,
+				start:  float64(dts) / float64(max(t.Timescale, 1)),
+			}
+
+			for i := run[0]; i < run[1]; i++ {
+				c.size += int64(t.Samples[i].Size)
+			}
+
+			chunks = append(chunks, c)
+		}
+	}
+
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].start < chunks[j].start
+	})
+
+	total := int64(0)
+	for _, c := range chunks {
+		total += c.size
+	}
+
+	return chunks, total
+}
+
+func mkFtyp(tracks []*Track) []byte {
+	brands := []string{"isom", "iso2"}
+
+	for _, t := range tracks {
+		if t.CodecTag() == "avc1" {
+			brands = append(brands, "avc1")
+			break
+		}
+	}
+
+	brands = append(brands, "mp41")
+
+	payload := []byte("isom")
+	payload = binary.BigEndian.AppendUint32(payload, 0x200)
+
+	for _, b := range brands {
+		payload = append(payload, b...)
+	}
+
+	return mkBox("ftyp", payload)
+}
+
+func mkMdatHeader(size, hdrLen int64) []byte {
+	if hdrLen == _largeBoxHeaderLen {
+		hdr := binary.BigEndian.AppendUint32(nil, 1)
+		hdr = append(hdr, "mdat"...)
+
+		return binary.BigEndian.AppendUint64(hdr, uint64(size+hdrLen))
+	}
+
+	hdr := binary.BigEndian.AppendUint32(nil, uint32(size+hdrLen))
+
+	return append(hdr, "mdat"...)
+}
+
+func mkMoov(tracks []*Track, chunks []chunk, udta []byte, mdatStart int64, useCo64 bool) []byte {
+	// chunk offsets of each track in output
+	offsets := make([][]int64, len(tracks))
+	counts := make([][]int, len(tracks))
+	pos := mdatStart
+
+	for _, c := range chunks {
+		offsets[c.track] = append(offsets[c.track], pos)
+		counts[c.track] = append(counts[c.track], c.count)
+		pos += c.size
+	}
+
+	movieDuration := uint64(0)
+	traks := [][]byte{}
+
+	for i, t := range tracks {
+		trakDuration := t.presentationDuration()
+		movieDuration = max(movieDuration, trakDuration)
+
+		traks = append(traks, mkTrak(t, uint32(i+1), trakDuration, counts[i], offsets[i], useCo64))
+	}
+
+	boxes := [][]byte{mkMvhd(movieDuration, uint32(len(tracks)+1))}
+	boxes = append(boxes, traks...)
+
+	if udta != nil {
+		boxes = append(boxes, udta)
+	}
+
+	return mkBox("moov", boxes...)
+}
+
+// presentationDuration returns the track duration in the output movie timescale.
+func (t *Track) presentationDuration() uint64 {
+	if len(t.Edits) == 0 {
+		return rescale(t.Duration(), t.Timescale, _movieTimescale)
+	}
+
+	total := uint64(0)
+	for _, e := range t.Edits {
+		total += t.editDuration(e)
+	}
+
+	return total
+}
+
+// editDuration returns the duration of e in the output movie timescale. An edit of duration 0 in fragmented
+// streams spans the rest of the media, it's the media duration after MediaTime then.
+func (t *Track) editDuration(e Edit) uint64 {
+	if e.SegmentDuration != 0 {
+		return rescale(e.SegmentDuration, t.movieTimescale, _movieTimescale)
+	}
+
+	media := t.Duration()
+	if e.MediaTime > 0 {
+		media -= min(media, uint64(e.MediaTime))
+	}
+
+	return rescale(media, t.Timescale, _movieTimescale)
+}
+
+func rescale(v uint64, from, to uint32) uint64 {
+	if from == 0 || from == to {
+		return v
+	}
+
+	return v * uint64(to) / uint64(from)
+}
+
+var _unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func mkMvhd(duration uint64, nextTrackID uint32) []byte {
+	version := uint8(0)
+	payload := []byte{}
+
+	if duration > math.MaxUint32 {
+		version = 1
+		payload = binary.BigEndian.AppendUint64(payload, 0)
+		payload = binary.BigEndian.AppendUint64(payload, 0)
+		payload = binary.BigEndian.AppendUint32(payload, _movieTimescale)
+		payload = binary.BigEndian.AppendUint64(payload, duration)
+	} else {
+		payload = binary.BigEndian.AppendUint32(payload, 0)
+		payload = binary.BigEndian.AppendUint32(payload, 0)
+		payload = binary.BigEndian.AppendUint32(payload, _movieTimescale)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(duration))
+	}
+
+	// rate 1.0, volume 1.0, reserved
+	payload = binary.BigEndian.AppendUint32(payload, 0x00010000)
+	payload = binary.BigEndian.AppendUint16(payload, 0x0100)
+	payload = append(payload, make([]byte, 10)...)
+
+	for _, m := range _unityMatrix {
+		payload = binary.BigEndian.AppendUint32(payload, m)
+	}
+
+	// pre_defined
+	payload = append(payload, make([]byte, 24)...)
+	payload = binary.BigEndian.AppendUint32(payload, nextTrackID)
+
+	return mkFullBox("mvhd", version, 0, payload)
+}
+
+func mkTrak(t *Track, id uint32, duration uint64, counts []int, offsets []int64, useCo64 bool) []byte {
+	boxes := [][]byte{mkTkhd(t, id, duration)}
+
+	if len(t.Edits) != 0 {
+		boxes = append(boxes, mkEdts(t))
+	}
+
+	minf := [][]byte{}
+	if t.mediaHeader != nil {
+		minf = append(minf, t.mediaHeader)
+	}
+
+	if t.dinf != nil {
+		minf = append(minf, t.dinf)
+	}
+
+	minf = append(minf, mkStbl(t, counts, offsets, useCo64))
+
+	mdia := mkBox("mdia", mkMdhd(t), t.hdlr, mkBox("minf", minf...))
+	boxes = append(boxes, mdia)
+
+	return mkBox("trak", boxes...)
+}
+
+func mkTkhd(t *Track, id uint32, duration uint64) []byte {
+	// layer, alternate_group, volume, reserved, matrix, width and height are kept from source
+	const tailLen = 52
+
+	_, flags := newFieldReader(t.tkhd[_boxHeaderLen:]).versionAndFlags()
+	tail := make([]byte, tailLen)
+
+	if len(t.tkhd) >= tailLen {
+		copy(tail, t.tkhd[len(t.tkhd)-tailLen:])
+	}
+
+	version := uint8(0)
+	payload := []byte{}
+
+	if duration > math.MaxUint32 {
+		version = 1
+		payload = binary.BigEndian.AppendUint64(payload, 0)
+		payload = binary.BigEndian.AppendUint64(payload, 0)
+		payload = binary.BigEndian.AppendUint32(payload, id)
+		payload = binary.BigEndian.AppendUint32(payload, 0)
+		payload = binary.BigEndian.AppendUint64(payload, duration)
+	} else {
+		payload = binary.BigEndian.AppendUint32(payload, 0)
+		payload = binary.BigEndian.AppendUint32(payload, 0)
+		payload = binary.BigEndian.AppendUint32(payload, id)
+		payload = binary.BigEndian.AppendUint32(payload, 0)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(duration))
+	}
+
+	// reserved
+	payload = append(payload, make([]byte, 8)...)
+	payload = append(payload, tail...)
+
+	return mkFullBox("tkhd", version, flags, payload)
+}
+
+func mkEdts(t *Track) []byte {
+	version := uint8(0)
+
+	for _, e := range t.Edits {
+		if t.editDuration(e) > math.MaxUint32 || e.MediaTime > math.MaxInt32 {
+			version = 1
+		}
+	}
+
+	payload := binary.BigEndian.AppendUint32(nil, uint32(len(t.Edits)))
+
+	for _, e := range t.Edits {
+		dur := t.editDuration(e)
+
+		if version == 1 {
+			payload = binary.BigEndian.AppendUint64(payload, dur)
+			payload = binary.BigEndian.AppendUint64(payload, uint64(e.MediaTime))
+		} else {
+			payload = binary.BigEndian.AppendUint32(payload, uint32(dur))
+			payload = binary.BigEndian.AppendUint32(payload, uint32(int32(e.MediaTime)))
+		}
+
+		payload = binary.BigEndian.AppendUint32(payload, e.MediaRate)
+	}
+
+	return mkBox("edts", mkFullBox("elst", version, 0, payload))
+}
+
+func mkMdhd(t *Track) []byte {
+	// language and pre_defined are kept from source
+	const tailLen = 4
+
+	tail := []byte{0x55, 0xc4, 0, 0} // und
+	if len(t.mdhd) >= tailLen {
+		tail = t.mdhd[len(t.mdhd)-tailLen:]
+	}
+
+	duration := t.Duration()
+	version := uint8(0)
+	payload := []byte{}
+
+	if duration > math.MaxUint32 {
+		version = 1
+		payload = binary.BigEndian.AppendUint64(payload, 0)
+		payload = binary.BigEndian.AppendUint64(payload, 0)
+		payload = binary.BigEndian.AppendUint32(payload, t.Timescale)
+		payload = binary.BigEndian.AppendUint64(payload, duration)
+	} else {
+		payload = binary.BigEndian.AppendUint32(payload, 0)
+		payload = binary.BigEndian.AppendUint32(payload, 0)
+		payload = binary.BigEndian.AppendUint32(payload, t.Timescale)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(duration))
+	}
+
+	payload = append(payload, tail...)
+
+	return mkFullBox("mdhd", version, 0, payload)
+}
+
+func mkStbl(t *Track, counts []int, offsets []int64, useCo64 bool) []byte {
+	boxes := [][]byte{t.stsd, mkStts(t.Samples)}
+
+	if ctts := mkCtts(t.Samples); ctts != nil {
+		boxes = append(boxes, ctts)
+	}
+
+	if stss := mkStss(t.Samples); stss != nil {
+		boxes = append(boxes, stss)
+	}
+
+	boxes = append(boxes, mkStsc(counts), mkStsz(t.Samples), mkStco(offsets, useCo64))
+
+	return mkBox("stbl", boxes...)
+}
+
+func mkStts(samples []Sample) []byte {
+	entries := []byte{}
+	count := uint32(0)
+
+	for i := 0; i < len(samples); {
+		j := i
+		for j < len(samples) && samples[j].Duration == samples[i].Duration {
+			j++
+		}
+
+		entries = binary.BigEndian.AppendUint32(entries, uint32(j-i))
+		entries = binary.BigEndian.AppendUint32(entries, samples[i].Duration)
+		count++
+		i = j
+	}
+
+	return mkFullBox("stts", 0, 0, binary.BigEndian.AppendUint32(nil, count), entries)
+}
+
+func mkCtts(samples []Sample) []byte {
+	version := uint8(0)
+	needed := false
+
+	for _, s := range samples {
+		if s.CompositionOffset != 0 {
+			needed = true
+		}
+
+		if s.CompositionOffset < 0 {
+			version = 1
+		}
+	}
+
+	if !needed {
+		return nil
+	}
+
+	entries := []byte{}
+	count := uint32(0)
+
+	for i := 0; i < len(samples); {
+		j := i
+		for j < len(samples) && samples[j].CompositionOffset == samples[i].CompositionOffset {
+			j++
+		}
+
+		entries = binary.BigEndian.AppendUint32(entries, uint32(j-i))
+		entries = binary.BigEndian.AppendUint32(entries, uint32(samples[i].CompositionOffset))
+		count++
+		i = j
+	}
+
+	return mkFullBox("ctts", version, 0, binary.BigEndian.AppendUint32(nil, count), entries)
+}
+
+// mkStss returns nil when every sample is a sync sample.
+func mkStss(samples []Sample) []byte {
+	entries := []byte{}
+	count := uint32(0)
+
+	for i, s := range samples {
+		if s.Sync {
+			entries = binary.BigEndian.AppendUint32(entries, uint32(i+1))
+			count++
+		}
+	}
+
+	if int(count) == len(samples) {
+		return nil
+	}
+
+	return mkFullBox("stss", 0, 0, binary.BigEndian.AppendUint32(nil, count), entries)
+}
+
+func mkStsc(counts []int) []byte {
+	entries := []byte{}
+	total := uint32(0)
+
+	for i, c := range counts {
+		if i > 0 && counts[i-1] == c {
+			continue
+		}
+
+		entries = binary.BigEndian.AppendUint32(entries, uint32(i+1))
+		entries = binary.BigEndian.AppendUint32(entries, uint32(c))
+		// sample_description_index
+		entries = binary.BigEndian.AppendUint32(entries, 1)
+		total++
+	}
+
+	return mkFullBox("stsc", 0, 0, binary.BigEndian.AppendUint32(nil, total), entries)
+}
+
+func mkStsz(samples []Sample) []byte {
+	// sample_size 0 means sizes are listed per sample
+	payload := binary.BigEndian.AppendUint32(nil, 0)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(samples)))
+
+	for _, s := range samples {
+		payload = binary.BigEndian.AppendUint32(payload, s.Size)
+	}
+
+	return mkFullBox("stsz", 0, 0, payload)
+}
+
+func mkStco(offsets []int64, useCo64 bool) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(len(offsets)))
+
+	if useCo64 {
+		for _, o := range offsets {
+			payload = binary.BigEndian.AppendUint64(payload, uint64(o))
+		}
+
+		return mkFullBox("co64", 0, 0, payload)
+	}
+
+	for _, o := range offsets {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(o))
+	}
+
+	return mkFullBox("stco", 0, 0, payload)
+}
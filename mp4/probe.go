@@ -0,0 +1,153 @@
+package mp4
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Info is the summary of a progressive mp4 read by Probe.
+type Info struct {
+	// Duration is from mvhd
+	Duration time.Duration
+	Tracks   []TrackInfo
+}
+
+// TrackInfo is a track of a progressive mp4.
+type TrackInfo struct {
+	ID uint32
+	// Handler is the handler type, e.g. vide or soun
+	Handler string
+	// Codec is the type of the first sample entry, e.g. avc1, hvc1 or mp4a
+	Codec    string
+	Duration time.Duration
+	Samples  int
+}
+
+// Probe checks file by Verify, then reads the duration and tracks of its moov.
+func Probe(file string) (*Info, error) {
+	if err := Verify(file); err != nil {
+		return nil, err
+	}
+
+	fin, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+
+	st, err := fin.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := readBoxHeaders(fin, 0, st.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range headers {
+		if h.typ != "moov" {
+			continue
+		}
+
+		moov, err := readBox(fin, h)
+		if err != nil {
+			return nil, err
+		}
+
+		return parseInfo(moov)
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrNoMoov, file)
+}
+
+func parseInfo(moov rawBox) (*Info, error) {
+	info := &Info{}
+
+	mvhd, ok := moov.child("mvhd")
+	if !ok {
+		return nil, fmt.Errorf("%w: mvhd", ErrMissingHeader)
+	}
+
+	timescale, duration, err := readTimes(mvhd)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Duration = scaleDuration(duration, timescale)
+
+	boxes, err := moov.children()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, box := range boxes {
+		if box.typ != "trak" {
+			continue
+		}
+
+		t, err := parseTrak(box)
+		if err != nil {
+			return nil, err
+		}
+
+		track := TrackInfo{ID: t.ID, Handler: t.Handler, Codec: t.CodecTag()}
+
+		mdhd, _ := box.child("mdia", "mdhd")
+
+		timescale, duration, err := readTimes(mdhd)
+		if err != nil {
+			return nil, err
+		}
+
+		track.Duration = scaleDuration(duration, timescale)
+
+		// version/flags(4) + sample_size(4) + sample_count(4)
+		if stsz, ok := box.child("mdia", "minf", "stbl", "stsz"); ok {
+			fr := newFieldReader(stsz.payload)
+			fr.skip(8)
+			track.Samples = int(fr.u32())
+		}
+
+		info.Tracks = append(info.Tracks, track)
+	}
+
+	return info, nil
+}
+
+// readTimes reads the timescale and duration of mvhd or mdhd, which share the same layout.
+func readTimes(box rawBox) (uint32, uint64, error) {
+	fr := newFieldReader(box.payload)
+
+	var duration uint64
+
+	v, _ := fr.versionAndFlags()
+	if v == 1 {
+		fr.skip(16)
+	} else {
+		fr.skip(8)
+	}
+
+	timescale := fr.u32()
+
+	if v == 1 {
+		duration = fr.u64()
+	} else {
+		duration = uint64(fr.u32())
+	}
+
+	if fr.err != nil {
+		return 0, 0, fmt.Errorf("%w: %s", fr.err, box.typ)
+	}
+
+	return timescale, duration, nil
+}
+
+func scaleDuration(duration uint64, timescale uint32) time.Duration {
+	if timescale == 0 {
+		return 0
+	}
+
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+}
@@ -0,0 +1,63 @@
+package mp4
+
+import (
+	"fmt"
+	"os"
+)
+
+// Verify checks file is a complete progressive mp4, i.e. it starts with ftyp,
+// boxes span the whole file, moov has tracks and mdat is not empty.
+func Verify(file string) error {
+	fin, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	st, err := fin.Stat()
+	if err != nil {
+		return err
+	}
+
+	// a truncated file fails here, as the last box exceeds the file size
+	headers, err := readBoxHeaders(fin, 0, st.Size())
+	if err != nil {
+		return err
+	}
+
+	if len(headers) == 0 || headers[0].typ != "ftyp" {
+		return fmt.Errorf("%w: %s", ErrNotMP4, file)
+	}
+
+	var moov *boxHeader
+
+	mdatSize := int64(0)
+
+	for i, h := range headers {
+		switch h.typ {
+		case "moov":
+			moov = &headers[i]
+		case "mdat":
+			mdatSize += h.payloadSize()
+		}
+	}
+
+	if moov == nil {
+		return fmt.Errorf("%w: %s", ErrNoMoov, file)
+	}
+
+	box, err := readBox(fin, *moov)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := box.child("trak"); !ok {
+		return fmt.Errorf("%w: %s", ErrNoTrack, file)
+	}
+
+	if mdatSize == 0 {
+		return fmt.Errorf("%w: empty mdat in %s", ErrNoSamples, file)
+	}
+
+	return nil
+}
@@ -1,21 +1,184 @@
 package utils
 
-import "os"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-const _ffmpeg = "ffmpeg"
+	"github.com/spf13/cast"
+)
+
+const (
+	_ffmpeg  = "ffmpeg"
+	_ffprobe = "ffprobe"
+)
+
+// PipeInputSupported is false where ffmpeg can't inherit the extra pipes, i.e. on windows.
+const PipeInputSupported = runtime.GOOS != "windows"
+
+var ErrPipeNotSupported = errors.New("pipe inputs are not supported on " + runtime.GOOS)
 
 func ConvertWithFfmpeg(inputFiles []string, output string, ffmpegBins ...string) (string, error) {
+	return ConvertWithFfmpegContext(context.Background(), inputFiles, output, nil, nil, ffmpegBins...)
+}
+
+// ConvertWithFfmpegContext merges inputFiles with codecArgs, e.g. `-c:v libx264 -c:a copy`, or by stream copy if nil,
+// ffmpeg is killed when ctx is done. onProgress receives the output time reported by `-progress`, it can be nil.
+func ConvertWithFfmpegContext(
+	ctx context.Context, inputFiles []string, output string, codecArgs []string, onProgress func(time.Duration),
+	ffmpegBins ...string,
+) (string, error) {
+	args := ffmpegArgs(inputFiles, output, codecArgs)
+
+	return RunCommandContext(ctx, ffmpegBin(ffmpegBins), args, ffmpegProgress(onProgress))
+}
+
+// ConcatWithFfmpegContext joins the segments of one stream (e.g. flv segments) by the concat demuxer,
+// the list file is written next to output and removed when done.
+func ConcatWithFfmpegContext(
+	ctx context.Context, segments []string, output string, codecArgs []string, onProgress func(time.Duration),
+	ffmpegBins ...string,
+) (string, error) {
+	list, err := os.CreateTemp(filepath.Dir(output), ".concat-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(list.Name())
+	defer list.Close()
+
+	for _, seg := range segments {
+		abs, err := filepath.Abs(seg)
+		if err != nil {
+			return "", err
+		}
+
+		// quotes are escaped as '\''
+		if _, err := fmt.Fprintf(list, "file '%s'\n", strings.ReplaceAll(abs, "'", `'\''`)); err != nil {
+			return "", err
+		}
+	}
+
+	if err := list.Close(); err != nil {
+		return "", err
+	}
+
+	args := append([]string{"-f", "concat", "-safe", "0"}, ffmpegArgs([]string{list.Name()}, output, codecArgs)...)
+
+	return RunCommandContext(ctx, ffmpegBin(ffmpegBins), args, ffmpegProgress(onProgress))
+}
+
+// FfprobeContext returns the format duration and the streams of file as ffprobe json, i.e.
+// `{"streams": [{"codec_name": "h264", "codec_type": "video", "codec_tag_string": "avc1", "disposition": {"attached_pic": 0}}...],
+// "format": {"duration": "60.0"}}`.
+func FfprobeContext(ctx context.Context, file string, ffprobeBins ...string) (string, error) {
+	args := []string{
+		"-v", "error",
+		"-show_entries", "format=duration:stream=codec_type,codec_name,codec_tag_string:stream_disposition=attached_pic",
+		"-of", "json",
+		file,
+	}
+
+	return RunCommandContext(ctx, ffprobeBin(ffprobeBins), args, nil)
+}
+
+// ConvertReadersWithFfmpegContext is ConvertWithFfmpegContext with inputs fed to ffmpeg through pipes(pipe:3, pipe:4...),
+// so nothing is copied to disk. The inputs must be readable from start to end, e.g. fragmented mp4 with moov in front.
+func ConvertReadersWithFfmpegContext(
+	ctx context.Context, inputs []io.Reader, output string, codecArgs []string, onProgress func(time.Duration),
+	ffmpegBins ...string,
+) (string, error) {
+	if !PipeInputSupported {
+		return "", ErrPipeNotSupported
+	}
+
+	names := []string{}
+	readEnds := []*os.File{}
+	writeEnds := []*os.File{}
+
+	// the write ends are closed once fed, closing again is harmless
+	defer func() {
+		for _, f := range append(readEnds, writeEnds...) {
+			f.Close()
+		}
+	}()
+
+	for i := range inputs {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return "", err
+		}
+
+		readEnds = append(readEnds, r)
+		writeEnds = append(writeEnds, w)
+		// ExtraFiles[i] becomes fd 3+i of ffmpeg
+		names = append(names, fmt.Sprintf("pipe:%d", 3+i))
+	}
+
+	cmd := exec.CommandContext(ctx, ffmpegBin(ffmpegBins), ffmpegArgs(names, output, codecArgs)...)
+	cmd.ExtraFiles = readEnds
+
+	feed := func() error {
+		// ffmpeg holds the read ends now, it gets EOF only if ours are closed
+		for _, r := range readEnds {
+			r.Close()
+		}
+
+		errs := make([]error, len(inputs))
+
+		var wg sync.WaitGroup
+
+		for i, input := range inputs {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				_, err := io.Copy(writeEnds[i], input)
+				writeEnds[i].Close()
+
+				// ffmpeg exited early, its own error is reported instead
+				if !errors.Is(err, syscall.EPIPE) {
+					errs[i] = err
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		return errors.Join(errs...)
+	}
+
+	return runCommand(ctx, cmd, ffmpegProgress(onProgress), feed)
+}
+
+// ffmpegArgs merges inputs into output with codecArgs, stream copy if nil.
+func ffmpegArgs(inputs []string, output string, codecArgs []string) []string {
 	args := []string{}
-	for _, file := range inputFiles {
+	for _, file := range inputs {
 		args = append(args, "-i", file)
 	}
 
+	if codecArgs == nil {
+		codecArgs = []string{"-c:v", "copy", "-c:a", "copy"}
+	}
+
+	args = append(args, codecArgs...)
+
 	fixedArgs := []string{
-		"-c:v", "copy",
-		"-c:a", "copy",
 		"-strict", "experimental",
 		"-hide_banner",
 		"-stats",
+		// key=value lines to stdout, e.g. out_time_us=1234567
+		"-progress", "pipe:1",
 	}
 
 	outputArgs := []string{
@@ -26,6 +189,10 @@ func ConvertWithFfmpeg(inputFiles []string, output string, ffmpegBins ...string)
 	args = append(args, fixedArgs...)
 	args = append(args, outputArgs...)
 
+	return args
+}
+
+func ffmpegBin(ffmpegBins []string) string {
 	bin := os.Getenv("BL_FFMPEG")
 	if len(ffmpegBins) != 0 {
 		bin = ffmpegBins[0]
@@ -35,5 +202,39 @@ func ConvertWithFfmpeg(inputFiles []string, output string, ffmpegBins ...string)
 		bin = _ffmpeg
 	}
 
-	return RunCommand(bin, args)
+	return bin
+}
+
+// ffprobeBin is BL_FFPROBE, or the ffprobe next to BL_FFMPEG, or ffprobe in PATH.
+func ffprobeBin(ffprobeBins []string) string {
+	if len(ffprobeBins) != 0 && ffprobeBins[0] != "" {
+		return ffprobeBins[0]
+	}
+
+	if bin := os.Getenv("BL_FFPROBE"); bin != "" {
+		return bin
+	}
+
+	if bin := os.Getenv("BL_FFMPEG"); strings.Contains(filepath.Base(bin), _ffmpeg) {
+		return filepath.Join(filepath.Dir(bin), strings.Replace(filepath.Base(bin), _ffmpeg, _ffprobe, 1))
+	}
+
+	return _ffprobe
+}
+
+// ffmpegProgress parses the `-progress` lines for onProgress, nil if onProgress is nil.
+func ffmpegProgress(onProgress func(time.Duration)) func(string) {
+	if onProgress == nil {
+		return nil
+	}
+
+	return func(line string) {
+		// out_time_ms is in microseconds as well, out_time_us is missing in old versions
+		key, value, ok := strings.Cut(line, "=")
+		if ok && (key == "out_time_us" || key == "out_time_ms") {
+			if us := cast.ToInt64(value); us > 0 {
+				onProgress(time.Duration(us) * time.Microsecond)
+			}
+		}
+	}
 }
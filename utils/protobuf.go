@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	ProtoVarint  = 0
+	ProtoFixed64 = 1
+	ProtoBytes   = 2
+	ProtoFixed32 = 5
+)
+
+var ErrInvalidProto = errors.New("invalid protobuf data")
+
+// ProtoField is a field decoded from protobuf wire format without schema,
+// Varint holds the value of varint/fixed fields, Bytes holds the value of length-delimited fields.
+type ProtoField struct {
+	Num    int
+	Type   int
+	Varint uint64
+	Bytes  []byte
+}
+
+// Int returns the varint as a signed value (int32/int64, not zigzag encoded).
+func (f ProtoField) Int() int64 {
+	return int64(f.Varint)
+}
+
+// ParseProto decodes the top level fields of a protobuf message,
+// nested messages can be decoded by calling ParseProto on the field Bytes.
+func ParseProto(data []byte) ([]ProtoField, error) {
+	fields := []ProtoField{}
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad field key", ErrInvalidProto)
+		}
+
+		data = data[n:]
+		field := ProtoField{Num: int(key >> 3), Type: int(key & 0x7)}
+
+		switch field.Type {
+		case ProtoVarint:
+			field.Varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("%w: bad varint of field %d", ErrInvalidProto, field.Num)
+			}
+
+			data = data[n:]
+		case ProtoFixed64:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("%w: short fixed64 of field %d", ErrInvalidProto, field.Num)
+			}
+
+			field.Varint = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case ProtoFixed32:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("%w: short fixed32 of field %d", ErrInvalidProto, field.Num)
+			}
+
+			field.Varint = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case ProtoBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return nil, fmt.Errorf("%w: bad length of field %d", ErrInvalidProto, field.Num)
+			}
+
+			field.Bytes = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return nil, fmt.Errorf("%w: unsupported wire type %d of field %d", ErrInvalidProto, field.Type, field.Num)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
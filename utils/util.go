@@ -2,14 +2,18 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/pterm/pterm"
 	"github.com/spf13/cast"
 )
 
+const _waitDelay = 2 * time.Second
+
 func ScanfInt(msg ...string) int {
 	result, _ := pterm.DefaultInteractiveTextInput.Show(msg...)
 	return cast.ToInt(result)
@@ -41,16 +45,112 @@ func SanitizeFilename(name string) string {
 }
 
 func RunCommand(name string, args []string) (string, error) {
-	cmd := exec.Command(name, args...)
+	return RunCommandContext(context.Background(), name, args, nil)
+}
+
+// RunCommandContext runs the command until it exits or ctx is done, onStdout(can be nil) receives stdout line by line.
+func RunCommandContext(ctx context.Context, name string, args []string, onStdout func(line string)) (string, error) {
+	return runCommand(ctx, exec.CommandContext(ctx, name, args...), onStdout, nil)
+}
+
+// runCommand runs cmd created with ctx, afterStart(can be nil) is called once cmd is started, e.g. to feed its pipes.
+func runCommand(ctx context.Context, cmd *exec.Cmd, onStdout func(line string), afterStart func() error) (string, error) {
+	// don't wait forever for the output of children once killed
+	cmd.WaitDelay = _waitDelay
 
 	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	cmd.Stdout = &lineWriter{buf: &stdout, onLine: onStdout}
+
+	if err := cmd.Start(); err != nil {
+		return "", &CommandError{Err: err}
+	}
+
+	var errAfterStart error
+	if afterStart != nil {
+		errAfterStart = afterStart()
+	}
+
+	err := cmd.Wait()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("command canceled: %w", ctx.Err())
+	}
 
-	err := cmd.Run()
 	if err != nil {
-		return "", fmt.Errorf("command execution failed: %w, stderr: %s", err, stderr.String())
+		return "", &CommandError{Err: err, Stderr: stderr.String()}
+	}
+
+	if errAfterStart != nil {
+		return "", errAfterStart
 	}
 
 	return strings.TrimSpace(stdout.String()), nil
 }
+
+// CommandError is returned by RunCommandContext when the command fails.
+type CommandError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("command execution failed: %v, stderr: %s", e.Err, e.Stderr)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// StderrTail returns the last n lines of Stderr.
+func (e *CommandError) StderrTail(n int) string {
+	lines := strings.Split(strings.TrimSpace(e.Stderr), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// lineWriter keeps everything written in buf, and calls onLine for each complete line.
+type lineWriter struct {
+	buf    *bytes.Buffer
+	onLine func(string)
+	// start of the incomplete line in buf
+	start int
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n, _ := w.buf.Write(p)
+	if w.onLine == nil {
+		return n, nil
+	}
+
+	for {
+		rest := w.buf.Bytes()[w.start:]
+
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			return n, nil
+		}
+
+		w.onLine(strings.TrimRight(string(rest[:i]), "\r"))
+		w.start += i + 1
+	}
+}
+
+// FormatBytes formats n in binary units, e.g. 1.5 MiB
+func FormatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}